@@ -1,24 +1,53 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/kjansson/yac-p/v3/pkg/collector/yace"
 	"github.com/kjansson/yac-p/v3/pkg/converter"
+	"github.com/kjansson/yac-p/v3/pkg/filter"
 	"github.com/kjansson/yac-p/v3/pkg/logger"
 	"github.com/kjansson/yac-p/v3/pkg/persister/prom"
+	"github.com/kjansson/yac-p/v3/pkg/processor/cardinality"
+	"github.com/kjansson/yac-p/v3/pkg/processor/externallabels"
+	"github.com/kjansson/yac-p/v3/pkg/processor/relabel"
+	"github.com/kjansson/yac-p/v3/pkg/processor/staleness"
 	"github.com/kjansson/yac-p/v3/pkg/types"
 )
 
+// staleSeries remembers the series sent by the previous invocation. It is kept outside the controller, which is created on every invocation, so it survives warm invocations.
+var staleSeries = staleness.NewMarker()
+
 func NewController(config Config) (*types.Controller, error) {
 
-	logger, err := logger.NewLogger(config.LogDestination, config.LogFormat, config.Debug)
+	// LOG_LEVEL takes precedence over DEBUG
+	logLevel := config.LogLevel
+	if logLevel == "" && config.Debug {
+		logLevel = "debug"
+	}
+	logger, err := logger.NewLogger(config.LogDestination, config.LogFormat, logger.LoggerOpts{
+		Level:           logLevel,
+		ComponentLevels: config.LogComponentLevels,
+		Attributes:      config.LogAttributes,
+		RedactPattern:   config.LogRedactPattern,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Records of the run carry its attributes, such as the Lambda request ID
+	logger = logger.With(config.LogRunAttrs...)
+
+	// The config file is loaded once, as it also holds the metric filters
+	configFile, err := config.ConfigFileLoader()
 	if err != nil {
 		return nil, err
 	}
 
 	collector, err := yace.NewYaceClient(
-		config.ConfigFileLoader,
+		logger.Component(types.ComponentCollector),
+		func() ([]byte, error) { return configFile, nil },
 		yace.YaceOpts{
 			YaceCloudwatchConcurrencyPerApiLimitEnabled:       config.YaceCloudwatchConcurrencyPerApiLimitEnabled,
 			YaceCloudwatchConcurrencyListMetricsLimit:         config.YaceCloudwatchConcurrencyListMetricsLimit,
@@ -33,42 +62,182 @@ func NewController(config Config) (*types.Controller, error) {
 		return nil, err
 	}
 
-	converter := converter.NewConverter(logger)
+	converter, err := converter.NewConverter(logger.Component(types.ComponentConverter), converter.ConverterOpts{
+		NativeHistograms:  config.NativeHistograms,
+		InvalidNames:      config.InvalidNames,
+		TimestampStrategy: config.TimestampStrategy,
+		TimestampOffset:   config.TimestampOffset,
+		ChunkSize:         config.StreamingChunkSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	persister, err := newPersister(config, prom.PromOpts{
+		MaxSeriesPerRequest: config.RemoteWriteMaxSeriesPerRequest,
+		MaxBytesPerRequest:  config.RemoteWriteMaxBytesPerRequest,
+		RequestConcurrency:  config.RemoteWriteConcurrency,
+		MaxRetries:          config.RemoteWriteMaxRetries,
+		MinBackoff:          config.RemoteWriteMinBackoff,
+		MaxBackoff:          config.RemoteWriteMaxBackoff,
+		MaxRetryDuration:    config.RemoteWriteMaxRetryDuration,
+		HTTPClient: prom.HTTPClientOpts{
+			Timeout:            config.RemoteWriteTimeout,
+			CAFile:             config.RemoteWriteTLSCAFile,
+			CertFile:           config.RemoteWriteTLSCertFile,
+			KeyFile:            config.RemoteWriteTLSKeyFile,
+			InsecureSkipVerify: config.RemoteWriteTLSInsecureSkipVerify,
+			ProxyURL:           config.RemoteWriteProxyURL,
+			ServerName:         config.RemoteWriteTLSServerName,
+		},
+		Headers:          config.RemoteWriteHeaders,
+		TenantID:         config.RemoteWriteTenantID,
+		Protocol:         config.RemoteWriteProtocol,
+		Metadata:         config.RemoteWriteMetadata,
+		MetadataInterval: config.RemoteWriteMetadataInterval,
+		OAuth2: prom.OAuth2Opts{
+			TokenURL:       config.OAuth2TokenURL,
+			ClientID:       config.OAuth2ClientID,
+			ClientSecret:   config.OAuth2ClientSecret,
+			Scopes:         config.OAuth2Scopes,
+			EndpointParams: config.OAuth2EndpointParams,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	persister, err := prom.NewPromClient(
-		config.RemoteWriteURL,
-		config.AuthType,
-		config.AuthToken,
-		config.Username,
-		config.Password,
-		config.Region,
-		config.PrometheusRegion,
-		config.AWSRoleARN,
-	)
+	// Secrets of the remote write targets are masked in logs and errors
+	if holder, ok := persister.(types.SecretHolder); ok {
+		logger.Redactor.AddSecrets(holder.Secrets()...)
+	}
+
+	filters, err := newFilters(config, configFile)
 	if err != nil {
 		return nil, err
 	}
 
+	// External labels are added before relabeling, like Prometheus does for remote write
+	processors := []types.MetricProcessor{}
+	var externalLabeler *externallabels.ExternalLabeler
+	if config.ExternalLabels != "" {
+		externalLabeler, err = externallabels.NewExternalLabeler(config.ExternalLabels, config.ExternalLabelsMode)
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, externalLabeler)
+	}
+	if config.RelabelConfigs != "" {
+		relabeler, err := relabel.NewRelabeler([]byte(config.RelabelConfigs))
+		if err != nil {
+			return nil, err
+		}
+		processors = append(processors, relabeler)
+	}
+	// Cardinality limits are applied last, to the series that are actually sent
+	if config.CardinalityMaxSeries != "" || config.CardinalityMaxSeriesPerMetric != "" || config.CardinalityMetricLimits != "" {
+		if config.StreamingChunkSize != "" {
+			return nil, fmt.Errorf("cardinality limits can't be used with streaming, as they need all time series at once")
+		}
+		limiter, err := cardinality.NewLimiter(config.CardinalityMaxSeries, config.CardinalityMaxSeriesPerMetric, config.CardinalityMetricLimits)
+		if err != nil {
+			return nil, err
+		}
+		if externalLabeler != nil {
+			limiter.Labels = externalLabeler.Labels
+		}
+		processors = append(processors, limiter)
+	}
+	if config.StalenessMarkers != "" {
+		enabled, err := strconv.ParseBool(config.StalenessMarkers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid staleness markers setting: %w", err)
+		}
+		if enabled {
+			if config.StreamingChunkSize != "" {
+				return nil, fmt.Errorf("staleness markers can't be used with streaming, as they need all time series at once")
+			}
+			processors = append(processors, staleSeries)
+		}
+	}
+
 	c := &types.Controller{
-		Logger:    logger,
-		Collector: collector,
-		Converter: converter,
-		Persister: persister,
+		Logger:     logger,
+		Collector:  collector,
+		Filters:    filters,
+		Converter:  converter,
+		Processors: processors,
+		Persister:  persister,
 	}
 
 	return c, nil
 }
 
+// newFilters creates the metric filters from the environment, or from the filters section of the config file if not set in the environment
+func newFilters(config Config, configFile []byte) ([]types.MetricFilter, error) {
+
+	var filterConfig filter.FilterConfig
+	var err error
+	if config.MetricFilters != "" {
+		filterConfig, err = filter.ParseFilterConfig([]byte(config.MetricFilters))
+	} else {
+		filterConfig, err = filter.ParseConfigFileFilters(configFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if filterConfig.IsEmpty() {
+		return nil, nil
+	}
+
+	f, err := filter.NewFilter(filterConfig)
+	if err != nil {
+		return nil, err
+	}
+	return []types.MetricFilter{f}, nil
+}
+
 type Config struct {
 	Debug                                             bool   `env:"DEBUG"`
 	RemoteWriteURL                                    string `env:"PROMETHEUS_REMOTE_WRITE_URL"`
 	AuthType                                          string `env:"AUTH_TYPE"`
-	AuthToken                                         string `env:"AUTH_TYPE"`
+	AuthToken                                         string `env:"AUTH_TOKEN"`
 	Username                                          string `env:"USERNAME"`
 	Password                                          string `env:"PASSWORD"`
 	Region                                            string `env:"AWS_REGION"`
 	PrometheusRegion                                  string `env:"PROMETHEUS_REGION"`
 	AWSRoleARN                                        string `env:"AWS_ROLE_ARN"`
+	OAuth2TokenURL                                    string `env:"OAUTH2_TOKEN_URL"`
+	OAuth2ClientID                                    string `env:"OAUTH2_CLIENT_ID"`
+	OAuth2ClientSecret                                string `env:"OAUTH2_CLIENT_SECRET"`
+	OAuth2Scopes                                      string `env:"OAUTH2_SCOPES"`
+	OAuth2EndpointParams                              string `env:"OAUTH2_ENDPOINT_PARAMS"`
+	RemoteWriteTargets                                string `env:"REMOTE_WRITE_TARGETS"`
+	RemoteWriteFanoutPolicy                           string `env:"REMOTE_WRITE_FANOUT_POLICY"`
+	SpoolDir                                          string `env:"SPOOL_DIR"`
+	SpoolS3Bucket                                     string `env:"SPOOL_S3_BUCKET"`
+	SpoolS3Prefix                                     string `env:"SPOOL_S3_PREFIX"`
+	SpoolMaxAge                                       string `env:"SPOOL_MAX_AGE"`
+	SpoolMaxBytes                                     string `env:"SPOOL_MAX_BYTES"`
+	RemoteWriteMaxSeriesPerRequest                    string `env:"REMOTE_WRITE_MAX_SERIES_PER_REQUEST"`
+	RemoteWriteMaxBytesPerRequest                     string `env:"REMOTE_WRITE_MAX_BYTES_PER_REQUEST"`
+	RemoteWriteConcurrency                            string `env:"REMOTE_WRITE_CONCURRENCY"`
+	RemoteWriteMaxRetries                             string `env:"REMOTE_WRITE_MAX_RETRIES"`
+	RemoteWriteMinBackoff                             string `env:"REMOTE_WRITE_MIN_BACKOFF"`
+	RemoteWriteMaxBackoff                             string `env:"REMOTE_WRITE_MAX_BACKOFF"`
+	RemoteWriteMaxRetryDuration                       string `env:"REMOTE_WRITE_MAX_RETRY_DURATION"`
+	RemoteWriteTimeout                                string `env:"REMOTE_WRITE_TIMEOUT"`
+	RemoteWriteTLSCAFile                              string `env:"REMOTE_WRITE_TLS_CA_FILE"`
+	RemoteWriteTLSCertFile                            string `env:"REMOTE_WRITE_TLS_CERT_FILE"`
+	RemoteWriteTLSKeyFile                             string `env:"REMOTE_WRITE_TLS_KEY_FILE"`
+	RemoteWriteTLSInsecureSkipVerify                  string `env:"REMOTE_WRITE_TLS_INSECURE_SKIP_VERIFY"`
+	RemoteWriteTLSServerName                          string `env:"REMOTE_WRITE_TLS_SERVER_NAME"`
+	RemoteWriteProxyURL                               string `env:"REMOTE_WRITE_PROXY_URL"`
+	RemoteWriteHeaders                                string `env:"REMOTE_WRITE_HEADERS"`
+	RemoteWriteTenantID                               string `env:"REMOTE_WRITE_TENANT_ID"`
+	RemoteWriteProtocol                               string `env:"REMOTE_WRITE_PROTOCOL"`
+	RemoteWriteMetadata                               string `env:"REMOTE_WRITE_METADATA"`
+	RemoteWriteMetadataInterval                       string `env:"REMOTE_WRITE_METADATA_INTERVAL"`
 	YaceCloudwatchConcurrencyPerApiLimitEnabled       string `env:"YACE_CLOUDWATCH_CONCURRENCY_PER_API_LIMIT_ENABLED"`
 	YaceCloudwatchConcurrencyListMetricsLimit         string `env:"YACE_CLOUDWATCH_CONCURRENCY_LIST_METRICS_LIMIT"`
 	YaceCloudwatchConcurrencyGetMetricDataLimit       string `env:"YACE_CLOUDWATCH_CONCURRENCY_GET_METRIC_DATA_LIMIT"`
@@ -77,7 +246,26 @@ type Config struct {
 	YaceTaggingAPIConcurrency                         string `env:"YACE_TAGGING_API_CONCURRENCY"`
 	YaceCloudwatchConcurrency                         string `env:"YACE_CLOUDWATCH_CONCURRENCY"`
 	ConfigFileLoader                                  func() ([]byte, error)
+	ExternalLabels                                    string `env:"EXTERNAL_LABELS"`
+	ExternalLabelsMode                                string `env:"EXTERNAL_LABELS_MODE"`
+	RelabelConfigs                                    string `env:"RELABEL_CONFIGS"`
+	MetricFilters                                     string `env:"METRIC_FILTERS"`
+	CardinalityMaxSeries                              string `env:"CARDINALITY_MAX_SERIES"`
+	CardinalityMaxSeriesPerMetric                     string `env:"CARDINALITY_MAX_SERIES_PER_METRIC"`
+	CardinalityMetricLimits                           string `env:"CARDINALITY_METRIC_LIMITS"`
+	StalenessMarkers                                  string `env:"STALENESS_MARKERS"`
+	NativeHistograms                                  string `env:"NATIVE_HISTOGRAMS"`
+	InvalidNames                                      string `env:"INVALID_NAMES"`
+	TimestampStrategy                                 string `env:"TIMESTAMP_STRATEGY"`
+	StreamingChunkSize                                string `env:"STREAMING_CHUNK_SIZE"`
+	TimestampOffset                                   string `env:"TIMESTAMP_OFFSET"`
+	PersistTimeReserve                                string `env:"PERSIST_TIME_RESERVE"`
 	LogFormat                                         string `env:"LOG_FORMAT"`
 	LogLevel                                          string `env:"LOG_LEVEL"`
+	LogComponentLevels                                string `env:"LOG_COMPONENT_LEVELS"`
+	LogAttributes                                     string `env:"LOG_ATTRIBUTES"`
+	LogRedactPattern                                  string `env:"LOG_REDACT_PATTERN"`
+	TracingExporter                                   string `env:"TRACING_EXPORTER"`
 	LogDestination                                    *os.File
+	LogRunAttrs                                       []any // Attributes added to every log record of the run
 }
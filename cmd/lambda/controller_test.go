@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	defcon "github.com/kjansson/defcon"
+	"github.com/kjansson/yac-p/v3/internal/test_utils"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+)
+
+func TestAuthTokenSecret(t *testing.T) {
+
+	t.Setenv("PROMETHEUS_REMOTE_WRITE_URL", "http://localhost:9090/api/v1/write")
+	t.Setenv("AUTH_TYPE", "TOKEN")
+	t.Setenv("AUTH_TOKEN", "testtoken")
+
+	config := Config{}
+	err := defcon.CheckConfigStruct(&config)
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if config.AuthToken != "testtoken" {
+		t.Fatalf("Expected auth token from AUTH_TOKEN, got %q", config.AuthToken)
+	}
+	config.ConfigFileLoader = test_utils.GetTestConfigLoader()
+	config.LogDestination = os.Stdout
+
+	c, err := NewController(config)
+	if err != nil {
+		t.Fatalf("Failed to create controller: %v", err)
+	}
+	redactor, ok := c.Logger.(types.ErrorRedactor)
+	if !ok {
+		t.Fatalf("Expected logger to mask errors")
+	}
+
+	// The token is masked, the auth type is not
+	msg := redactor.RedactError(errors.New("auth_type=TOKEN token=testtoken")).Error()
+	if strings.Contains(msg, "testtoken") || !strings.Contains(msg, "auth_type=TOKEN") {
+		t.Fatalf("Expected only the token to be masked, got %s", msg)
+	}
+}
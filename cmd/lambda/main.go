@@ -2,55 +2,156 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-lambda-go/lambdacontext"
 	defcon "github.com/kjansson/defcon"
+	"github.com/kjansson/yac-p/v3/pkg/tracing"
+)
+
+const (
+	DefaultPersistTimeReserve = 5 * time.Second        // Default time reserved before the Lambda deadline for converting and persisting metrics
+	shutdownMargin            = 500 * time.Millisecond // Time left after persisting to spool cut-off batches and return before the Lambda is stopped
 )
 
 func main() {
 	lambda.Start(HandleRequest) // Start the AWS Lambda function
 }
 
-func HandleRequest() {
+// collectDeadline returns the deadline for metrics collection, reserving time before the Lambda deadline for converting and persisting. At most half of the remaining time is reserved.
+func collectDeadline(deadline time.Time, reserve time.Duration) time.Time {
+	return deadline.Add(-min(reserve, time.Until(deadline)/2))
+}
+
+// runAttrs returns the log attributes identifying a run: a random run ID, and the request ID and function ARN of the Lambda invocation, if any
+func runAttrs(ctx context.Context) ([]any, error) {
+	random := make([]byte, 8)
+	_, err := rand.Read(random)
+	if err != nil {
+		return nil, err
+	}
+	attrs := []any{slog.String("run_id", hex.EncodeToString(random))}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		attrs = append(attrs, slog.String("aws_request_id", lc.AwsRequestID), slog.String("function_arn", lc.InvokedFunctionArn))
+	}
+	return attrs, nil
+}
+
+func HandleRequest(ctx context.Context) (err error) {
 
 	config := Config{}
-	err := defcon.CheckConfigStruct(&config) // Validate the config struct
+	err = defcon.CheckConfigStruct(&config) // Validate the config struct
 	if err != nil {
-		panic(err)
+		return err
 	}
 	config.ConfigFileLoader = GetS3Loader() // Set the config file loader to S3 for Lambda
+	config.LogRunAttrs, err = runAttrs(ctx) // Correlate the log records of this invocation
+	if err != nil {
+		return err
+	}
 
 	c, err := NewController(config) // Create a new controller instance
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	err = setupTracing(ctx, config.TracingExporter)
+	if err != nil {
+		return err
 	}
+	defer flushTracing(ctx, c.Logger)
+	ctx, span := tracing.Start(ctx, "yacp.run", spanAttrs(config.LogRunAttrs)...)
+	defer func() { tracing.End(span, err) }()
 
 	c.Logger.Log("debug", "Starting yac-p lambda function") // Log the start of the function
 
+	reserve := DefaultPersistTimeReserve
+	if config.PersistTimeReserve != "" {
+		reserve, err = time.ParseDuration(config.PersistTimeReserve)
+		if err != nil {
+			return fmt.Errorf("invalid persist time reserve: %w", err)
+		}
+	}
+
+	// Collection is cancelled early enough to persist the metrics collected so far before the Lambda deadline
+	collectCtx, persistCtx := ctx, ctx
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancelCollect, cancelPersist context.CancelFunc
+		collectCtx, cancelCollect = context.WithDeadline(ctx, collectDeadline(deadline, reserve))
+		defer cancelCollect()
+		persistCtx, cancelPersist = context.WithDeadline(ctx, deadline.Add(-shutdownMargin))
+		defer cancelPersist()
+		c.Logger.Log("debug", "Lambda deadline", "deadline", deadline, "remaining", time.Until(deadline).String())
+	}
+
 	c.Logger.Log("debug", "Collecting metrics")
 	// Gather cloudwatch metrics
-	err = c.CollectMetrics()
+	err = c.CollectMetricsContext(collectCtx)
 	if err != nil {
-		panic(err)
+		if !errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+			return err
+		}
+		c.Logger.Log("warn", "Metrics collection cancelled to leave time for persisting, continuing with the metrics collected so far", "error", err.Error())
+		staleSeries.Skip() // Series missing from an incomplete collection may still exist
 	}
 
 	c.Logger.Log("debug", "Extracting metrics")
 	// Extract the metrics from the prometheus registry
-	metrics, err := c.ExportMetrics()
+	metrics, err := c.ExportMetricsContext(ctx)
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	// Drop unwanted metrics before they are converted
+	metrics, err = c.FilterMetricsContext(ctx, metrics)
+	if err != nil {
+		return err
+	}
+
+	// Extract metadata, such as type and help text, to send along with the timeseries
+	metadata, err := c.ConvertMetadata(metrics)
+	if err != nil {
+		return err
+	}
+
+	if config.StreamingChunkSize != "" {
+		c.Logger.Log("debug", "Processing and persisting metrics in chunks")
+		// Convert, process and send the timeseries one chunk at a time, to bound memory use for large registries
+		err = c.PersistMetricsStream(persistCtx, c.ConvertMetricsStream(persistCtx, metrics), metadata)
+		if err != nil {
+			c.Logger.Log("error", "Failed to persist metrics", "error", err.Error())
+			return err
+		}
+		return nil
 	}
 
 	c.Logger.Log("debug", "Processing metrics")
 	// Process the metrics into timeseries format
-	timeSeries, err := c.ConvertMetrics(metrics)
+	timeSeries, err := c.ConvertMetricsContext(persistCtx, metrics)
+	if err != nil {
+		return err
+	}
+
+	// Relabel, filter or otherwise process the timeseries before persisting
+	timeSeries, err = c.ProcessMetricsContext(persistCtx, timeSeries)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	c.Logger.Log("debug", "Persisting metrics")
 	// Persist the metrics to the remote write endpoint
-	err = c.PersistMetrics(timeSeries) // Send the timeseries to the remote write endpoint
+	err = c.PersistMetricsContext(persistCtx, timeSeries, metadata) // Send the timeseries to the remote write endpoint
 	if err != nil {
-		panic(err)
+		c.Logger.Log("error", "Failed to persist metrics", "error", err.Error())
+		return err
 	}
+	staleSeries.Commit() // The next invocation marks the series missing from the ones sent now
+	return nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/kjansson/yac-p/v3/pkg/spool"
+)
+
+// newSpool creates the spool for a remote write target, or returns nil if spooling isn't configured. Each target gets its own directory or key prefix.
+func newSpool(cfg Config, target string) (*spool.Spool, error) {
+
+	var store spool.Store
+	switch {
+	case cfg.SpoolS3Bucket != "":
+		awsCfg, err := config.LoadDefaultConfig(context.TODO(),
+			config.WithRegion(cfg.Region),
+		)
+		if err != nil {
+			return nil, err
+		}
+		store, err = spool.NewS3Store(s3.NewFromConfig(awsCfg), cfg.SpoolS3Bucket, path.Join(cfg.SpoolS3Prefix, target))
+		if err != nil {
+			return nil, err
+		}
+	case cfg.SpoolDir != "":
+		var err error
+		store, err = spool.NewLocalStore(filepath.Join(cfg.SpoolDir, target))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create spool directory: %w", err)
+		}
+	default:
+		return nil, nil
+	}
+
+	return spool.NewSpool(store, spool.SpoolOpts{
+		MaxAge:   cfg.SpoolMaxAge,
+		MaxBytes: cfg.SpoolMaxBytes,
+	})
+}
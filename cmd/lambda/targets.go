@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kjansson/yac-p/v3/pkg/persister/fanout"
+	"github.com/kjansson/yac-p/v3/pkg/persister/prom"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"golang.org/x/oauth2"
+)
+
+// httpClients keeps the HTTP clients of the remote write targets, keyed by their options. They are kept outside the clients, which are created on every invocation, so warm invocations reuse open connections and TLS sessions.
+var httpClients = map[prom.HTTPClientOpts]*http.Client{}
+
+// tokenSources keeps the OAuth2 token sources of the remote write targets. They are kept outside the clients, which are created on every invocation, so tokens are reused by warm invocations until they expire.
+var tokenSources = map[tokenSourceKey]oauth2.TokenSource{}
+
+// tokenSourceKey identifies the token sources that can be shared. A changed client secret or HTTP client gets a new token source.
+type tokenSourceKey struct {
+	httpClient     *http.Client // Shared HTTP client the token source requests tokens with
+	tokenURL       string
+	clientID       string
+	clientSecret   string // SHA-256 hash of the client secret
+	scopes         string
+	endpointParams string
+}
+
+// metadataStates remembers when each remote write target last got metadata-only requests, keyed by target name, so the metadata interval holds across warm invocations
+var metadataStates = map[string]*prom.MetadataState{}
+
+// TargetConfig holds the settings of an additional remote write target. Settings not listed here, such as batching, retries and the HTTP client, are shared with the primary target.
+type TargetConfig struct {
+	Name                 string `json:"name"`
+	RemoteWriteURL       string `json:"url"`
+	AuthType             string `json:"auth_type"`
+	AuthToken            string `json:"auth_token"`
+	Username             string `json:"username"`
+	Password             string `json:"password"`
+	PrometheusRegion     string `json:"prometheus_region"`
+	AWSRoleARN           string `json:"aws_role_arn"`
+	Headers              string `json:"headers"`
+	TenantID             string `json:"tenant_id"`
+	Protocol             string `json:"protocol"`
+	OAuth2TokenURL       string `json:"oauth2_token_url"`
+	OAuth2ClientID       string `json:"oauth2_client_id"`
+	OAuth2ClientSecret   string `json:"oauth2_client_secret"`
+	OAuth2Scopes         string `json:"oauth2_scopes"`
+	OAuth2EndpointParams string `json:"oauth2_endpoint_params"`
+}
+
+// newPersister creates the persister for the configured remote write targets. A single target is used as is, multiple targets are wrapped in a fan-out persister.
+func newPersister(config Config, promOpts prom.PromOpts) (types.MetricPersister, error) {
+
+	targets := []fanout.Target{}
+	if config.RemoteWriteURL != "" || config.RemoteWriteTargets == "" {
+		primary, err := prom.NewPromClient(
+			config.RemoteWriteURL,
+			config.AuthType,
+			config.AuthToken,
+			config.Username,
+			config.Password,
+			config.Region,
+			config.PrometheusRegion,
+			config.AWSRoleARN,
+			promOpts,
+		)
+		if err != nil {
+			return nil, err
+		}
+		primary.Spool, err = newSpool(config, "primary")
+		if err != nil {
+			return nil, err
+		}
+		err = shareHTTPClient(primary, promOpts.HTTPClient)
+		if err != nil {
+			return nil, err
+		}
+		err = shareTokenSource(primary)
+		if err != nil {
+			return nil, err
+		}
+		primary.MetadataState = metadataState("primary")
+		if config.RemoteWriteTargets == "" {
+			return primary, nil
+		}
+		targets = append(targets, fanout.Target{Name: "primary", Persister: primary})
+	}
+
+	targetConfigs := []TargetConfig{}
+	err := json.Unmarshal([]byte(config.RemoteWriteTargets), &targetConfigs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote write targets: %w", err)
+	}
+
+	for i, target := range targetConfigs {
+		if target.Name == "" {
+			target.Name = fmt.Sprintf("target-%d", i)
+		}
+		opts := promOpts
+		opts.Headers = target.Headers
+		opts.TenantID = target.TenantID
+		opts.Protocol = target.Protocol
+		opts.OAuth2 = prom.OAuth2Opts{
+			TokenURL:       target.OAuth2TokenURL,
+			ClientID:       target.OAuth2ClientID,
+			ClientSecret:   target.OAuth2ClientSecret,
+			Scopes:         target.OAuth2Scopes,
+			EndpointParams: target.OAuth2EndpointParams,
+		}
+		persister, err := prom.NewPromClient(
+			target.RemoteWriteURL,
+			target.AuthType,
+			target.AuthToken,
+			target.Username,
+			target.Password,
+			config.Region,
+			target.PrometheusRegion,
+			target.AWSRoleARN,
+			opts,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		persister.Spool, err = newSpool(config, target.Name)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		err = shareHTTPClient(persister, opts.HTTPClient)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		err = shareTokenSource(persister)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target.Name, err)
+		}
+		persister.MetadataState = metadataState(target.Name)
+		targets = append(targets, fanout.Target{Name: target.Name, Persister: persister})
+	}
+
+	return fanout.NewFanoutPersister(targets, config.RemoteWriteFanoutPolicy)
+}
+
+// shareHTTPClient sets the HTTP client of a client to the one kept for its options, creating it on first use
+func shareHTTPClient(client *prom.PromClient, opts prom.HTTPClientOpts) error {
+	httpClient, ok := httpClients[opts]
+	if !ok {
+		var err error
+		httpClient, err = prom.NewHTTPClient(opts)
+		if err != nil {
+			return err
+		}
+		httpClients[opts] = httpClient
+	}
+	client.HTTPClient = httpClient
+	return nil
+}
+
+// shareTokenSource sets the token source of a client using OAuth2 auth to the one kept for its credentials and HTTP client, creating it on first use. Call it after the HTTP client is shared.
+func shareTokenSource(client *prom.PromClient) error {
+	cfg := client.OAuth2Config
+	if cfg == nil {
+		return nil
+	}
+	secret := sha256.Sum256([]byte(cfg.ClientSecret))
+	key := tokenSourceKey{
+		httpClient:     client.HTTPClient,
+		tokenURL:       cfg.TokenURL,
+		clientID:       cfg.ClientID,
+		clientSecret:   hex.EncodeToString(secret[:]),
+		scopes:         strings.Join(cfg.Scopes, " "),
+		endpointParams: cfg.EndpointParams.Encode(),
+	}
+	tokenSource, ok := tokenSources[key]
+	if !ok {
+		var err error
+		tokenSource, err = client.NewTokenSource()
+		if err != nil {
+			return err
+		}
+		tokenSources[key] = tokenSource
+	}
+	client.TokenSource = tokenSource
+	return nil
+}
+
+// metadataState returns the metadata state kept for a target, creating it on first use
+func metadataState(target string) *prom.MetadataState {
+	state, ok := metadataStates[target]
+	if !ok {
+		state = &prom.MetadataState{}
+		metadataStates[target] = state
+	}
+	return state
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/internal/test_utils"
+	"github.com/kjansson/yac-p/v3/pkg/persister/prom"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestConnectionsSharedBetweenInvocations(t *testing.T) {
+
+	var connections atomic.Int64
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	svr.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	svr.Start()
+	defer svr.Close()
+
+	config := Config{
+		RemoteWriteURL:   svr.URL,
+		ConfigFileLoader: test_utils.GetTestConfigLoader(),
+		LogDestination:   os.Stdout,
+	}
+	timeSeries := []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "test_gauge"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+	}}
+
+	// Every invocation creates a new controller, the connection of the first invocation is reused by the second
+	for i := 0; i < 2; i++ {
+		c, err := NewController(config)
+		if err != nil {
+			t.Fatalf("Failed to create controller: %v", err)
+		}
+		err = c.PersistMetrics(timeSeries)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if connections.Load() != 1 {
+		t.Fatalf("Expected 1 connection, got %d", connections.Load())
+	}
+}
+
+func TestTokenSharedBetweenInvocations(t *testing.T) {
+
+	var issued atomic.Int64
+	tokenSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("token-%d", issued.Add(1)),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		if err != nil {
+			t.Errorf("Failed to encode token response: %v", err)
+		}
+	}))
+	defer tokenSvr.Close()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" {
+			t.Errorf("Expected Authorization Bearer token-1, got %s", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	config := Config{
+		RemoteWriteURL:     svr.URL,
+		AuthType:           "OAUTH2",
+		OAuth2TokenURL:     tokenSvr.URL,
+		OAuth2ClientID:     "testclient",
+		OAuth2ClientSecret: "testsecret",
+		OAuth2Scopes:       "metrics:write",
+		ConfigFileLoader:   test_utils.GetTestConfigLoader(),
+		LogDestination:     os.Stdout,
+	}
+	timeSeries := []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "test_gauge"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+	}}
+
+	// Every invocation creates a new controller, the token of the first invocation is reused by the second
+	for i := 0; i < 2; i++ {
+		c, err := NewController(config)
+		if err != nil {
+			t.Fatalf("Failed to create controller: %v", err)
+		}
+		err = c.PersistMetrics(timeSeries)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if issued.Load() != 1 {
+		t.Fatalf("Expected 1 token to be issued, got %d", issued.Load())
+	}
+}
+
+func TestTokenSourceSecretRotated(t *testing.T) {
+
+	var issued atomic.Int64
+	tokenSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, secret, _ := r.BasicAuth()
+		if secret != fmt.Sprintf("secret-%d", issued.Load()+1) {
+			t.Errorf("Expected the client secret of invocation %d, got %s", issued.Load()+1, secret)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("token-%d", issued.Add(1)),
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		if err != nil {
+			t.Errorf("Failed to encode token response: %v", err)
+		}
+	}))
+	defer tokenSvr.Close()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	timeSeries := []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "test_gauge"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+	}}
+
+	// The client secret is rotated between invocations, the second invocation requests a token with the new secret
+	for i := 1; i <= 2; i++ {
+		c, err := NewController(Config{
+			RemoteWriteURL:     svr.URL,
+			AuthType:           "OAUTH2",
+			OAuth2TokenURL:     tokenSvr.URL,
+			OAuth2ClientID:     "testclient",
+			OAuth2ClientSecret: fmt.Sprintf("secret-%d", i),
+			ConfigFileLoader:   test_utils.GetTestConfigLoader(),
+			LogDestination:     os.Stdout,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create controller: %v", err)
+		}
+		err = c.PersistMetrics(timeSeries)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if issued.Load() != 2 {
+		t.Fatalf("Expected 2 tokens to be issued, got %d", issued.Load())
+	}
+}
+
+func TestMetadataIntervalBetweenInvocations(t *testing.T) {
+
+	var metadataRequests atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("Failed to read request: %v", err)
+		}
+		data, err := snappy.Decode(nil, body)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+		}
+		req := &prompb.WriteRequest{}
+		err = req.Unmarshal(data)
+		if err != nil {
+			t.Errorf("Failed to unmarshal request: %v", err)
+		}
+		if len(req.Timeseries) == 0 && len(req.Metadata) > 0 {
+			metadataRequests.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	metadataStates = map[string]*prom.MetadataState{}
+	config := Config{
+		RemoteWriteURL:              svr.URL,
+		RemoteWriteMetadata:         prom.MetadataSeparate,
+		RemoteWriteMetadataInterval: "1h",
+		ConfigFileLoader:            test_utils.GetTestConfigLoader(),
+		LogDestination:              os.Stdout,
+	}
+	timeSeries := []prompb.TimeSeries{{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "test_gauge"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+	}}
+	metadata := &types.MetricMetadata{Families: []prompb.MetricMetadata{{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "test_gauge"}}}
+
+	// Every invocation creates a new controller, the second invocation is within the metadata interval of the first
+	for i := 0; i < 2; i++ {
+		c, err := NewController(config)
+		if err != nil {
+			t.Fatalf("Failed to create controller: %v", err)
+		}
+		err = c.PersistMetricsContext(context.Background(), timeSeries, metadata)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if metadataRequests.Load() != 1 {
+		t.Fatalf("Expected 1 metadata request, got %d", metadataRequests.Load())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	DefaultServiceName = "yac-p" // Service name of the spans, unless set by OTEL_SERVICE_NAME
+
+	ExporterOTLP   = "OTLP"   // Export spans with OTLP over HTTP, configured by the standard OTEL_EXPORTER_OTLP_* environment variables
+	ExporterStdout = "STDOUT" // Write spans to stdout, for local testing
+	ExporterNone   = "NONE"   // Don't export spans
+)
+
+// tracerProvider exports the spans of all invocations. It is kept between warm invocations, and flushed at the end of each.
+var tracerProvider *sdktrace.TracerProvider
+
+// setupTracing creates the tracer provider on the first invocation and sets it as the global provider, nothing is set up if no exporter is configured
+func setupTracing(ctx context.Context, exporter string) error {
+	if tracerProvider != nil {
+		return nil
+	}
+	tp, err := newTracerProvider(ctx, exporter)
+	if err != nil || tp == nil {
+		return err
+	}
+	tracerProvider = tp
+	otel.SetTracerProvider(tp)
+	return nil
+}
+
+// newTracerProvider creates a tracer provider exporting spans with the given exporter (OTLP, STDOUT, NONE). No provider is returned for NONE or an empty exporter.
+func newTracerProvider(ctx context.Context, exporter string) (*sdktrace.TracerProvider, error) {
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter: %s", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s span exporter: %w", exporter, err)
+	}
+
+	// Attributes from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", DefaultServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tracing resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(res),
+	), nil
+}
+
+// flushTracing exports the spans of the invocation before the Lambda is frozen
+func flushTracing(ctx context.Context, logger types.Logger) {
+	if tracerProvider == nil {
+		return
+	}
+	err := tracerProvider.ForceFlush(ctx)
+	if err != nil {
+		logger.Log("warn", "Failed to export spans", slog.String("error", err.Error()))
+	}
+}
+
+// spanAttrs converts the log attributes of a run to span attributes
+func spanAttrs(attrs []any) []attribute.KeyValue {
+	kvs := []attribute.KeyValue{}
+	for _, attr := range attrs {
+		if a, ok := attr.(slog.Attr); ok {
+			kvs = append(kvs, attribute.String(a.Key, a.Value.String()))
+		}
+	}
+	return kvs
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTracerProvider(t *testing.T) {
+
+	for _, exporter := range []string{"", ExporterNone} {
+		tp, err := newTracerProvider(context.Background(), exporter)
+		if err != nil || tp != nil {
+			t.Fatalf("Expected no tracer provider for exporter %q, got %v, %v", exporter, tp, err)
+		}
+	}
+
+	tp, err := newTracerProvider(context.Background(), ExporterStdout)
+	if err != nil || tp == nil {
+		t.Fatalf("Failed to create tracer provider: %v", err)
+	}
+	err = tp.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to shut down tracer provider: %v", err)
+	}
+
+	_, err = newTracerProvider(context.Background(), "JAEGER")
+	if err == nil {
+		t.Fatalf("Expected error for invalid exporter, got nil")
+	}
+}
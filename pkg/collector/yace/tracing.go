@@ -0,0 +1,92 @@
+package yace
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/tracing"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients"
+	cloudwatch_client "github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/cloudwatch"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	attrRegion    = attribute.Key("aws.region")           // AWS region of the API call
+	attrNamespace = attribute.Key("cloudwatch.namespace") // Cloudwatch namespace of the API call
+	attrMetric    = attribute.Key("cloudwatch.metric")    // Cloudwatch metric name of the API call
+	attrResults   = attribute.Key("yacp.results")         // Number of results returned by the API call
+	attrResources = attribute.Key("yacp.resources")       // Number of resources discovered by the API call
+)
+
+// tracingFactory wraps a YACE client factory, adding spans for the Cloudwatch and tagging API calls made by its clients
+type tracingFactory struct {
+	clients.Factory
+}
+
+func (f tracingFactory) GetCloudwatchClient(region string, role model.Role, concurrency cloudwatch_client.ConcurrencyConfig) cloudwatch_client.Client {
+	return &tracingCloudwatchClient{client: f.Factory.GetCloudwatchClient(region, role, concurrency), region: region}
+}
+
+func (f tracingFactory) GetTaggingClient(region string, role model.Role, concurrencyLimit int) tagging.Client {
+	return &tracingTaggingClient{client: f.Factory.GetTaggingClient(region, role, concurrencyLimit)}
+}
+
+type tracingCloudwatchClient struct {
+	client cloudwatch_client.Client // Client making the API calls
+	region string                   // Region of the client
+}
+
+func (c *tracingCloudwatchClient) ListMetrics(ctx context.Context, namespace string, metric *model.MetricConfig, recentlyActiveOnly bool, fn func(page []*model.Metric)) error {
+	ctx, span := tracing.Start(ctx, "cloudwatch.ListMetrics", attrRegion.String(c.region), attrNamespace.String(namespace), attrMetric.String(metricName(metric)))
+	results := 0
+	counted := fn
+	if fn != nil {
+		counted = func(page []*model.Metric) {
+			results += len(page)
+			fn(page)
+		}
+	}
+	err := c.client.ListMetrics(ctx, namespace, metric, recentlyActiveOnly, counted)
+	span.SetAttributes(attrResults.Int(results))
+	tracing.End(span, err)
+	return err
+}
+
+func (c *tracingCloudwatchClient) GetMetricData(ctx context.Context, getMetricData []*model.CloudwatchData, namespace string, startTime time.Time, endTime time.Time) []cloudwatch_client.MetricDataResult {
+	ctx, span := tracing.Start(ctx, "cloudwatch.GetMetricData", attrRegion.String(c.region), attrNamespace.String(namespace), tracing.AttrMetrics.Int(len(getMetricData)))
+	results := c.client.GetMetricData(ctx, getMetricData, namespace, startTime, endTime)
+	span.SetAttributes(attrResults.Int(len(results)))
+	span.End()
+	return results
+}
+
+func (c *tracingCloudwatchClient) GetMetricStatistics(ctx context.Context, logger *slog.Logger, dimensions []model.Dimension, namespace string, metric *model.MetricConfig) []*model.MetricStatisticsResult {
+	ctx, span := tracing.Start(ctx, "cloudwatch.GetMetricStatistics", attrRegion.String(c.region), attrNamespace.String(namespace), attrMetric.String(metricName(metric)))
+	results := c.client.GetMetricStatistics(ctx, logger, dimensions, namespace, metric)
+	span.SetAttributes(attrResults.Int(len(results)))
+	span.End()
+	return results
+}
+
+// metricName returns the name of a metric config, empty if not set
+func metricName(metric *model.MetricConfig) string {
+	if metric == nil {
+		return ""
+	}
+	return metric.Name
+}
+
+type tracingTaggingClient struct {
+	client tagging.Client // Client making the API calls
+}
+
+func (c *tracingTaggingClient) GetResources(ctx context.Context, job model.DiscoveryJob, region string) ([]*model.TaggedResource, error) {
+	ctx, span := tracing.Start(ctx, "tagging.GetResources", attrRegion.String(region), attrNamespace.String(job.Namespace))
+	resources, err := c.client.GetResources(ctx, job, region)
+	span.SetAttributes(attrResources.Int(len(resources)))
+	tracing.End(span, err)
+	return resources, err
+}
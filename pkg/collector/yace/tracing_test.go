@@ -0,0 +1,107 @@
+package yace
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/account"
+	cloudwatch_client "github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/cloudwatch"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/tagging"
+	"github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// fakeFactory returns clients answering every call with fixed results
+type fakeFactory struct {
+	clients.Factory
+}
+
+func (fakeFactory) GetCloudwatchClient(string, model.Role, cloudwatch_client.ConcurrencyConfig) cloudwatch_client.Client {
+	return fakeCloudwatchClient{}
+}
+
+func (fakeFactory) GetTaggingClient(string, model.Role, int) tagging.Client {
+	return fakeTaggingClient{}
+}
+
+func (fakeFactory) GetAccountClient(string, model.Role) account.Client {
+	return nil
+}
+
+type fakeCloudwatchClient struct{}
+
+func (fakeCloudwatchClient) ListMetrics(_ context.Context, _ string, _ *model.MetricConfig, _ bool, fn func(page []*model.Metric)) error {
+	fn([]*model.Metric{{}, {}})
+	fn([]*model.Metric{{}})
+	return nil
+}
+
+func (fakeCloudwatchClient) GetMetricData(_ context.Context, getMetricData []*model.CloudwatchData, _ string, _ time.Time, _ time.Time) []cloudwatch_client.MetricDataResult {
+	return make([]cloudwatch_client.MetricDataResult, len(getMetricData))
+}
+
+func (fakeCloudwatchClient) GetMetricStatistics(context.Context, *slog.Logger, []model.Dimension, string, *model.MetricConfig) []*model.MetricStatisticsResult {
+	return nil
+}
+
+type fakeTaggingClient struct{}
+
+func (fakeTaggingClient) GetResources(context.Context, model.DiscoveryJob, string) ([]*model.TaggedResource, error) {
+	return nil, errors.New("access denied")
+}
+
+func TestTracingFactory(t *testing.T) {
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	factory := tracingFactory{fakeFactory{}}
+	ctx := context.Background()
+	cloudwatch := factory.GetCloudwatchClient("eu-west-1", model.Role{}, cloudwatch_client.ConcurrencyConfig{})
+	err := cloudwatch.ListMetrics(ctx, "AWS/EC2", &model.MetricConfig{Name: "CPUUtilization"}, false, func([]*model.Metric) {})
+	if err != nil {
+		t.Fatalf("Failed to list metrics: %v", err)
+	}
+	cloudwatch.GetMetricData(ctx, make([]*model.CloudwatchData, 3), "AWS/EC2", time.Now(), time.Now())
+	_, err = factory.GetTaggingClient("eu-west-1", model.Role{}, 1).GetResources(ctx, model.DiscoveryJob{Namespace: "AWS/EC2"}, "eu-west-1")
+	if err == nil {
+		t.Fatalf("Expected error from tagging client, got nil")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, got %d", len(spans))
+	}
+	expected := []struct {
+		name    string
+		results int64
+		key     string
+		status  codes.Code
+	}{
+		{"cloudwatch.ListMetrics", 3, "yacp.results", codes.Unset},
+		{"cloudwatch.GetMetricData", 3, "yacp.results", codes.Unset},
+		{"tagging.GetResources", 0, "yacp.resources", codes.Error},
+	}
+	for i, e := range expected {
+		span := spans[i]
+		if span.Name != e.name || span.Status.Code != e.status {
+			t.Fatalf("Expected span %s with status %v, got %s with status %v", e.name, e.status, span.Name, span.Status.Code)
+		}
+		attrs := map[string]any{}
+		for _, attr := range span.Attributes {
+			attrs[string(attr.Key)] = attr.Value.AsInterface()
+		}
+		if attrs["aws.region"] != "eu-west-1" || attrs["cloudwatch.namespace"] != "AWS/EC2" || attrs[e.key] != e.results {
+			t.Fatalf("Unexpected attributes on span %s: %v", span.Name, attrs)
+		}
+	}
+}
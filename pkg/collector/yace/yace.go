@@ -3,10 +3,12 @@ package yace
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"os"
 	"strconv"
 
+	"github.com/kjansson/yac-p/v3/pkg/logger"
 	"github.com/kjansson/yac-p/v3/pkg/types"
 	yace "github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg"
 	client "github.com/prometheus-community/yet-another-cloudwatch-exporter/pkg/clients/v2"
@@ -32,12 +34,13 @@ type YaceClient struct {
 	Registry         *prometheus.Registry   // Prometheus registry used to store the metrics
 	Client           *client.CachingFactory // YACE client used to collect metrics
 	JobConfig        model.JobsConfig       // YACE job config
-	Logger           *slog.Logger           // Logger instance
+	Logger           *slog.Logger           // Logger passed to YACE
 	YaceOpts         YaceOpts               // YACE options
 	ConfigFileLoader func() ([]byte, error) // Function to load the YACE config file
 }
 
-func NewYaceClient(configFileLoader func() ([]byte, error), yaceOpts YaceOpts) (*YaceClient, error) {
+// NewYaceClient creates a YACE client. The logs of YACE are passed on to the given logger with a component field, or written to stdout if the logger is nil.
+func NewYaceClient(log types.Logger, configFileLoader func() ([]byte, error), yaceOpts YaceOpts) (*YaceClient, error) {
 	var err error
 
 	y := &YaceClient{
@@ -45,9 +48,11 @@ func NewYaceClient(configFileLoader func() ([]byte, error), yaceOpts YaceOpts) (
 		YaceOpts:         yaceOpts,
 	}
 
-	y.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
-
-	y.Registry = prometheus.NewRegistry() // Create a new prometheus registry
+	if log != nil {
+		y.Logger = slog.New(logger.NewHandler(log)).With("component", "yace")
+	} else {
+		y.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
 
 	contents, err := y.ConfigFileLoader()
 	if err != nil {
@@ -83,11 +88,9 @@ func NewYaceClient(configFileLoader func() ([]byte, error), yaceOpts YaceOpts) (
 		return nil, err
 	}
 
-	for _, metric := range yace.Metrics { // Register YACE internal metrics
-		err := y.Registry.Register(metric)
-		if err != nil {
-			return nil, err
-		}
+	y.Registry, err = newRegistry()
+	if err != nil {
+		return nil, err
 	}
 
 	y.Client, err = client.NewFactory(y.Logger, y.JobConfig, false)
@@ -97,19 +100,44 @@ func NewYaceClient(configFileLoader func() ([]byte, error), yaceOpts YaceOpts) (
 	return y, nil
 }
 
+// newRegistry creates a prometheus registry with the YACE internal metrics registered
+func newRegistry() (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+	for _, metric := range yace.Metrics { // Register YACE internal metrics
+		err := registry.Register(metric)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry, nil
+}
+
 // CollectMetrics performs the Cloudwatch metrics collection and updates the prometheus registry
 func (y *YaceClient) CollectMetrics(logger types.Logger) error {
-	ctx := context.Background()
+	return y.CollectMetricsContext(context.Background(), logger)
+}
+
+// CollectMetricsContext is like CollectMetrics but stops querying Cloudwatch when the context is cancelled. The metrics collected up to that point are kept in the registry.
+// Every collection starts with a new registry, so series of resources that no longer exist are not exported again with their old values when the client is reused.
+func (y *YaceClient) CollectMetricsContext(ctx context.Context, logger types.Logger) error {
 
 	opts, err := getYaceOptions(y.YaceOpts, logger) // Get the YACE options from the config
 	if err != nil {
 		return err
 	}
+	registry, err := newRegistry()
+	if err != nil {
+		return err
+	}
+	y.Registry = registry
 	// Query metrics and resources and update the prometheus registry
-	err = yace.UpdateMetrics(ctx, y.Logger, y.JobConfig, y.Registry, y.Client, opts...)
+	err = yace.UpdateMetrics(ctx, y.Logger, y.JobConfig, y.Registry, tracingFactory{y.Client}, opts...)
 	if err != nil {
 		return err
 	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("metrics collection interrupted, collected metrics may be incomplete: %w", ctx.Err())
+	}
 	return nil
 }
 
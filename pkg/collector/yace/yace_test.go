@@ -1,13 +1,18 @@
 package yace
 
 import (
+	"context"
+	"os"
 	"testing"
 
 	"github.com/kjansson/yac-p/v3/internal/test_utils"
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func TestConfigLoad(t *testing.T) {
 	_, err := NewYaceClient(
+		nil,
 		test_utils.GetTestConfigLoader(),
 		YaceOpts{},
 	)
@@ -16,3 +21,38 @@ func TestConfigLoad(t *testing.T) {
 		t.Fatalf("Failed to initialize: %v", err)
 	}
 }
+
+func TestRegistryReset(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	y, err := NewYaceClient(
+		logger,
+		test_utils.GetTestConfigLoader(),
+		YaceOpts{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to initialize: %v", err)
+	}
+
+	stale := prometheus.NewGauge(prometheus.GaugeOpts{Name: "aws_ec2_cpuutilization_average", Help: "Left from a previous collection"})
+	stale.Set(1)
+	y.GetRegistry().MustRegister(stale)
+
+	// Collection is cancelled before querying Cloudwatch, the registry is replaced regardless
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = y.CollectMetricsContext(ctx, logger)
+
+	metrics, err := y.ExportMetrics(logger)
+	if err != nil {
+		t.Fatalf("Failed to export metrics: %v", err)
+	}
+	for _, family := range metrics {
+		if family.GetName() == "aws_ec2_cpuutilization_average" {
+			t.Fatalf("Expected metrics of the previous collection to be cleared")
+		}
+	}
+}
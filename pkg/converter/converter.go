@@ -2,84 +2,311 @@
 package converter
 
 import (
+	"context"
 	"fmt"
+	"iter"
 	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/kjansson/yac-p/v3/pkg/types"
 	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	io_prometheus_client "github.com/prometheus/client_model/go"
 )
 
+const DefaultChunkSize = 10000 // Default number of time series per chunk when streaming
+
 type Converter struct {
-	Logger types.Logger // Logger instance
+	Logger           types.Logger // Logger instance
+	NativeHistograms bool         // Convert histograms with native buckets to native histograms instead of classic bucket series
+	InvalidNames     string       // How invalid metric and label names are handled (SANITIZE, DROP), defaults to SANITIZE
+
+	TimestampStrategy TimestampStrategy // Decides the sample timestamps, defaults to CloudwatchFamilyStrategy
+
+	ChunkSize int // Number of time series per chunk when streaming, defaults to DefaultChunkSize
+
+	now func() time.Time // Clock used for the collection time, defaults to time.Now
+}
+
+// ConverterOpts contains optional settings for the converter. Values are strings to allow them to be passed directly from environment variables.
+type ConverterOpts struct {
+	NativeHistograms  string
+	InvalidNames      string // "SANITIZE" or "DROP"
+	TimestampStrategy string // "COLLECTION", "CLOUDWATCH_FAMILY", "CLOUDWATCH_NEWEST" or "OFFSET"
+	TimestampOffset   string // Go duration format, e.g. "5m", used by the OFFSET strategy
+	ChunkSize         string
 }
 
-func NewConverter(logger types.Logger) *Converter {
-	return &Converter{
+func NewConverter(logger types.Logger, opts ConverterOpts) (*Converter, error) {
+	c := &Converter{
 		Logger: logger,
 	}
+	if opts.NativeHistograms != "" {
+		var err error
+		c.NativeHistograms, err = strconv.ParseBool(opts.NativeHistograms)
+		if err != nil {
+			return nil, fmt.Errorf("invalid native histograms setting: %w", err)
+		}
+	}
+	switch opts.InvalidNames {
+	case "", InvalidNamesSanitize, InvalidNamesDrop:
+		c.InvalidNames = opts.InvalidNames
+	default:
+		return nil, fmt.Errorf("invalid setting for invalid names: %s", opts.InvalidNames)
+	}
+	var err error
+	c.TimestampStrategy, err = NewTimestampStrategy(opts.TimestampStrategy, opts.TimestampOffset)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ChunkSize != "" {
+		c.ChunkSize, err = strconv.Atoi(opts.ChunkSize)
+		if err != nil || c.ChunkSize <= 0 {
+			return nil, fmt.Errorf("invalid chunk size: %s", opts.ChunkSize)
+		}
+	}
+	return c, nil
 }
 
 // getValue extracts the value of the metric based on the metric type
 func getValue(valueType io_prometheus_client.MetricType, metric *io_prometheus_client.Metric) (float64, error) {
 	switch valueType {
 	case io_prometheus_client.MetricType_GAUGE:
-		return *metric.Gauge.Value, nil
+		return metric.GetGauge().GetValue(), nil
 	case io_prometheus_client.MetricType_COUNTER:
-		return *metric.Counter.Value, nil
+		return metric.GetCounter().GetValue(), nil
+	case io_prometheus_client.MetricType_UNTYPED: // Untyped metrics are treated as gauges
+		return metric.GetUntyped().GetValue(), nil
 	default:
 		return 0, fmt.Errorf("unknown metric type: %s", valueType)
 	}
 }
 
+// getLabels creates the time series labels of a metric, extra labels such as le or quantile are added last.
+// Labels of the metric named like the metric name or an extra label are left out, so they can't replace the labels added by the converter.
+func getLabels(metricName string, metric *io_prometheus_client.Metric, extra ...prompb.Label) []prompb.Label {
+	// This one is special, we need to add the metric name in the special label that prometheus expects
+	labels := []prompb.Label{{Name: "__name__", Value: metricName}}
+	for _, label := range metric.GetLabel() {
+		if label.GetName() == "__name__" || slices.ContainsFunc(extra, func(e prompb.Label) bool { return e.Name == label.GetName() }) {
+			continue
+		}
+		labels = append(labels, prompb.Label{Name: label.GetName(), Value: label.GetValue()}) // Create prometheus time series labels
+	}
+	return append(labels, extra...)
+}
+
+// convertMetric converts a single metric into one or more time series, histograms and summaries are expanded into several series
+func (c *Converter) convertMetric(metricName string, metricType io_prometheus_client.MetricType, metric *io_prometheus_client.Metric, timestamp int64) ([]prompb.TimeSeries, error) {
+	switch metricType {
+	case io_prometheus_client.MetricType_HISTOGRAM, io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+		if c.NativeHistograms && isNativeHistogram(metric.GetHistogram()) {
+			return []prompb.TimeSeries{getNativeHistogramSeries(metricName, metricType, metric, timestamp)}, nil
+		}
+		return getHistogramSeries(metricName, metric, timestamp), nil
+	case io_prometheus_client.MetricType_SUMMARY:
+		return getSummarySeries(metricName, metric, timestamp), nil
+	}
+
+	value, err := getValue(metricType, metric) // Extract the value of the metric based on the metric type
+	if err != nil {
+		return nil, err
+	}
+	return []prompb.TimeSeries{{
+		Labels:  getLabels(metricName, metric),
+		Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}}, // Create prometheus time series samples
+	}}, nil
+}
+
+// getMetadataType maps the metric type to the remote write metadata type
+func getMetadataType(metricType io_prometheus_client.MetricType) prompb.MetricMetadata_MetricType {
+	switch metricType {
+	case io_prometheus_client.MetricType_GAUGE:
+		return prompb.MetricMetadata_GAUGE
+	case io_prometheus_client.MetricType_COUNTER:
+		return prompb.MetricMetadata_COUNTER
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		return prompb.MetricMetadata_HISTOGRAM
+	case io_prometheus_client.MetricType_GAUGE_HISTOGRAM:
+		return prompb.MetricMetadata_GAUGEHISTOGRAM
+	case io_prometheus_client.MetricType_SUMMARY:
+		return prompb.MetricMetadata_SUMMARY
+	default:
+		return prompb.MetricMetadata_UNKNOWN
+	}
+}
+
+// metricUnits are the units inferred from metric name suffixes, following the Prometheus naming conventions
+var metricUnits = []string{
+	"seconds", "milliseconds", "microseconds", "nanoseconds",
+	"bytes", "kilobytes", "megabytes", "gigabytes", "bits",
+	"percent", "ratio",
+}
+
+// getUnit returns the unit of a metric family, either set explicitly or inferred from a unit suffix in the name, optionally followed by _total
+func getUnit(family *io_prometheus_client.MetricFamily) string {
+	if unit := family.GetUnit(); unit != "" {
+		return unit
+	}
+	name := strings.TrimSuffix(family.GetName(), "_total")
+	for _, unit := range metricUnits {
+		if strings.HasSuffix(name, "_"+unit) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// getCreatedTimestamp returns the created timestamp of counters, histograms and summaries
+func getCreatedTimestamp(metricType io_prometheus_client.MetricType, metric *io_prometheus_client.Metric) *timestamppb.Timestamp {
+	switch metricType {
+	case io_prometheus_client.MetricType_COUNTER:
+		return metric.GetCounter().GetCreatedTimestamp()
+	case io_prometheus_client.MetricType_HISTOGRAM:
+		return metric.GetHistogram().GetCreatedTimestamp()
+	case io_prometheus_client.MetricType_SUMMARY:
+		return metric.GetSummary().GetCreatedTimestamp()
+	default:
+		return nil
+	}
+}
+
+// ConvertMetadata extracts the type, help text and unit of each metric family, and the created timestamps of counters, histograms and summaries, for use with remote write metadata
+func (c *Converter) ConvertMetadata(metrics []*io_prometheus_client.MetricFamily, logger types.Logger) (*types.MetricMetadata, error) {
+
+	metadata := &types.MetricMetadata{
+		Families:          []prompb.MetricMetadata{},
+		CreatedTimestamps: map[string]int64{},
+	}
+	stats := normalizeStats{} // Counts are reported when converting the metrics
+	for _, family := range metrics {
+		familyName := family.GetName()
+		if !isValidName(familyName, true) && c.invalidNames() == InvalidNamesSanitize {
+			familyName = sanitizeName(familyName, true) // Match the sanitized names of the series
+		}
+		metadata.Families = append(metadata.Families, prompb.MetricMetadata{
+			Type:             getMetadataType(family.GetType()),
+			MetricFamilyName: familyName,
+			Help:             family.GetHelp(),
+			Unit:             getUnit(family),
+		})
+		for _, metric := range family.GetMetric() {
+			created := getCreatedTimestamp(family.GetType(), metric)
+			if created == nil {
+				continue
+			}
+			// Histograms and summaries are expanded into several series, all sharing the created timestamp
+			series, err := c.convertMetric(family.GetName(), family.GetType(), metric, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, ts := range series {
+				labels, ok := c.normalizeLabels(ts.Labels, &stats)
+				if !ok {
+					continue
+				}
+				metadata.CreatedTimestamps[types.SeriesKey(labels)] = created.AsTime().UnixMilli()
+			}
+		}
+	}
+	logger.Log("debug", "Converted metadata", slog.Int("family_count", len(metadata.Families)), slog.Int("created_timestamp_count", len(metadata.CreatedTimestamps)))
+	return metadata, nil
+}
+
 // ConvertMetrics accepts Prometheus metrics gathered from a Prometheus registry, converts and returns them in timeseries format suitable for the Prometheus remote write API
 func (c *Converter) ConvertMetrics(metrics []*io_prometheus_client.MetricFamily, logger types.Logger) ([]prompb.TimeSeries, error) {
+	return c.ConvertMetricsContext(context.Background(), metrics, logger)
+}
+
+// ConvertMetricsContext is like ConvertMetrics but stops converting when the context is cancelled
+func (c *Converter) ConvertMetricsContext(ctx context.Context, metrics []*io_prometheus_client.MetricFamily, logger types.Logger) ([]prompb.TimeSeries, error) {
 
-	newTimestamp := time.Now().UnixNano() / int64(time.Millisecond)
 	timeSeries := []prompb.TimeSeries{} // Create a slice of prometheus time series
-	var oldTimestamp int64
-	timestamped := false
+	err := c.convert(ctx, metrics, logger, func(series []prompb.TimeSeries) bool {
+		timeSeries = append(timeSeries, series...)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.normalizeTimeSeries(timeSeries, logger), nil
+}
+
+// ConvertMetricsStream is like ConvertMetricsContext but emits the time series in chunks of about ChunkSize series as they are converted, so that they can be sent before the rest is converted.
+// Series with identical labels are only merged within a chunk.
+func (c *Converter) ConvertMetricsStream(ctx context.Context, metrics []*io_prometheus_client.MetricFamily, logger types.Logger) iter.Seq2[[]prompb.TimeSeries, error] {
+
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return func(yield func([]prompb.TimeSeries, error) bool) {
+		chunk := make([]prompb.TimeSeries, 0, chunkSize)
+		stopped := false
+		err := c.convert(ctx, metrics, logger, func(series []prompb.TimeSeries) bool {
+			chunk = append(chunk, series...)
+			if len(chunk) < chunkSize {
+				return true
+			}
+			if !yield(c.normalizeTimeSeries(chunk, logger), nil) {
+				stopped = true
+				return false
+			}
+			chunk = make([]prompb.TimeSeries, 0, chunkSize) // The previous chunk may still be in use by the consumer
+			return true
+		})
+		if stopped {
+			return
+		}
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		if len(chunk) > 0 {
+			yield(c.normalizeTimeSeries(chunk, logger), nil)
+		}
+	}
+}
+
+// convert converts the metrics and passes the series of each metric to emit, until emit returns false or the context is cancelled
+func (c *Converter) convert(ctx context.Context, metrics []*io_prometheus_client.MetricFamily, logger types.Logger, emit func([]prompb.TimeSeries) bool) error {
+
+	now := time.Now
+	if c.now != nil {
+		now = c.now
+	}
+	strategy := c.TimestampStrategy
+	if strategy == nil {
+		strategy = CloudwatchFamilyStrategy{}
+	}
+	// Metrics can have timestamps from Cloudwatch if YACE is configured to use them, the strategy decides how they are used and what metrics without one get
+	timestampOf := strategy.Timestamps(metrics, now())
+
 	// Process metrics into timeseries format that remote write expects
 	for _, family := range metrics { // Range through metric types
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("metrics conversion interrupted: %w", err)
+		}
 		metricName, metricType := family.GetName(), family.GetType() // Extraxt the metric type and name to use in prometheus time series
 		logger.Log("debug", "Processing metric", slog.String("metric_name", metricName), slog.String("metric_type", metricType.String()))
+		if _, ok := io_prometheus_client.MetricType_name[int32(metricType)]; !ok {
+			logger.Log("warn", "Skipping metric of unknown type", slog.String("metric_name", metricName), slog.String("metric_type", metricType.String()))
+			continue
+		}
 		for _, metric := range family.GetMetric() { // Range through the metrics of the metric type
-			ts := prompb.TimeSeries{}
-
-			// This one is special, we need to add the metric name in the special label that prometheus expects
-			ts.Labels = append(ts.Labels, prompb.Label{Name: "__name__", Value: metricName})
-			for _, label := range metric.GetLabel() {
-				ts.Labels = append(ts.Labels, prompb.Label{Name: label.GetName(), Value: label.GetValue()}) // Create prometheus time series labels
-			}
-
-			value, err := getValue(metricType, metric) // Extract the value of the metric based on the metric type
+			timestamp := timestampOf(family, metric)
+			series, err := c.convertMetric(metricName, metricType, metric, timestamp)
 			if err != nil {
-				return nil, err
+				return err
 			}
-
-			timestamp := metric.GetTimestampMs() // Extract the timestamp of the metric
-			// Metrics can have timestamps from Cloudwatch if YACE is configured to use them.
-			// If the metric does not have a timestamp, it's either a helper metric created by YACE or YACE is configured to ignore Cloudwatch timestamps.
-			// We store the timestamp of the first metric if it's non-zero and use it for the helper metrics,
-			// if the first metric is not timestamped we assume that YACE is configured to ignore Cloduwatch timestamps and generate our own.
-			if timestamp == 0 {
-				if timestamped {
-					logger.Log("debug", "Using stored timestamp from previous metric", slog.Int64("timestamp", oldTimestamp))
-					timestamp = oldTimestamp
-				} else {
-					logger.Log("debug", "Using generated timestamp", slog.Int64("timestamp", newTimestamp))
-					timestamp = newTimestamp
-				}
-			} else {
-				oldTimestamp = timestamp
-				timestamped = true
+			if !emit(series) {
+				return nil
 			}
-
-			ts.Samples = append(ts.Samples, prompb.Sample{Value: value, Timestamp: timestamp}) // Create prometheus time series samples
-			timeSeries = append(timeSeries, ts)
 		}
 	}
-	return timeSeries, nil
+	return nil
 }
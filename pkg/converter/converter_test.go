@@ -1,11 +1,17 @@
 package converter
 
 import (
+	"context"
+	"errors"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	io_prometheus_client "github.com/prometheus/client_model/go"
 )
@@ -33,13 +39,16 @@ func TestMetricsProcessing(t *testing.T) {
 	logger, err := logger.NewLogger(
 		os.Stdout,
 		"text",
-		false,
+		logger.LoggerOpts{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to initialize logger: %v", err)
 	}
 
-	c := NewConverter(logger)
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
 
 	timeseries, err := c.ConvertMetrics(createTestMetricsFamily(), logger)
 	if err != nil {
@@ -68,3 +77,106 @@ func TestMetricsProcessing(t *testing.T) {
 		}
 	}
 }
+
+func TestMetadataConversion(t *testing.T) {
+	logger, err := logger.NewLogger(
+		os.Stdout,
+		"text",
+		logger.LoggerOpts{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	created := timestamppb.New(time.UnixMilli(1000))
+	families := append(createTestMetricsFamily(), &io_prometheus_client.MetricFamily{
+		Name: proto.String("test_counter"),
+		Help: proto.String("This is a test counter"),
+		Type: io_prometheus_client.MetricType_COUNTER.Enum(),
+		Metric: []*io_prometheus_client.Metric{{
+			Label: []*io_prometheus_client.LabelPair{
+				{Name: proto.String("label1"), Value: proto.String("value1")},
+			},
+			Counter: &io_prometheus_client.Counter{
+				Value:            proto.Float64(2.0),
+				CreatedTimestamp: created,
+			},
+		}},
+	})
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	metadata, err := c.ConvertMetadata(families, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert metadata: %v", err)
+	}
+	if len(metadata.Families) != 2 {
+		t.Fatalf("Expected metadata for 2 families, got %d", len(metadata.Families))
+	}
+	if metadata.Families[0].MetricFamilyName != "test_gauge" || metadata.Families[0].Type != prompb.MetricMetadata_GAUGE || metadata.Families[0].Help != "This is a test gauge" {
+		t.Fatalf("Unexpected gauge metadata: %+v", metadata.Families[0])
+	}
+	if metadata.Families[1].Type != prompb.MetricMetadata_COUNTER {
+		t.Fatalf("Expected counter metadata type, got %s", metadata.Families[1].Type)
+	}
+
+	timeSeries, err := c.ConvertMetrics(families, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if metadata.CreatedTimestamps[types.SeriesKey(timeSeries[1].Labels)] != 1000 {
+		t.Fatalf("Expected created timestamp 1000 for counter, got %v", metadata.CreatedTimestamps)
+	}
+	if _, ok := metadata.CreatedTimestamps[types.SeriesKey(timeSeries[0].Labels)]; ok {
+		t.Fatalf("Expected no created timestamp for gauge")
+	}
+}
+
+func TestMetadataUnit(t *testing.T) {
+
+	tests := map[string]string{
+		"aws_elb_latency_seconds":        "seconds",
+		"aws_s3_bucket_size_bytes":       "bytes",
+		"aws_lambda_errors_ratio":        "ratio",
+		"aws_sqs_sent_bytes_total":       "bytes",
+		"aws_ec2_cpuutilization_average": "",
+		"aws_ec2_seconds_left":           "",
+	}
+	for name, expected := range tests {
+		unit := getUnit(&io_prometheus_client.MetricFamily{Name: proto.String(name)})
+		if unit != expected {
+			t.Fatalf("Expected unit %q for %s, got %q", expected, name, unit)
+		}
+	}
+
+	unit := getUnit(&io_prometheus_client.MetricFamily{Name: proto.String("aws_ec2_cpuutilization_average"), Unit: proto.String("percent")})
+	if unit != "percent" {
+		t.Fatalf("Expected explicit unit percent, got %q", unit)
+	}
+}
+
+func TestMetricsProcessingCancelled(t *testing.T) {
+	logger, err := logger.NewLogger(
+		os.Stdout,
+		"text",
+		logger.LoggerOpts{},
+	)
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.ConvertMetricsContext(ctx, createTestMetricsFamily(), logger)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected cancelled error, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package converter
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/prompb"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// formatLabelFloat formats a bucket bound or quantile the way Prometheus normalizes le and quantile labels, e.g. "1.0", "0.25" and "+Inf"
+func formatLabelFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	formatted := strconv.FormatFloat(value, 'g', -1, 64)
+	if !strings.ContainsAny(formatted, ".e") {
+		formatted += ".0"
+	}
+	return formatted
+}
+
+// getSeries creates a time series with a single sample
+func getSeries(metricName string, metric *io_prometheus_client.Metric, value float64, timestamp int64, extra ...prompb.Label) prompb.TimeSeries {
+	return prompb.TimeSeries{
+		Labels:  getLabels(metricName, metric, extra...),
+		Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+	}
+}
+
+// getHistogramSeries expands a classic histogram into _bucket series with le labels, a _sum and a _count series
+func getHistogramSeries(metricName string, metric *io_prometheus_client.Metric, timestamp int64) []prompb.TimeSeries {
+	h := metric.GetHistogram()
+	count := h.GetSampleCountFloat()
+	if count == 0 {
+		count = float64(h.GetSampleCount())
+	}
+
+	series := make([]prompb.TimeSeries, 0, len(h.GetBucket())+3)
+	infSeen := false
+	for _, bucket := range h.GetBucket() {
+		upperBound := bucket.GetUpperBound()
+		if math.IsInf(upperBound, 1) {
+			infSeen = true
+		}
+		bucketCount := bucket.GetCumulativeCountFloat()
+		if bucketCount == 0 {
+			bucketCount = float64(bucket.GetCumulativeCount())
+		}
+		series = append(series, getSeries(metricName+"_bucket", metric, bucketCount, timestamp, prompb.Label{Name: "le", Value: formatLabelFloat(upperBound)}))
+	}
+	// The +Inf bucket is implicit in the client model, but required by remote write receivers
+	if !infSeen {
+		series = append(series, getSeries(metricName+"_bucket", metric, count, timestamp, prompb.Label{Name: "le", Value: "+Inf"}))
+	}
+	series = append(series,
+		getSeries(metricName+"_sum", metric, h.GetSampleSum(), timestamp),
+		getSeries(metricName+"_count", metric, count, timestamp),
+	)
+	return series
+}
+
+// getSummarySeries expands a summary into series with quantile labels, a _sum and a _count series
+func getSummarySeries(metricName string, metric *io_prometheus_client.Metric, timestamp int64) []prompb.TimeSeries {
+	s := metric.GetSummary()
+	count := float64(s.GetSampleCount())
+
+	series := make([]prompb.TimeSeries, 0, len(s.GetQuantile())+2)
+	for _, quantile := range s.GetQuantile() {
+		series = append(series, getSeries(metricName, metric, quantile.GetValue(), timestamp, prompb.Label{Name: "quantile", Value: formatLabelFloat(quantile.GetQuantile())}))
+	}
+	series = append(series,
+		getSeries(metricName+"_sum", metric, s.GetSampleSum(), timestamp),
+		getSeries(metricName+"_count", metric, count, timestamp),
+	)
+	return series
+}
+
+// isNativeHistogram reports whether a histogram carries native histogram buckets, using the same rules as the Prometheus scraper
+func isNativeHistogram(h *io_prometheus_client.Histogram) bool {
+	return len(h.GetPositiveSpan()) > 0 ||
+		len(h.GetNegativeSpan()) > 0 ||
+		h.GetZeroThreshold() > 0 ||
+		h.GetZeroCount() > 0 ||
+		h.GetZeroCountFloat() > 0
+}
+
+// getSpans converts client model bucket spans to histogram spans
+func getSpans(spans []*io_prometheus_client.BucketSpan) []histogram.Span {
+	converted := make([]histogram.Span, 0, len(spans))
+	for _, span := range spans {
+		converted = append(converted, histogram.Span{Offset: span.GetOffset(), Length: span.GetLength()})
+	}
+	return converted
+}
+
+// getNativeHistogramSeries converts a histogram with native buckets into a time series with a single native histogram sample
+func getNativeHistogramSeries(metricName string, metricType io_prometheus_client.MetricType, metric *io_prometheus_client.Metric, timestamp int64) prompb.TimeSeries {
+	h := metric.GetHistogram()
+	resetHint := histogram.UnknownCounterReset
+	if metricType == io_prometheus_client.MetricType_GAUGE_HISTOGRAM {
+		resetHint = histogram.GaugeType
+	}
+
+	var sample prompb.Histogram
+	if h.GetSampleCountFloat() > 0 || h.GetZeroCountFloat() > 0 {
+		// Float histograms carry absolute bucket counts
+		sample = prompb.FromFloatHistogram(timestamp, &histogram.FloatHistogram{
+			CounterResetHint: resetHint,
+			Schema:           h.GetSchema(),
+			ZeroThreshold:    h.GetZeroThreshold(),
+			ZeroCount:        h.GetZeroCountFloat(),
+			Count:            h.GetSampleCountFloat(),
+			Sum:              h.GetSampleSum(),
+			PositiveSpans:    getSpans(h.GetPositiveSpan()),
+			NegativeSpans:    getSpans(h.GetNegativeSpan()),
+			PositiveBuckets:  h.GetPositiveCount(),
+			NegativeBuckets:  h.GetNegativeCount(),
+		})
+	} else {
+		// Integer histograms carry bucket counts as deltas to the previous bucket
+		sample = prompb.FromIntHistogram(timestamp, &histogram.Histogram{
+			CounterResetHint: resetHint,
+			Schema:           h.GetSchema(),
+			ZeroThreshold:    h.GetZeroThreshold(),
+			ZeroCount:        h.GetZeroCount(),
+			Count:            h.GetSampleCount(),
+			Sum:              h.GetSampleSum(),
+			PositiveSpans:    getSpans(h.GetPositiveSpan()),
+			NegativeSpans:    getSpans(h.GetNegativeSpan()),
+			PositiveBuckets:  h.GetPositiveDelta(),
+			NegativeBuckets:  h.GetNegativeDelta(),
+		})
+	}
+
+	return prompb.TimeSeries{
+		Labels:     getLabels(metricName, metric),
+		Histograms: []prompb.Histogram{sample},
+	}
+}
@@ -0,0 +1,277 @@
+package converter
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+func createTestHistogramFamily() *io_prometheus_client.MetricFamily {
+	return &io_prometheus_client.MetricFamily{
+		Name: proto.String("test_histogram"),
+		Help: proto.String("This is a test histogram"),
+		Type: io_prometheus_client.MetricType_HISTOGRAM.Enum(),
+		Metric: []*io_prometheus_client.Metric{{
+			Label: []*io_prometheus_client.LabelPair{
+				{Name: proto.String("label1"), Value: proto.String("value1")},
+			},
+			Histogram: &io_prometheus_client.Histogram{
+				SampleCount: proto.Uint64(10),
+				SampleSum:   proto.Float64(12.5),
+				Bucket: []*io_prometheus_client.Bucket{
+					{UpperBound: proto.Float64(0.5), CumulativeCount: proto.Uint64(4)},
+					{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(7)},
+				},
+				Schema:        proto.Int32(0),
+				ZeroThreshold: proto.Float64(0.001),
+				ZeroCount:     proto.Uint64(1),
+				PositiveSpan: []*io_prometheus_client.BucketSpan{
+					{Offset: proto.Int32(0), Length: proto.Uint32(2)},
+				},
+				PositiveDelta: []int64{5, -1},
+			},
+		}},
+	}
+}
+
+// getTestSeries returns the time series with the given name whose last label matches, or nil
+func getTestSeries(timeSeries []prompb.TimeSeries, name string, labelName string, labelValue string) *prompb.TimeSeries {
+	for i, ts := range timeSeries {
+		if ts.Labels[0].Value != name {
+			continue
+		}
+		last := ts.Labels[len(ts.Labels)-1]
+		if labelName == "" || (last.Name == labelName && last.Value == labelValue) {
+			return &timeSeries[i]
+		}
+	}
+	return nil
+}
+
+func TestHistogramConversion(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	timeSeries, err := c.ConvertMetrics([]*io_prometheus_client.MetricFamily{createTestHistogramFamily()}, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert histogram: %v", err)
+	}
+	// Two buckets, the implicit +Inf bucket, _sum and _count
+	if len(timeSeries) != 5 {
+		t.Fatalf("Expected 5 time series, got %d", len(timeSeries))
+	}
+
+	expected := []struct {
+		name       string
+		labelName  string
+		labelValue string
+		value      float64
+	}{
+		{"test_histogram_bucket", "le", "0.5", 4},
+		{"test_histogram_bucket", "le", "1.0", 7},
+		{"test_histogram_bucket", "le", "+Inf", 10},
+		{"test_histogram_sum", "", "", 12.5},
+		{"test_histogram_count", "", "", 10},
+	}
+	for _, e := range expected {
+		ts := getTestSeries(timeSeries, e.name, e.labelName, e.labelValue)
+		if ts == nil {
+			t.Fatalf("Missing series %s{%s=%q}", e.name, e.labelName, e.labelValue)
+		}
+		if ts.Labels[1].Name != "label1" {
+			t.Fatalf("Expected metric labels to be kept on %s, got %v", e.name, ts.Labels)
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Value != e.value || ts.Samples[0].Timestamp == 0 {
+			t.Fatalf("Unexpected samples for %s{%s=%q}: %v", e.name, e.labelName, e.labelValue, ts.Samples)
+		}
+	}
+}
+
+func TestNativeHistogramConversion(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	_, err = NewConverter(logger, ConverterOpts{NativeHistograms: "maybe"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid native histograms setting, got nil")
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{NativeHistograms: "true"})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	timeSeries, err := c.ConvertMetrics([]*io_prometheus_client.MetricFamily{createTestHistogramFamily()}, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert histogram: %v", err)
+	}
+	if len(timeSeries) != 1 {
+		t.Fatalf("Expected a single native histogram series, got %d", len(timeSeries))
+	}
+	ts := timeSeries[0]
+	if ts.Labels[0].Value != "test_histogram" || len(ts.Samples) != 0 || len(ts.Histograms) != 1 {
+		t.Fatalf("Unexpected native histogram series: %v", ts)
+	}
+	h := ts.Histograms[0]
+	if h.IsFloatHistogram() || h.GetCountInt() != 10 || h.Sum != 12.5 || h.GetZeroCountInt() != 1 || h.ZeroThreshold != 0.001 {
+		t.Fatalf("Unexpected native histogram: %v", h)
+	}
+	if len(h.PositiveSpans) != 1 || h.PositiveSpans[0].Length != 2 || len(h.PositiveDeltas) != 2 || h.Timestamp == 0 {
+		t.Fatalf("Unexpected native histogram buckets: %v", h)
+	}
+
+	// Histograms without native buckets are still converted to classic series
+	classic := createTestHistogramFamily()
+	classic.Metric[0].Histogram.ZeroThreshold = nil
+	classic.Metric[0].Histogram.ZeroCount = nil
+	classic.Metric[0].Histogram.PositiveSpan = nil
+	classic.Metric[0].Histogram.PositiveDelta = nil
+	timeSeries, err = c.ConvertMetrics([]*io_prometheus_client.MetricFamily{classic}, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert histogram: %v", err)
+	}
+	if len(timeSeries) != 5 {
+		t.Fatalf("Expected 5 classic histogram series, got %d", len(timeSeries))
+	}
+}
+
+func TestSummaryAndUntypedConversion(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	families := []*io_prometheus_client.MetricFamily{
+		{
+			Name: proto.String("test_summary"),
+			Type: io_prometheus_client.MetricType_SUMMARY.Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Summary: &io_prometheus_client.Summary{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(6),
+					Quantile: []*io_prometheus_client.Quantile{
+						{Quantile: proto.Float64(0.5), Value: proto.Float64(2)},
+						{Quantile: proto.Float64(0.99), Value: proto.Float64(3)},
+					},
+				},
+			}},
+		},
+		{
+			Name: proto.String("test_untyped"),
+			Type: io_prometheus_client.MetricType_UNTYPED.Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Untyped: &io_prometheus_client.Untyped{Value: proto.Float64(42)},
+			}},
+		},
+		{
+			Name: proto.String("test_unknown"),
+			Type: io_prometheus_client.MetricType(99).Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1)},
+			}},
+		},
+	}
+
+	timeSeries, err := c.ConvertMetrics(families, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert metrics: %v", err)
+	}
+	// Two quantiles, _sum, _count and the untyped series, the unknown type is skipped
+	if len(timeSeries) != 5 {
+		t.Fatalf("Expected 5 time series, got %d", len(timeSeries))
+	}
+
+	expected := []struct {
+		name       string
+		labelName  string
+		labelValue string
+		value      float64
+	}{
+		{"test_summary", "quantile", "0.5", 2},
+		{"test_summary", "quantile", "0.99", 3},
+		{"test_summary_sum", "", "", 6},
+		{"test_summary_count", "", "", 3},
+		{"test_untyped", "", "", 42},
+	}
+	for _, e := range expected {
+		ts := getTestSeries(timeSeries, e.name, e.labelName, e.labelValue)
+		if ts == nil {
+			t.Fatalf("Missing series %s{%s=%q}", e.name, e.labelName, e.labelValue)
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Value != e.value {
+			t.Fatalf("Unexpected samples for %s{%s=%q}: %v", e.name, e.labelName, e.labelValue, ts.Samples)
+		}
+	}
+}
+
+func TestFormatLabelFloat(t *testing.T) {
+	tests := map[float64]string{
+		1:      "1.0",
+		0.25:   "0.25",
+		100:    "100.0",
+		1e+06:  "1e+06",
+		0.0001: "0.0001",
+	}
+	for value, expected := range tests {
+		if formatted := formatLabelFloat(value); formatted != expected {
+			t.Fatalf("Expected %s, got %s", expected, formatted)
+		}
+	}
+}
+
+func TestHistogramMetadataConversion(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	family := createTestHistogramFamily()
+	family.Metric[0].Histogram.CreatedTimestamp = timestamppb.New(time.UnixMilli(1000))
+	metadata, err := c.ConvertMetadata([]*io_prometheus_client.MetricFamily{family}, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert metadata: %v", err)
+	}
+	if len(metadata.Families) != 1 || metadata.Families[0].Type != prompb.MetricMetadata_HISTOGRAM {
+		t.Fatalf("Unexpected metadata families: %v", metadata.Families)
+	}
+	// Every series of the histogram shares the created timestamp
+	timeSeries, err := c.ConvertMetrics([]*io_prometheus_client.MetricFamily{family}, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert histogram: %v", err)
+	}
+	if len(metadata.CreatedTimestamps) != len(timeSeries) {
+		t.Fatalf("Expected %d created timestamps, got %d", len(timeSeries), len(metadata.CreatedTimestamps))
+	}
+	for _, ts := range timeSeries {
+		if metadata.CreatedTimestamps[types.SeriesKey(ts.Labels)] != 1000 {
+			t.Fatalf("Missing created timestamp for %v", ts.Labels)
+		}
+	}
+}
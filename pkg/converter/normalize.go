@@ -0,0 +1,188 @@
+package converter
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	InvalidNamesSanitize = "SANITIZE" // Invalid characters in metric and label names are replaced with underscores
+	InvalidNamesDrop     = "DROP"     // Series with invalid metric or label names are dropped
+)
+
+// normalizeStats counts the fixes made to the converted time series
+type normalizeStats struct {
+	emptyLabels      int // Labels dropped for having an empty value
+	sanitizedNames   int // Metric and label names with invalid characters replaced
+	sanitizedValues  int // Label values with invalid UTF-8 replaced
+	duplicateLabels  int // Labels dropped for repeating a label name within a series
+	droppedSeries    int // Series dropped for invalid names or an empty metric name
+	mergedSeries     int // Series merged into another series with the same labels
+	duplicateSamples int // Samples dropped for repeating a timestamp within a merged series
+}
+
+func (s normalizeStats) changed() bool {
+	return s != normalizeStats{}
+}
+
+// invalidNames returns how invalid names are handled, defaults to InvalidNamesSanitize
+func (c *Converter) invalidNames() string {
+	if c.InvalidNames == "" {
+		return InvalidNamesSanitize
+	}
+	return c.InvalidNames
+}
+
+// sanitizeName replaces characters that are not valid in a metric or label name with underscores, colons are only valid in metric names
+func sanitizeName(name string, metricName bool) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r == ':' && metricName):
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_') // Names can't start with a digit
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// isValidName reports whether a metric or label name is valid under the legacy Prometheus naming rules used by YACE
+func isValidName(name string, metricName bool) bool {
+	if metricName {
+		return model.IsValidLegacyMetricName(name)
+	}
+	return model.LabelName(name).IsValidLegacy()
+}
+
+// normalizeLabels sorts the labels by name, drops empty values and repeated names, and sanitizes invalid names and values.
+// It returns false if the series should be dropped because of invalid names or an empty metric name.
+func (c *Converter) normalizeLabels(labels []prompb.Label, stats *normalizeStats) ([]prompb.Label, bool) {
+
+	normalized := make([]prompb.Label, 0, len(labels))
+	for _, label := range labels {
+		if label.Name == model.MetricNameLabel && label.Value == "" {
+			stats.droppedSeries++ // A series without a metric name can't be stored
+			return nil, false
+		}
+		if label.Name == "" || label.Value == "" {
+			stats.emptyLabels++
+			continue
+		}
+		metricName := label.Name == model.MetricNameLabel
+		if !isValidName(label.Name, false) || (metricName && !isValidName(label.Value, true)) {
+			if c.invalidNames() == InvalidNamesDrop {
+				stats.droppedSeries++
+				return nil, false
+			}
+			stats.sanitizedNames++
+			if metricName {
+				label.Value = sanitizeName(label.Value, true)
+			} else {
+				label.Name = sanitizeName(label.Name, false)
+			}
+		}
+		if !utf8.ValidString(label.Value) {
+			stats.sanitizedValues++
+			label.Value = strings.ToValidUTF8(label.Value, string(utf8.RuneError))
+		}
+		normalized = append(normalized, label)
+	}
+
+	// The remote write spec requires labels sorted by name and unique within a series, the first occurrence of a name is kept
+	sort.SliceStable(normalized, func(i, j int) bool {
+		return normalized[i].Name < normalized[j].Name
+	})
+	unique := normalized[:0]
+	for i, label := range normalized {
+		if i > 0 && label.Name == normalized[i-1].Name {
+			stats.duplicateLabels++
+			continue
+		}
+		unique = append(unique, label)
+	}
+	return unique, true
+}
+
+// normalizeTimeSeries normalizes the labels of every series and merges series with identical labels, keeping the first sample for each timestamp
+func (c *Converter) normalizeTimeSeries(timeSeries []prompb.TimeSeries, logger types.Logger) []prompb.TimeSeries {
+
+	stats := normalizeStats{}
+	normalized := make([]prompb.TimeSeries, 0, len(timeSeries))
+	index := make(map[string]int, len(timeSeries))
+	for _, ts := range timeSeries {
+		labels, ok := c.normalizeLabels(ts.Labels, &stats)
+		if !ok {
+			continue
+		}
+		ts.Labels = labels
+
+		key := types.SeriesKey(ts.Labels)
+		i, duplicate := index[key]
+		if !duplicate {
+			index[key] = len(normalized)
+			normalized = append(normalized, ts)
+			continue
+		}
+		stats.mergedSeries++
+		merged := &normalized[i]
+		for _, sample := range ts.Samples {
+			if containsSampleTimestamp(merged, sample.Timestamp) {
+				stats.duplicateSamples++
+				continue
+			}
+			merged.Samples = append(merged.Samples, sample)
+		}
+		for _, h := range ts.Histograms {
+			if containsSampleTimestamp(merged, h.Timestamp) {
+				stats.duplicateSamples++
+				continue
+			}
+			merged.Histograms = append(merged.Histograms, h)
+		}
+		sort.Slice(merged.Samples, func(a, b int) bool { return merged.Samples[a].Timestamp < merged.Samples[b].Timestamp })
+		sort.Slice(merged.Histograms, func(a, b int) bool { return merged.Histograms[a].Timestamp < merged.Histograms[b].Timestamp })
+	}
+
+	level := "debug"
+	if stats.changed() {
+		level = "info"
+	}
+	logger.Log(level, "Normalized time series",
+		slog.Int("timeseries_count", len(normalized)),
+		slog.Int("empty_labels_dropped", stats.emptyLabels),
+		slog.Int("names_sanitized", stats.sanitizedNames),
+		slog.Int("values_sanitized", stats.sanitizedValues),
+		slog.Int("duplicate_labels_dropped", stats.duplicateLabels),
+		slog.Int("invalid_series_dropped", stats.droppedSeries),
+		slog.Int("duplicate_series_merged", stats.mergedSeries),
+		slog.Int("duplicate_samples_dropped", stats.duplicateSamples),
+	)
+	return normalized
+}
+
+// containsSampleTimestamp reports whether the series already has a sample or histogram at the timestamp
+func containsSampleTimestamp(ts *prompb.TimeSeries, timestamp int64) bool {
+	for _, sample := range ts.Samples {
+		if sample.Timestamp == timestamp {
+			return true
+		}
+	}
+	for _, h := range ts.Histograms {
+		if h.Timestamp == timestamp {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,226 @@
+package converter
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/proto"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+func createTestUnnormalizedFamilies() []*io_prometheus_client.MetricFamily {
+	return []*io_prometheus_client.MetricFamily{
+		{
+			Name: proto.String("test-gauge"),
+			Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{
+				{
+					Label: []*io_prometheus_client.LabelPair{
+						{Name: proto.String("zone"), Value: proto.String("a")},
+						{Name: proto.String("empty"), Value: proto.String("")},
+						{Name: proto.String("1st.label"), Value: proto.String("value")},
+						{Name: proto.String("account"), Value: proto.String("123456789012")},
+					},
+					Gauge:       &io_prometheus_client.Gauge{Value: proto.Float64(1)},
+					TimestampMs: proto.Int64(1000),
+				},
+				{
+					// Only differs by an empty label, so it's a duplicate of the series above once normalized
+					Label: []*io_prometheus_client.LabelPair{
+						{Name: proto.String("zone"), Value: proto.String("a")},
+						{Name: proto.String("1st.label"), Value: proto.String("value")},
+						{Name: proto.String("account"), Value: proto.String("123456789012")},
+					},
+					Gauge:       &io_prometheus_client.Gauge{Value: proto.Float64(2)},
+					TimestampMs: proto.Int64(2000),
+				},
+				{
+					Label: []*io_prometheus_client.LabelPair{
+						{Name: proto.String("zone"), Value: proto.String("a")},
+						{Name: proto.String("1st.label"), Value: proto.String("value")},
+						{Name: proto.String("account"), Value: proto.String("123456789012")},
+					},
+					Gauge:       &io_prometheus_client.Gauge{Value: proto.Float64(3)},
+					TimestampMs: proto.Int64(1000),
+				},
+			},
+		},
+		{
+			Name: proto.String("test_valid"),
+			Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Label: []*io_prometheus_client.LabelPair{
+					{Name: proto.String("zone"), Value: proto.String("a")},
+					{Name: proto.String("zone"), Value: proto.String("b")},
+					{Name: proto.String("invalid_utf8"), Value: proto.String("a\xffb")},
+				},
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(4)},
+			}},
+		},
+	}
+}
+
+func TestNormalizeSanitize(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	_, err = NewConverter(logger, ConverterOpts{InvalidNames: "IGNORE"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid names setting, got nil")
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	timeSeries, err := c.ConvertMetrics(createTestUnnormalizedFamilies(), logger)
+	if err != nil {
+		t.Fatalf("Failed to convert metrics: %v", err)
+	}
+	if len(timeSeries) != 2 {
+		t.Fatalf("Expected duplicate series to be merged into 2 series, got %d", len(timeSeries))
+	}
+
+	for _, ts := range timeSeries {
+		if !sort.SliceIsSorted(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name }) {
+			t.Fatalf("Expected sorted labels, got %v", ts.Labels)
+		}
+	}
+
+	merged := timeSeries[0]
+	expected := []prompb.Label{
+		{Name: "_1st_label", Value: "value"},
+		{Name: "__name__", Value: "test_gauge"},
+		{Name: "account", Value: "123456789012"},
+		{Name: "zone", Value: "a"},
+	}
+	if len(merged.Labels) != len(expected) {
+		t.Fatalf("Expected labels %v, got %v", expected, merged.Labels)
+	}
+	for i, label := range expected {
+		if merged.Labels[i].Name != label.Name || merged.Labels[i].Value != label.Value {
+			t.Fatalf("Expected labels %v, got %v", expected, merged.Labels)
+		}
+	}
+	// Samples are merged in timestamp order, the first sample for a timestamp is kept
+	if len(merged.Samples) != 2 || merged.Samples[0].Value != 1 || merged.Samples[1].Timestamp != 2000 {
+		t.Fatalf("Unexpected merged samples: %v", merged.Samples)
+	}
+
+	valid := timeSeries[1]
+	if len(valid.Labels) != 3 || valid.Labels[2].Value != "a" {
+		t.Fatalf("Expected repeated label to be dropped keeping the first value, got %v", valid.Labels)
+	}
+	if valid.Labels[1].Name != "invalid_utf8" || valid.Labels[1].Value != "a�b" {
+		t.Fatalf("Expected invalid UTF-8 to be replaced, got %q", valid.Labels[1].Value)
+	}
+}
+
+func TestNormalizeDrop(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{InvalidNames: InvalidNamesDrop})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	timeSeries, err := c.ConvertMetrics(createTestUnnormalizedFamilies(), logger)
+	if err != nil {
+		t.Fatalf("Failed to convert metrics: %v", err)
+	}
+	if len(timeSeries) != 1 || timeSeries[0].Labels[0].Value != "test_valid" {
+		t.Fatalf("Expected only the series with valid names to be kept, got %v", timeSeries)
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name       string
+		metricName bool
+		expected   string
+	}{
+		{"valid_name", false, "valid_name"},
+		{"dimension.InstanceId", false, "dimension_InstanceId"},
+		{"1label", false, "_1label"},
+		{"ns:metric-name", true, "ns:metric_name"},
+		{"ns:label", false, "ns_label"},
+	}
+	for _, test := range tests {
+		if sanitized := sanitizeName(test.name, test.metricName); sanitized != test.expected {
+			t.Fatalf("Expected %s to be sanitized to %s, got %s", test.name, test.expected, sanitized)
+		}
+	}
+}
+
+func TestNormalizeConverterLabels(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	families := []*io_prometheus_client.MetricFamily{
+		{
+			// A series without a metric name is dropped, instead of being sent without one
+			Name: proto.String(""),
+			Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Label: []*io_prometheus_client.LabelPair{{Name: proto.String("zone"), Value: proto.String("a")}},
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1)},
+			}},
+		},
+		{
+			// A dimension named le doesn't replace the bucket bounds
+			Name: proto.String("test_histogram"),
+			Type: io_prometheus_client.MetricType_HISTOGRAM.Enum(),
+			Metric: []*io_prometheus_client.Metric{{
+				Label: []*io_prometheus_client.LabelPair{{Name: proto.String("le"), Value: proto.String("dimension")}},
+				Histogram: &io_prometheus_client.Histogram{
+					SampleCount: proto.Uint64(3),
+					SampleSum:   proto.Float64(6),
+					Bucket: []*io_prometheus_client.Bucket{
+						{UpperBound: proto.Float64(1), CumulativeCount: proto.Uint64(1)},
+						{UpperBound: proto.Float64(2), CumulativeCount: proto.Uint64(2)},
+					},
+				},
+			}},
+		},
+	}
+
+	timeSeries, err := c.ConvertMetrics(families, logger)
+	if err != nil {
+		t.Fatalf("Failed to convert metrics: %v", err)
+	}
+	buckets := map[string]bool{}
+	for _, ts := range timeSeries {
+		name := ""
+		for _, label := range ts.Labels {
+			if label.Name == "__name__" {
+				name = label.Value
+			}
+			if label.Name == "le" && name == "test_histogram_bucket" {
+				buckets[label.Value] = true
+			}
+		}
+		if name == "" {
+			t.Fatalf("Expected series without a metric name to be dropped, got %v", ts.Labels)
+		}
+	}
+	if len(buckets) != 3 || !buckets["1.0"] || !buckets["2.0"] || !buckets["+Inf"] {
+		t.Fatalf("Expected the bucket bounds to be kept, got %v", buckets)
+	}
+}
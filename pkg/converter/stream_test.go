@@ -0,0 +1,117 @@
+package converter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/proto"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+func createManyTestMetricsFamilies(families int, metricsPerFamily int) []*io_prometheus_client.MetricFamily {
+	metrics := []*io_prometheus_client.MetricFamily{}
+	for i := 0; i < families; i++ {
+		family := &io_prometheus_client.MetricFamily{
+			Name: proto.String(fmt.Sprintf("test_gauge_%d", i)),
+			Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+		}
+		for j := 0; j < metricsPerFamily; j++ {
+			family.Metric = append(family.Metric, &io_prometheus_client.Metric{
+				Label: []*io_prometheus_client.LabelPair{{Name: proto.String("instance"), Value: proto.String(fmt.Sprintf("i-%08d", j))}},
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(float64(j))},
+			})
+		}
+		metrics = append(metrics, family)
+	}
+	return metrics
+}
+
+func TestMetricsProcessingStream(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c, err := NewConverter(logger, ConverterOpts{ChunkSize: "25"})
+	if err != nil {
+		t.Fatalf("Failed to create converter: %v", err)
+	}
+
+	// Chunks are cut within families, so a large family doesn't end up in a single chunk
+	metrics := createManyTestMetricsFamilies(3, 40)
+	chunks, total := 0, 0
+	for chunk, err := range c.ConvertMetricsStream(context.Background(), metrics, logger) {
+		if err != nil {
+			t.Fatalf("Failed to process metrics: %v", err)
+		}
+		if len(chunk) > 25 {
+			t.Fatalf("Expected at most 25 series per chunk, got %d", len(chunk))
+		}
+		chunks++
+		total += len(chunk)
+	}
+	if chunks != 5 || total != 120 {
+		t.Fatalf("Expected 120 series in 5 chunks, got %d series in %d chunks", total, chunks)
+	}
+
+	all, err := c.ConvertMetrics(metrics, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(all) != total {
+		t.Fatalf("Expected streaming to produce the same %d series, got %d", len(all), total)
+	}
+
+	// The consumer can stop early
+	chunks = 0
+	for range c.ConvertMetricsStream(context.Background(), metrics, logger) {
+		chunks++
+		break
+	}
+	if chunks != 1 {
+		t.Fatalf("Expected 1 chunk before stopping, got %d", chunks)
+	}
+}
+
+func TestMetricsProcessingStreamCancelled(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	c := &Converter{ChunkSize: 10}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var streamErr error
+	received := []prompb.TimeSeries{}
+	for chunk, err := range c.ConvertMetricsStream(ctx, createManyTestMetricsFamilies(3, 10), logger) {
+		if err != nil {
+			streamErr = err
+			break
+		}
+		received = append(received, chunk...)
+		cancel() // Cancel after the first family
+	}
+	if !errors.Is(streamErr, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", streamErr)
+	}
+	if len(received) != 10 {
+		t.Fatalf("Expected the 10 series converted before cancelling, got %d", len(received))
+	}
+}
+
+func TestChunkSizeOption(t *testing.T) {
+
+	for _, size := range []string{"0", "-1", "many"} {
+		_, err := NewConverter(nil, ConverterOpts{ChunkSize: size})
+		if err == nil {
+			t.Fatalf("Expected error for chunk size %q, got nil", size)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package converter
+
+import (
+	"fmt"
+	"time"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+const (
+	TimestampCollection       = "COLLECTION"        // Collection wall-clock time for every sample
+	TimestampCloudwatchFamily = "CLOUDWATCH_FAMILY" // Cloudwatch timestamps, metrics without one use the newest timestamp of their family
+	TimestampCloudwatchNewest = "CLOUDWATCH_NEWEST" // Cloudwatch timestamps, metrics without one use the newest timestamp of the run
+	TimestampOffset           = "OFFSET"            // Collection wall-clock time minus a fixed offset for every sample
+)
+
+// TimestampFunc returns the sample timestamp in milliseconds of a metric
+type TimestampFunc func(family *io_prometheus_client.MetricFamily, metric *io_prometheus_client.Metric) int64
+
+// TimestampStrategy is an interface for deciding the timestamps of converted samples
+type TimestampStrategy interface {
+	// Timestamps is called once per conversion with the metrics and the collection time, so no state is carried between warm Lambda invocations
+	Timestamps(metrics []*io_prometheus_client.MetricFamily, now time.Time) TimestampFunc
+}
+
+// NewTimestampStrategy returns the timestamp strategy with the given name, the offset is only used by the OFFSET strategy
+func NewTimestampStrategy(name string, offset string) (TimestampStrategy, error) {
+	switch name {
+	case "", TimestampCloudwatchFamily:
+		return CloudwatchFamilyStrategy{}, nil
+	case TimestampCollection:
+		return CollectionStrategy{}, nil
+	case TimestampCloudwatchNewest:
+		return CloudwatchNewestStrategy{}, nil
+	case TimestampOffset:
+		if offset == "" {
+			return nil, fmt.Errorf("timestamp offset must be set for the OFFSET timestamp strategy")
+		}
+		d, err := time.ParseDuration(offset)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp offset: %w", err)
+		}
+		return OffsetStrategy{Offset: d}, nil
+	default:
+		return nil, fmt.Errorf("invalid timestamp strategy: %s", name)
+	}
+}
+
+// CollectionStrategy uses the collection wall-clock time for every sample and ignores Cloudwatch timestamps
+type CollectionStrategy struct{}
+
+func (CollectionStrategy) Timestamps(metrics []*io_prometheus_client.MetricFamily, now time.Time) TimestampFunc {
+	return func(*io_prometheus_client.MetricFamily, *io_prometheus_client.Metric) int64 {
+		return now.UnixMilli()
+	}
+}
+
+// OffsetStrategy uses the collection wall-clock time minus a fixed offset for every sample, for namespaces where Cloudwatch data is delayed
+type OffsetStrategy struct {
+	Offset time.Duration // Offset subtracted from the collection time
+}
+
+func (s OffsetStrategy) Timestamps(metrics []*io_prometheus_client.MetricFamily, now time.Time) TimestampFunc {
+	return func(*io_prometheus_client.MetricFamily, *io_prometheus_client.Metric) int64 {
+		return now.Add(-s.Offset).UnixMilli()
+	}
+}
+
+// CloudwatchFamilyStrategy uses the Cloudwatch timestamp of each metric. Metrics without one, such as YACE helper metrics, use the newest timestamp of their own family, or the collection time if the family has none.
+type CloudwatchFamilyStrategy struct{}
+
+func (CloudwatchFamilyStrategy) Timestamps(metrics []*io_prometheus_client.MetricFamily, now time.Time) TimestampFunc {
+	newest := make(map[*io_prometheus_client.MetricFamily]int64, len(metrics))
+	for _, family := range metrics {
+		newest[family] = newestTimestamp([]*io_prometheus_client.MetricFamily{family})
+	}
+	return func(family *io_prometheus_client.MetricFamily, metric *io_prometheus_client.Metric) int64 {
+		if timestamp := metric.GetTimestampMs(); timestamp != 0 {
+			return timestamp
+		}
+		if timestamp := newest[family]; timestamp != 0 {
+			return timestamp
+		}
+		return now.UnixMilli()
+	}
+}
+
+// CloudwatchNewestStrategy uses the Cloudwatch timestamp of each metric. Metrics without one use the newest timestamp of all metrics, or the collection time if no metric has one.
+type CloudwatchNewestStrategy struct{}
+
+func (CloudwatchNewestStrategy) Timestamps(metrics []*io_prometheus_client.MetricFamily, now time.Time) TimestampFunc {
+	fallback := newestTimestamp(metrics)
+	if fallback == 0 {
+		fallback = now.UnixMilli()
+	}
+	return func(family *io_prometheus_client.MetricFamily, metric *io_prometheus_client.Metric) int64 {
+		if timestamp := metric.GetTimestampMs(); timestamp != 0 {
+			return timestamp
+		}
+		return fallback
+	}
+}
+
+// newestTimestamp returns the newest Cloudwatch timestamp of the metrics, or zero if none of them has one
+func newestTimestamp(metrics []*io_prometheus_client.MetricFamily) int64 {
+	var newest int64
+	for _, family := range metrics {
+		for _, metric := range family.GetMetric() {
+			newest = max(newest, metric.GetTimestampMs())
+		}
+	}
+	return newest
+}
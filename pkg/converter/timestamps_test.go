@@ -0,0 +1,142 @@
+package converter
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"google.golang.org/protobuf/proto"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// createTestTimestampedFamilies creates a family with one timestamped and one untimestamped metric, a helper family without timestamps and a second family with the given timestamp
+func createTestTimestampedFamilies(timestamp int64, otherTimestamp int64) []*io_prometheus_client.MetricFamily {
+	gauge := func(id string, timestamp int64) *io_prometheus_client.Metric {
+		metric := &io_prometheus_client.Metric{
+			Label: []*io_prometheus_client.LabelPair{{Name: proto.String("id"), Value: proto.String(id)}},
+			Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1)},
+		}
+		if timestamp != 0 {
+			metric.TimestampMs = proto.Int64(timestamp)
+		}
+		return metric
+	}
+	return []*io_prometheus_client.MetricFamily{
+		{
+			Name:   proto.String("aws_ec2_cpuutilization_average"),
+			Type:   io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{gauge("a", timestamp), gauge("b", 0)},
+		},
+		{
+			Name:   proto.String("aws_ec2_info"),
+			Type:   io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{gauge("c", 0)},
+		},
+		{
+			Name:   proto.String("aws_rds_cpuutilization_average"),
+			Type:   io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{gauge("d", otherTimestamp)},
+		},
+	}
+}
+
+func TestTimestampStrategyOptions(t *testing.T) {
+
+	tests := []struct {
+		strategy string
+		offset   string
+	}{
+		{"LATEST", ""},
+		{TimestampOffset, ""},
+		{TimestampOffset, "five minutes"},
+	}
+	for _, test := range tests {
+		_, err := NewTimestampStrategy(test.strategy, test.offset)
+		if err == nil {
+			t.Fatalf("Expected error for strategy %q and offset %q, got nil", test.strategy, test.offset)
+		}
+	}
+
+	strategy, err := NewTimestampStrategy("", "")
+	if err != nil {
+		t.Fatalf("Failed to create default strategy: %v", err)
+	}
+	if _, ok := strategy.(CloudwatchFamilyStrategy); !ok {
+		t.Fatalf("Expected default strategy CloudwatchFamilyStrategy, got %T", strategy)
+	}
+}
+
+func TestTimestampStrategies(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	coldNow := time.UnixMilli(1000000)
+	warmNow := time.UnixMilli(1300000)
+
+	tests := []struct {
+		strategy string
+		cold     []int64 // Expected timestamps of the series in the cold run
+		warm     []int64 // Expected timestamps of the series in the warm run
+	}{
+		{
+			strategy: TimestampCollection,
+			cold:     []int64{1000000, 1000000, 1000000, 1000000},
+			warm:     []int64{1300000, 1300000, 1300000, 1300000},
+		},
+		{
+			// Helper metrics don't borrow timestamps from other families
+			strategy: TimestampCloudwatchFamily,
+			cold:     []int64{100000, 100000, 1000000, 200000},
+			warm:     []int64{400000, 400000, 1300000, 1300000},
+		},
+		{
+			strategy: TimestampCloudwatchNewest,
+			cold:     []int64{100000, 200000, 200000, 200000},
+			warm:     []int64{400000, 400000, 400000, 400000},
+		},
+		{
+			strategy: TimestampOffset,
+			cold:     []int64{700000, 700000, 700000, 700000},
+			warm:     []int64{1000000, 1000000, 1000000, 1000000},
+		},
+	}
+
+	for _, test := range tests {
+		// A cold start creates a new converter, warm invocations reuse it
+		c, err := NewConverter(logger, ConverterOpts{TimestampStrategy: test.strategy, TimestampOffset: "5m"})
+		if err != nil {
+			t.Fatalf("Failed to create converter: %v", err)
+		}
+
+		runs := []struct {
+			name     string
+			now      time.Time
+			metrics  []*io_prometheus_client.MetricFamily
+			expected []int64
+		}{
+			{"cold", coldNow, createTestTimestampedFamilies(100000, 200000), test.cold},
+			// No new Cloudwatch data for the second family, nothing from the cold run may be reused
+			{"warm", warmNow, createTestTimestampedFamilies(400000, 0), test.warm},
+		}
+		for _, run := range runs {
+			c.now = func() time.Time { return run.now }
+			timeSeries, err := c.ConvertMetrics(run.metrics, logger)
+			if err != nil {
+				t.Fatalf("Failed to convert metrics: %v", err)
+			}
+			if len(timeSeries) != len(run.expected) {
+				t.Fatalf("%s %s run: expected %d time series, got %d", test.strategy, run.name, len(run.expected), len(timeSeries))
+			}
+			for i, ts := range timeSeries {
+				if ts.Samples[0].Timestamp != run.expected[i] {
+					t.Fatalf("%s %s run: expected timestamp %d for series %d, got %d", test.strategy, run.name, run.expected[i], i, ts.Samples[0].Timestamp)
+				}
+			}
+		}
+	}
+}
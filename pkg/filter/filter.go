@@ -0,0 +1,233 @@
+// Package filter provides a filter that drops metrics by name and labels after collection, before they are converted. It implements the types.MetricFilter interface.
+package filter
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v2"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// FilterConfig is the YAML format of the filters, given either in the environment or in a filters section of the YACE config file
+type FilterConfig struct {
+	IncludeNames  []string `yaml:"include_names"`  // Regexes of metric names to keep, all metrics are kept if empty
+	ExcludeNames  []string `yaml:"exclude_names"`  // Regexes of metric names to drop
+	IncludeLabels []string `yaml:"include_labels"` // Label matchers a metric must all match to be kept, e.g. region="eu-west-1"
+	ExcludeLabels []string `yaml:"exclude_labels"` // Label matchers a metric is dropped for matching any of, e.g. name=~"test-.*"
+}
+
+// IsEmpty reports whether the config has no filters
+func (c FilterConfig) IsEmpty() bool {
+	return len(c.IncludeNames) == 0 && len(c.ExcludeNames) == 0 && len(c.IncludeLabels) == 0 && len(c.ExcludeLabels) == 0
+}
+
+type Filter struct {
+	IncludeNames  []*regexp.Regexp  // Metric families are kept if their name matches any of these, or if empty
+	ExcludeNames  []*regexp.Regexp  // Metric families are dropped if their name matches any of these
+	IncludeLabels []*labels.Matcher // Metrics are kept if their labels match all of these
+	ExcludeLabels []*labels.Matcher // Metrics are dropped if their labels match any of these
+}
+
+// ParseFilterConfig parses filters in YAML, either as a mapping of the filters or as a mapping with a filters key
+func ParseFilterConfig(config []byte) (FilterConfig, error) {
+
+	cfg := FilterConfig{}
+	err := yaml.UnmarshalStrict(config, &cfg)
+	if err != nil {
+		wrapped := struct {
+			Filters FilterConfig `yaml:"filters"`
+		}{}
+		if wrappedErr := yaml.UnmarshalStrict(config, &wrapped); wrappedErr != nil {
+			return FilterConfig{}, fmt.Errorf("invalid metric filters: %w", err)
+		}
+		cfg = wrapped.Filters
+	}
+	return cfg, nil
+}
+
+// ParseConfigFileFilters parses the filters section of a YACE config file, the rest of the file is ignored
+func ParseConfigFileFilters(contents []byte) (FilterConfig, error) {
+
+	file := struct {
+		Filters FilterConfig `yaml:"filters"`
+	}{}
+	err := yaml.Unmarshal(contents, &file)
+	if err != nil {
+		return FilterConfig{}, fmt.Errorf("invalid metric filters in config file: %w", err)
+	}
+	return file.Filters, nil
+}
+
+// NewFilter compiles the name regexes and label matchers of the config. Name regexes are anchored at both ends, like Prometheus regexes.
+func NewFilter(config FilterConfig) (*Filter, error) {
+
+	f := &Filter{}
+	var err error
+	f.IncludeNames, err = compileNames(config.IncludeNames)
+	if err != nil {
+		return nil, err
+	}
+	f.ExcludeNames, err = compileNames(config.ExcludeNames)
+	if err != nil {
+		return nil, err
+	}
+	f.IncludeLabels, err = parseMatchers(config.IncludeLabels)
+	if err != nil {
+		return nil, err
+	}
+	f.ExcludeLabels, err = parseMatchers(config.ExcludeLabels)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// compileNames compiles anchored metric name regexes
+func compileNames(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric name filter %q: %w", pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// parseMatchers parses label matchers in PromQL format, e.g. region="eu-west-1" or name=~"test-.*". Quoting the value is optional.
+func parseMatchers(matchers []string) ([]*labels.Matcher, error) {
+	parsed := make([]*labels.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		i := strings.IndexAny(matcher, "=!")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid label matcher %q, expected e.g. name=\"value\"", matcher)
+		}
+		name, rest := strings.TrimSpace(matcher[:i]), matcher[i:]
+
+		var matchType labels.MatchType
+		switch {
+		case strings.HasPrefix(rest, "=~"):
+			matchType, rest = labels.MatchRegexp, rest[2:]
+		case strings.HasPrefix(rest, "!~"):
+			matchType, rest = labels.MatchNotRegexp, rest[2:]
+		case strings.HasPrefix(rest, "!="):
+			matchType, rest = labels.MatchNotEqual, rest[2:]
+		case strings.HasPrefix(rest, "="):
+			matchType, rest = labels.MatchEqual, rest[1:]
+		default:
+			return nil, fmt.Errorf("invalid label matcher %q, expected one of =, !=, =~ and !~", matcher)
+		}
+		if !model.LabelName(name).IsValidLegacy() {
+			return nil, fmt.Errorf("invalid label name in matcher %q", matcher)
+		}
+
+		value := strings.TrimSpace(rest)
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		m, err := labels.NewMatcher(matchType, name, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label matcher %q: %w", matcher, err)
+		}
+		parsed = append(parsed, m)
+	}
+	return parsed, nil
+}
+
+// keepName reports whether a metric family is kept by the name filters
+func (f *Filter) keepName(name string) bool {
+	if len(f.IncludeNames) > 0 {
+		included := false
+		for _, re := range f.IncludeNames {
+			if re.MatchString(name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, re := range f.ExcludeNames {
+		if re.MatchString(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// keepLabels reports whether a metric is kept by the label matchers. The family name is matched as the __name__ label, and missing labels match as empty values, like in PromQL.
+func (f *Filter) keepLabels(name string, metric *io_prometheus_client.Metric) bool {
+	value := func(labelName string) string {
+		if labelName == model.MetricNameLabel {
+			return name
+		}
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == labelName {
+				return label.GetValue()
+			}
+		}
+		return ""
+	}
+	for _, m := range f.IncludeLabels {
+		if !m.Matches(value(m.Name)) {
+			return false
+		}
+	}
+	for _, m := range f.ExcludeLabels {
+		if m.Matches(value(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// FilterMetrics drops metric families by name, and metrics by their labels. Families left without metrics are dropped.
+func (f *Filter) FilterMetrics(metrics []*io_prometheus_client.MetricFamily, logger types.Logger) ([]*io_prometheus_client.MetricFamily, error) {
+
+	filtered := make([]*io_prometheus_client.MetricFamily, 0, len(metrics))
+	droppedFamilies, droppedMetrics := 0, 0
+	for _, family := range metrics {
+		if !f.keepName(family.GetName()) {
+			droppedFamilies++
+			droppedMetrics += len(family.GetMetric())
+			continue
+		}
+		if len(f.IncludeLabels) == 0 && len(f.ExcludeLabels) == 0 {
+			filtered = append(filtered, family)
+			continue
+		}
+
+		kept := make([]*io_prometheus_client.Metric, 0, len(family.GetMetric()))
+		for _, metric := range family.GetMetric() {
+			if f.keepLabels(family.GetName(), metric) {
+				kept = append(kept, metric)
+			}
+		}
+		droppedMetrics += len(family.GetMetric()) - len(kept)
+		if len(kept) == 0 {
+			droppedFamilies++
+			continue
+		}
+		// The family is copied, as it may be shared with the registry
+		filtered = append(filtered, &io_prometheus_client.MetricFamily{
+			Name:   family.Name,
+			Help:   family.Help,
+			Type:   family.Type,
+			Unit:   family.Unit,
+			Metric: kept,
+		})
+	}
+
+	logger.Log("debug", "Filtered metrics", slog.Int("family_count", len(filtered)), slog.Int("families_dropped", droppedFamilies), slog.Int("metrics_dropped", droppedMetrics))
+	return filtered, nil
+}
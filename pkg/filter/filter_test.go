@@ -0,0 +1,173 @@
+package filter
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"google.golang.org/protobuf/proto"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+func createTestMetric(labels ...string) *io_prometheus_client.Metric {
+	metric := &io_prometheus_client.Metric{
+		Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(1.0)},
+	}
+	for i := 0; i+1 < len(labels); i += 2 {
+		metric.Label = append(metric.Label, &io_prometheus_client.LabelPair{Name: proto.String(labels[i]), Value: proto.String(labels[i+1])})
+	}
+	return metric
+}
+
+func createTestMetricsFamilies() []*io_prometheus_client.MetricFamily {
+	return []*io_prometheus_client.MetricFamily{
+		{
+			Name: proto.String("aws_ec2_cpuutilization_average"),
+			Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{
+				createTestMetric("region", "eu-west-1", "name", "web-1"),
+				createTestMetric("region", "eu-west-1", "name", "test-1"),
+				createTestMetric("region", "us-east-1", "name", "web-2"),
+			},
+		},
+		{
+			Name:   proto.String("aws_ec2_info"),
+			Type:   io_prometheus_client.MetricType_GAUGE.Enum(),
+			Metric: []*io_prometheus_client.Metric{createTestMetric("region", "eu-west-1", "name", "web-1")},
+		},
+		{
+			Name:   proto.String("yace_cloudwatch_requests_total"),
+			Type:   io_prometheus_client.MetricType_COUNTER.Enum(),
+			Metric: []*io_prometheus_client.Metric{{Counter: &io_prometheus_client.Counter{Value: proto.Float64(10)}}},
+		},
+	}
+}
+
+// familyNames returns the names of the families and the number of metrics in each
+func familyNames(metrics []*io_prometheus_client.MetricFamily) map[string]int {
+	names := map[string]int{}
+	for _, family := range metrics {
+		names[family.GetName()] = len(family.GetMetric())
+	}
+	return names
+}
+
+func TestFilterOptions(t *testing.T) {
+
+	tests := []FilterConfig{
+		{IncludeNames: []string{"aws_(ec2"}},
+		{ExcludeNames: []string{"*"}},
+		{IncludeLabels: []string{"region"}},
+		{IncludeLabels: []string{`1region="eu-west-1"`}},
+		{ExcludeLabels: []string{`name=~"test-(.*"`}},
+		{ExcludeLabels: []string{`="value"`}},
+	}
+	for _, test := range tests {
+		_, err := NewFilter(test)
+		if err == nil {
+			t.Fatalf("Expected error for %+v, got nil", test)
+		}
+	}
+
+	f, err := NewFilter(FilterConfig{IncludeLabels: []string{`region = "eu-west-1"`, "name!~test-.*"}})
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+	if f.IncludeLabels[0].Value != "eu-west-1" || f.IncludeLabels[1].Value != "test-.*" {
+		t.Fatalf("Unexpected label matchers: %v", f.IncludeLabels)
+	}
+}
+
+func TestParseFilterConfig(t *testing.T) {
+
+	cfg, err := ParseFilterConfig([]byte("exclude_names: [yace_.*]\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse filters: %v", err)
+	}
+	if len(cfg.ExcludeNames) != 1 {
+		t.Fatalf("Expected 1 exclude name, got %v", cfg.ExcludeNames)
+	}
+
+	cfg, err = ParseFilterConfig([]byte("filters:\n  include_names: [aws_.*]\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse wrapped filters: %v", err)
+	}
+	if len(cfg.IncludeNames) != 1 {
+		t.Fatalf("Expected 1 include name, got %v", cfg.IncludeNames)
+	}
+
+	_, err = ParseFilterConfig([]byte("exclude: [yace_.*]\n"))
+	if err == nil {
+		t.Fatalf("Expected error for unknown filter key, got nil")
+	}
+
+	// The YACE config in the rest of the file is ignored
+	cfg, err = ParseConfigFileFilters([]byte("apiVersion: v1alpha1\ndiscovery:\n  jobs: []\nfilters:\n  exclude_labels: ['name=~\"test-.*\"']\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse config file filters: %v", err)
+	}
+	if len(cfg.ExcludeLabels) != 1 || cfg.IsEmpty() {
+		t.Fatalf("Expected 1 exclude label matcher, got %v", cfg.ExcludeLabels)
+	}
+	cfg, err = ParseConfigFileFilters([]byte("apiVersion: v1alpha1\n"))
+	if err != nil || !cfg.IsEmpty() {
+		t.Fatalf("Expected no filters for config file without filters, got %+v, %v", cfg, err)
+	}
+}
+
+func TestFilterNames(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	f, err := NewFilter(FilterConfig{
+		IncludeNames: []string{"aws_.*", "yace_.*"},
+		ExcludeNames: []string{".*_info", "yace_cloudwatch_requests"}, // Anchored, so the second doesn't match the _total family
+	})
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	filtered, err := f.FilterMetrics(createTestMetricsFamilies(), logger)
+	if err != nil {
+		t.Fatalf("Failed to filter metrics: %v", err)
+	}
+	names := familyNames(filtered)
+	if len(names) != 2 || names["aws_ec2_cpuutilization_average"] != 3 || names["yace_cloudwatch_requests_total"] != 1 {
+		t.Fatalf("Unexpected families after filtering: %v", names)
+	}
+}
+
+func TestFilterLabels(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	f, err := NewFilter(FilterConfig{
+		IncludeLabels: []string{`region="eu-west-1"`},
+		ExcludeLabels: []string{`name=~"test-.*"`, `__name__="aws_ec2_info"`},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create filter: %v", err)
+	}
+
+	metrics := createTestMetricsFamilies()
+	filtered, err := f.FilterMetrics(metrics, logger)
+	if err != nil {
+		t.Fatalf("Failed to filter metrics: %v", err)
+	}
+	// The YACE metric has no region label, which matches as an empty value
+	names := familyNames(filtered)
+	if len(names) != 1 || names["aws_ec2_cpuutilization_average"] != 1 {
+		t.Fatalf("Unexpected families after filtering: %v", names)
+	}
+	if filtered[0].GetMetric()[0].GetLabel()[1].GetValue() != "web-1" {
+		t.Fatalf("Expected metric web-1 to be kept, got %v", filtered[0].GetMetric()[0].GetLabel())
+	}
+	if len(metrics[0].GetMetric()) != 3 {
+		t.Fatalf("Expected the original family to be left unchanged, got %d metrics", len(metrics[0].GetMetric()))
+	}
+}
@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+)
+
+// Handler is a slog.Handler that passes records on to a types.Logger, so libraries logging with slog share the format, level and destination of yac-p's own logs
+type Handler struct {
+	Logger types.Logger // Logger the records are passed on to
+	attrs  []any        // Attributes added with WithAttrs
+	prefix string       // Key prefix of the groups added with WithGroup
+}
+
+// NewHandler creates a slog.Handler that logs through the given logger
+func NewHandler(logger types.Logger) *Handler {
+	return &Handler{Logger: logger}
+}
+
+// Enabled reports whether the logger logs at the given level. Loggers that can't tell are assumed to log at every level and filter the records themselves.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	if l, ok := h.Logger.(interface {
+		Enabled(context.Context, slog.Level) bool
+	}); ok {
+		return l.Enabled(ctx, level)
+	}
+	return true
+}
+
+// Handle logs the record at the matching level of the logger, with the attributes of the handler followed by those of the record
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	args := make([]any, 0, len(h.attrs)+record.NumAttrs())
+	args = append(args, h.attrs...)
+	record.Attrs(func(attr slog.Attr) bool {
+		args = append(args, h.prefixed(attr))
+		return true
+	})
+	h.Logger.Log(levelName(record.Level), record.Message, args...)
+	return nil
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = make([]any, 0, len(h.attrs)+len(attrs))
+	handler.attrs = append(handler.attrs, h.attrs...)
+	for _, attr := range attrs {
+		handler.attrs = append(handler.attrs, h.prefixed(attr))
+	}
+	return &handler
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	handler := *h
+	handler.prefix = h.prefix + name + "."
+	return &handler
+}
+
+// prefixed returns the attribute with the group prefix added to its key
+func (h *Handler) prefixed(attr slog.Attr) slog.Attr {
+	if h.prefix != "" && attr.Key != "" {
+		attr.Key = h.prefix + attr.Key
+	}
+	return attr
+}
+
+// levelName returns the name of the log level used by types.Logger, levels in between are rounded down
+func levelName(level slog.Level) string {
+	switch {
+	case level < slog.LevelInfo:
+		return "debug"
+	case level < slog.LevelWarn:
+		return "info"
+	case level < slog.LevelError:
+		return "warn"
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,61 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+
+	tmpFile, err := os.CreateTemp(".", "logtest")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer func() {
+		err := os.Remove(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("Failed to remove temp file: %v", err)
+		}
+	}()
+	defer func() {
+		err := tmpFile.Close()
+		if err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+	}()
+
+	l, err := NewLogger(tmpFile, "json", LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	lib := slog.New(NewHandler(l)).With("component", "yace")
+	lib.Debug("filtered by the level of the logger")
+	lib.WithGroup("job").Warn("test message", "region", "eu-west-1")
+
+	_, err = tmpFile.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("Failed to seek temp file: %v", err)
+	}
+	entries := []map[string]any{}
+	scanner := bufio.NewScanner(tmpFile)
+	for scanner.Scan() {
+		entry := map[string]any{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("Expected JSON format, got '%s'", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry["level"] != "WARN" || entry["msg"] != "test message" || entry["component"] != "yace" || entry["job.region"] != "eu-west-1" {
+		t.Fatalf("Unexpected log entry: %v", entry)
+	}
+}
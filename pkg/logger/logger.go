@@ -2,51 +2,171 @@
 package logger
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"os"
+	"strings"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
 )
 
+// Components that can be given their own log level
+var components = []string{types.ComponentCollector, types.ComponentFilter, types.ComponentConverter, types.ComponentProcessor, types.ComponentPersister}
+
 type SlogLogger struct {
-	Logger         *slog.Logger // slog logger instance
-	LogFormat      string       // Format of the log output (json or text)
-	LogDestination *os.File     // Destination of the log output
-	LogLevel       string       // Logging level (debug, info, warn, error)
+	Logger         *slog.Logger           // slog logger instance
+	LogFormat      string                 // Format of the log output (json or text)
+	LogDestination *os.File               // Destination of the log output
+	LogLevel       string                 // Logging level (debug, info, warn, error)
+	Redactor       *Redactor              // Masks secrets in log records and errors
+	components     map[string]*SlogLogger // Loggers of the components with their own level
+}
+
+// LoggerOpts contains the logger options. They are given as strings to allow them to be passed directly from environment variables.
+type LoggerOpts struct {
+	Level           string // Logging level (debug, info, warn, error), defaults to info
+	ComponentLevels string // Logging levels of components as comma separated component=level pairs, e.g. "collector=debug,persister=warn"
+	Attributes      string // Attributes added to every record as comma separated key=value pairs, e.g. "function=yac-p,account_id=123456789012"
+	RedactPattern   string // Regular expression of additional text to mask in log records and errors (optional)
 }
 
-// Init initializes the logger and determines the log level
-func NewLogger(LogDestination *os.File, LogFormat string, Debug bool) (*SlogLogger, error) {
+// NewLogger creates a logger writing in the given format to the given destination, stdout if nil
+func NewLogger(LogDestination *os.File, LogFormat string, opts LoggerOpts) (*SlogLogger, error) {
 
-	logger := &SlogLogger{}
-	logOpts := &slog.HandlerOptions{}
-	if Debug {
-		logOpts.Level = slog.LevelDebug
-	} else {
-		logOpts.Level = slog.LevelInfo
+	if LogFormat != "" {
+		if LogFormat != "json" && LogFormat != "JSON" && LogFormat != "text" && LogFormat != "TEXT" {
+			return nil, fmt.Errorf("invalid log format: %s", LogFormat)
+		}
 	}
 
-	var destination *os.File
-	if LogDestination != nil {
-		destination = LogDestination
-	} else {
+	destination := LogDestination
+	if destination == nil {
 		destination = os.Stdout
 	}
 
-	if LogFormat != "" {
-		if LogFormat != "json" && LogFormat != "JSON" && LogFormat != "text" && LogFormat != "TEXT" {
-			return nil, fmt.Errorf("invalid log format: %s", LogFormat)
+	attributes, err := parsePairs(opts.Attributes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log attributes: %w", err)
+	}
+	attrs := make([]any, 0, len(attributes))
+	for _, attr := range attributes {
+		attrs = append(attrs, slog.String(attr[0], attr[1]))
+	}
+
+	redactor, err := NewRedactor(opts.RedactPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	newLogger := func(level string) (*SlogLogger, error) {
+		if level == "" {
+			level = "info"
 		}
+		slogLevel, err := parseLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		logOpts := &slog.HandlerOptions{Level: slogLevel}
+		var handler slog.Handler
+		if LogFormat == "json" || LogFormat == "JSON" {
+			handler = slog.NewJSONHandler(destination, logOpts)
+		} else {
+			handler = slog.NewTextHandler(destination, logOpts)
+		}
+		handler = &redactingHandler{next: handler, redactor: redactor}
+		return &SlogLogger{
+			Logger:         slog.New(handler).With(attrs...),
+			LogFormat:      LogFormat,
+			LogDestination: destination,
+			LogLevel:       strings.ToLower(level),
+			Redactor:       redactor,
+		}, nil
+	}
+
+	logger, err := newLogger(opts.Level)
+	if err != nil {
+		return nil, err
 	}
 
-	if LogFormat == "json" || LogFormat == "JSON" {
-		logger.Logger = slog.New(slog.NewJSONHandler(destination, logOpts))
-	} else {
-		logger.Logger = slog.New(slog.NewTextHandler(destination, logOpts))
+	componentLevels, err := parsePairs(opts.ComponentLevels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid component log levels: %w", err)
+	}
+	for _, pair := range componentLevels {
+		component, level := pair[0], pair[1]
+		known := false
+		for _, name := range components {
+			known = known || name == component
+		}
+		if !known {
+			return nil, fmt.Errorf("invalid log component: %s, expected one of %s", component, strings.Join(components, ", "))
+		}
+		if logger.components == nil {
+			logger.components = map[string]*SlogLogger{}
+		}
+		logger.components[component], err = newLogger(level)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log level for %s: %w", component, err)
+		}
 	}
 	return logger, nil
 }
 
-// Log accepts generic log entry components uses the slog package to log messages
+// parseLevel returns the slog level of a level name
+func parseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level: %s", level)
+}
+
+// parsePairs parses comma separated key=value pairs, keeping their order
+func parsePairs(value string) ([][2]string, error) {
+	pairs := [][2]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, val, found := strings.Cut(pair, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected key=value", pair)
+		}
+		pairs = append(pairs, [2]string{key, val})
+	}
+	return pairs, nil
+}
+
+// Component returns the logger of a component, which is the logger itself unless the component has its own level
+func (l *SlogLogger) Component(name string) types.Logger {
+	if component, ok := l.components[name]; ok {
+		return component
+	}
+	return l
+}
+
+// With returns a child logger adding the given attributes to every record, including those of the component loggers
+func (l *SlogLogger) With(args ...any) *SlogLogger {
+	child := *l
+	child.Logger = l.Logger.With(args...)
+	if l.components != nil {
+		child.components = make(map[string]*SlogLogger, len(l.components))
+		for name, component := range l.components {
+			child.components[name] = component.With(args...)
+		}
+	}
+	return &child
+}
+
+// Log accepts generic log entry components uses the slog package to log messages. Entries with an unknown level are logged at info with the level name added.
 func (l *SlogLogger) Log(level string, msg string, args ...any) {
 	switch level {
 	case "debug":
@@ -58,6 +178,19 @@ func (l *SlogLogger) Log(level string, msg string, args ...any) {
 	case "error":
 		l.Logger.Error(msg, args...)
 	default:
-		l.Logger.Info(msg, args...)
+		l.Logger.Info(msg, append(args, slog.String("unknown_level", level))...)
+	}
+}
+
+// Enabled reports whether the logger logs at the given level
+func (l *SlogLogger) Enabled(ctx context.Context, level slog.Level) bool {
+	return l.Logger.Enabled(ctx, level)
+}
+
+// RedactError returns the error with secrets masked in its message
+func (l *SlogLogger) RedactError(err error) error {
+	if l.Redactor == nil {
+		return err
 	}
+	return l.Redactor.RedactError(err)
 }
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"bufio"
 	"encoding/json"
 	"io"
 	"os"
@@ -17,7 +18,7 @@ type TestLogEntry struct {
 
 func TestLogLevel(t *testing.T) {
 
-	l, err := NewLogger(os.Stdout, "json", false)
+	l, err := NewLogger(os.Stdout, "json", LoggerOpts{})
 	if err != nil {
 		t.Fatalf("Failed to create logger: %v", err)
 	}
@@ -61,7 +62,7 @@ func TestLogFormat(t *testing.T) {
 		t.Fatalf("Failed to create temp file: %v", err)
 	}
 
-	l, err := NewLogger(tmpFile, "json", false)
+	l, err := NewLogger(tmpFile, "json", LoggerOpts{})
 	if err != nil {
 		t.Fatalf("Failed to create logger: %v", err)
 	}
@@ -98,8 +99,130 @@ func TestLogFormat(t *testing.T) {
 
 func TestLogFormatInit(t *testing.T) {
 
-	_, err := NewLogger(os.Stdout, "wrongformat", false)
+	_, err := NewLogger(os.Stdout, "wrongformat", LoggerOpts{})
 	if err == nil {
 		t.Fatalf("Expected error for invalid log format, got nil")
 	}
 }
+
+func TestLogLevelInit(t *testing.T) {
+
+	tests := []LoggerOpts{
+		{Level: "verbose"},
+		{ComponentLevels: "collector=trace"},
+		{ComponentLevels: "exporter=debug"},
+		{ComponentLevels: "collector"},
+		{Attributes: "=yac-p"},
+	}
+	for _, test := range tests {
+		_, err := NewLogger(os.Stdout, "text", test)
+		if err == nil {
+			t.Fatalf("Expected error for %+v, got nil", test)
+		}
+	}
+}
+
+func TestComponentLevels(t *testing.T) {
+
+	tmpFile, err := os.CreateTemp(".", "logtest")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer func() {
+		err := os.Remove(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("Failed to remove temp file: %v", err)
+		}
+	}()
+	defer func() {
+		err := tmpFile.Close()
+		if err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+	}()
+
+	l, err := NewLogger(tmpFile, "json", LoggerOpts{
+		Level:           "WARN",
+		ComponentLevels: "collector=debug",
+		Attributes:      "function=yac-p,account_id=123456789012",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+
+	l.Log("info", "filtered by the level of the logger")
+	l.Component("converter").Log("info", "filtered by the level of the logger")
+	l.Component("collector").Log("debug", "test message", "key1", "value1")
+
+	_, err = tmpFile.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("Failed to seek temp file: %v", err)
+	}
+	entries := []map[string]any{}
+	scanner := bufio.NewScanner(tmpFile)
+	for scanner.Scan() {
+		entry := map[string]any{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("Expected JSON format, got '%s'", scanner.Text())
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 log entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry["level"] != "DEBUG" || entry["key1"] != "value1" || entry["function"] != "yac-p" || entry["account_id"] != "123456789012" {
+		t.Fatalf("Unexpected log entry: %v", entry)
+	}
+}
+
+func TestChildLogger(t *testing.T) {
+
+	tmpFile, err := os.CreateTemp(".", "logtest")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer func() {
+		err := os.Remove(tmpFile.Name())
+		if err != nil {
+			t.Fatalf("Failed to remove temp file: %v", err)
+		}
+	}()
+	defer func() {
+		err := tmpFile.Close()
+		if err != nil {
+			t.Fatalf("Failed to close temp file: %v", err)
+		}
+	}()
+
+	l, err := NewLogger(tmpFile, "json", LoggerOpts{ComponentLevels: "persister=debug"})
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	child := l.With("run_id", "abc123")
+	child.Log("info", "test message")
+	child.Component("persister").Log("debug", "test message")
+	l.Log("info", "test message")
+
+	_, err = tmpFile.Seek(0, 0)
+	if err != nil {
+		t.Fatalf("Failed to seek temp file: %v", err)
+	}
+	runIDs := []any{}
+	scanner := bufio.NewScanner(tmpFile)
+	for scanner.Scan() {
+		entry := map[string]any{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			t.Fatalf("Expected JSON format, got '%s'", scanner.Text())
+		}
+		runIDs = append(runIDs, entry["run_id"])
+	}
+
+	// The parent logger is left unchanged
+	if len(runIDs) != 3 || runIDs[0] != "abc123" || runIDs[1] != "abc123" || runIDs[2] != nil {
+		t.Fatalf("Expected the run ID on the records of the child logger only, got %v", runIDs)
+	}
+}
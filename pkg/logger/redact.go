@@ -0,0 +1,207 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const Redacted = "REDACTED" // Replacement for masked values
+
+// minSecretLength is the length below which secret values are not masked, as short values would mask unrelated text
+const minSecretLength = 4
+
+// secretKeys are attribute names whose values are always masked, matched as the whole name or as a suffix after an underscore, e.g. auth_token
+var secretKeys = []string{"password", "passwd", "secret", "token", "authorization", "api_key", "apikey", "credentials", "private_key", "secret_access_key"}
+
+// urlPattern matches URLs in free text, ending at whitespace or quotes
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.\-]*://[^\s"'<>]+`)
+
+// Redactor masks secrets in log records and errors: values of secret attributes, the userinfo and query parameter values of URLs, known secret values and text matching a configured pattern
+type Redactor struct {
+	Pattern *regexp.Regexp // Additional text to mask, only the submatches are masked if the pattern has groups (optional)
+	secrets []string       // Secret values to mask wherever they appear
+	mu      sync.RWMutex   // Guards secrets
+}
+
+// NewRedactor creates a redactor masking text matching the given regular expression in addition to the built-in rules
+func NewRedactor(pattern string) (*Redactor, error) {
+	r := &Redactor{}
+	if pattern != "" {
+		var err error
+		r.Pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redact pattern: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// AddSecrets adds secret values, such as passwords and tokens, to mask wherever they appear. Values shorter than 4 characters are ignored.
+func (r *Redactor) AddSecrets(secrets ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+}
+
+// Redact returns the text with secrets masked
+func (r *Redactor) Redact(text string) string {
+	r.mu.RLock()
+	for _, secret := range r.secrets {
+		text = strings.ReplaceAll(text, secret, Redacted)
+	}
+	r.mu.RUnlock()
+
+	if r.Pattern != nil {
+		text = redactPattern(r.Pattern, text)
+	}
+	return urlPattern.ReplaceAllStringFunc(text, redactURL)
+}
+
+// RedactError returns an error with the secrets masked in its message. The original error is still available to errors.Is and errors.As.
+func (r *Redactor) RedactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := r.Redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+	return &redactedError{msg: msg, err: err}
+}
+
+// redactPattern masks the matches of the pattern in the text, or only the submatches if the pattern has groups
+func redactPattern(pattern *regexp.Regexp, text string) string {
+	var b strings.Builder
+	last := 0
+	for _, match := range pattern.FindAllStringSubmatchIndex(text, -1) {
+		spans := match[:2]
+		if pattern.NumSubexp() > 0 {
+			spans = match[2:]
+		}
+		for i := 0; i+1 < len(spans); i += 2 {
+			start, end := spans[i], spans[i+1]
+			if start < last || end <= start { // Unmatched or nested group
+				continue
+			}
+			b.WriteString(text[last:start])
+			b.WriteString(Redacted)
+			last = end
+		}
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// redactURL masks the userinfo and query parameter values of a URL, the URL is returned unchanged if it can't be parsed
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.User == nil && u.RawQuery == "") {
+		return rawURL
+	}
+	if u.User != nil {
+		u.User = url.User(Redacted)
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{Redacted}
+		}
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// isSecretKey reports whether an attribute name is that of a secret, ignoring group prefixes
+func isSecretKey(key string) bool {
+	key = strings.ToLower(strings.ReplaceAll(key, "-", "_"))
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		key = key[i+1:]
+	}
+	for _, secret := range secretKeys {
+		if key == secret || strings.HasSuffix(key, "_"+secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAttr masks the value of a secret attribute, and the secrets in the text of other attributes
+func (r *Redactor) redactAttr(attr slog.Attr) slog.Attr {
+	if isSecretKey(attr.Key) {
+		return slog.String(attr.Key, Redacted)
+	}
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, r.Redact(value.String()))
+	case slog.KindGroup:
+		group := value.Group()
+		attrs := make([]slog.Attr, 0, len(group))
+		for _, a := range group {
+			attrs = append(attrs, r.redactAttr(a))
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(attrs...)}
+	case slog.KindAny:
+		switch v := value.Any().(type) {
+		case error:
+			return slog.String(attr.Key, r.Redact(v.Error()))
+		case fmt.Stringer:
+			return slog.String(attr.Key, r.Redact(v.String()))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// redactedError is an error with the secrets masked in its message
+type redactedError struct {
+	msg string // Masked error message
+	err error  // Original error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactingHandler is a slog.Handler masking secrets in the message and attributes of records before passing them on
+type redactingHandler struct {
+	next     slog.Handler
+	redactor *Redactor
+}
+
+func (h *redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, h.redactor.Redact(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redactor.redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, h.redactor.redactAttr(attr))
+	}
+	return &redactingHandler{next: h.next.WithAttrs(redacted), redactor: h.redactor}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{next: h.next.WithGroup(name), redactor: h.redactor}
+}
@@ -0,0 +1,206 @@
+// Package fanout provides a persister that writes metrics to multiple persisters concurrently, e.g. to several remote write endpoints. It implements the types.MetricPersister interface.
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	PolicyAll        = "ALL"         // Every target must succeed
+	PolicyAny        = "ANY"         // At least one target must succeed
+	PolicyBestEffort = "BEST_EFFORT" // Failures are logged but never returned
+)
+
+// Target is a named persister that metrics are written to
+type Target struct {
+	Name      string                // Name of the target, used in logs and errors
+	Persister types.MetricPersister // Persister writing to the target
+}
+
+type FanoutPersister struct {
+	Targets []Target // Targets to write to
+	Policy  string   // Policy deciding when the write as a whole has failed (ALL, ANY, BEST_EFFORT), defaults to ALL
+}
+
+func NewFanoutPersister(targets []Target, policy string) (*FanoutPersister, error) {
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("at least one target must be set")
+	}
+
+	names := map[string]bool{}
+	for _, target := range targets {
+		if target.Persister == nil {
+			return nil, fmt.Errorf("persister must be set for target %s", target.Name)
+		}
+		if names[target.Name] {
+			return nil, fmt.Errorf("duplicate target name: %s", target.Name)
+		}
+		names[target.Name] = true
+	}
+
+	switch policy {
+	case "":
+		policy = PolicyAll
+	case PolicyAll, PolicyAny, PolicyBestEffort:
+	default:
+		return nil, fmt.Errorf("invalid fan-out policy: %s", policy)
+	}
+
+	return &FanoutPersister{
+		Targets: targets,
+		Policy:  policy,
+	}, nil
+}
+
+// PersistMetrics sends the time series to all targets concurrently and applies the policy to the results
+func (f *FanoutPersister) PersistMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) error {
+	return f.PersistMetricsContext(context.Background(), timeSeries, logger)
+}
+
+// PersistMetricsContext is like PersistMetrics but passes the context on to the targets that support it
+func (f *FanoutPersister) PersistMetricsContext(ctx context.Context, timeSeries []prompb.TimeSeries, logger types.Logger) error {
+	return f.fanout(logger, func(target Target) error {
+		if persister, ok := target.Persister.(types.ContextMetricPersister); ok {
+			return persister.PersistMetricsContext(ctx, timeSeries, logger)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return target.Persister.PersistMetrics(timeSeries, logger)
+	})
+}
+
+// PersistMetricsStream is like PersistMetricsContext but hands each chunk of time series to all targets as it arrives. Targets without streaming support collect all chunks before sending.
+// Chunks are passed on in step, so a slow target holds back the others by at most one chunk.
+func (f *FanoutPersister) PersistMetricsStream(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], logger types.Logger) error {
+	return f.PersistMetricsWithMetadata(ctx, chunks, nil, logger)
+}
+
+// PersistMetricsWithMetadata is like PersistMetricsStream but also hands the metric metadata (optional) to the targets that support it
+func (f *FanoutPersister) PersistMetricsWithMetadata(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], metadata *types.MetricMetadata, logger types.Logger) error {
+
+	feeds := make(map[string]chan []prompb.TimeSeries, len(f.Targets))
+	for _, target := range f.Targets {
+		feeds[target.Name] = make(chan []prompb.TimeSeries)
+	}
+	var streamErr error
+	go func() {
+		defer func() {
+			for _, feed := range feeds {
+				close(feed)
+			}
+		}()
+		for chunk, err := range chunks {
+			if err != nil {
+				streamErr = err
+				return
+			}
+			for _, feed := range feeds {
+				feed <- chunk
+			}
+		}
+	}()
+
+	err := f.fanout(logger, func(target Target) error {
+		feed := feeds[target.Name]
+		defer func() {
+			for range feed { // Keep receiving after the target stops, so the other targets get the remaining chunks
+			}
+		}()
+
+		received := func(yield func([]prompb.TimeSeries, error) bool) {
+			for chunk := range feed {
+				if !yield(chunk, nil) {
+					return
+				}
+			}
+		}
+		if persister, ok := target.Persister.(types.MetadataPersister); ok {
+			return persister.PersistMetricsWithMetadata(ctx, received, metadata, logger)
+		}
+		if persister, ok := target.Persister.(types.StreamMetricPersister); ok {
+			return persister.PersistMetricsStream(ctx, received, logger)
+		}
+		timeSeries := []prompb.TimeSeries{}
+		for chunk := range feed {
+			timeSeries = append(timeSeries, chunk...)
+		}
+		if persister, ok := target.Persister.(types.ContextMetricPersister); ok {
+			return persister.PersistMetricsContext(ctx, timeSeries, logger)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return target.Persister.PersistMetrics(timeSeries, logger)
+	})
+	if streamErr != nil {
+		return streamErr // The targets only got the chunks produced before the error
+	}
+	return err
+}
+
+// Secrets returns the secrets of all targets, so they can be masked in logs and errors
+func (f *FanoutPersister) Secrets() []string {
+	secrets := []string{}
+	for _, target := range f.Targets {
+		if holder, ok := target.Persister.(types.SecretHolder); ok {
+			secrets = append(secrets, holder.Secrets()...)
+		}
+	}
+	return secrets
+}
+
+// fanout runs the write function for all targets concurrently, logs the result of each target and applies the policy
+func (f *FanoutPersister) fanout(logger types.Logger, write func(Target) error) error {
+
+	errs := make([]error, len(f.Targets))
+	wg := sync.WaitGroup{}
+	for i, target := range f.Targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := write(target)
+			if err != nil {
+				logger.Log("error", "Failed to write to target", slog.String("target", target.Name), slog.Duration("duration", time.Since(start)), slog.String("error", err.Error()))
+				errs[i] = fmt.Errorf("target %s: %w", target.Name, err)
+				return
+			}
+			logger.Log("info", "Wrote to target", slog.String("target", target.Name), slog.Duration("duration", time.Since(start)))
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	logger.Log("debug", "Fan-out finished", slog.String("policy", f.Policy), slog.Int("targets", len(f.Targets)), slog.Int("failed", failed))
+	if failed == 0 {
+		return nil
+	}
+
+	switch f.Policy {
+	case PolicyAny:
+		if failed < len(f.Targets) {
+			logger.Log("warn", "Some targets failed, at least one target succeeded", slog.Int("failed", failed), slog.Int("targets", len(f.Targets)))
+			return nil
+		}
+	case PolicyBestEffort:
+		logger.Log("warn", "Some targets failed, ignored by best effort policy", slog.Int("failed", failed), slog.Int("targets", len(f.Targets)))
+		return nil
+	}
+	return fmt.Errorf("failed to write to %d of %d targets: %w", failed, len(f.Targets), errors.Join(errs...))
+}
@@ -0,0 +1,279 @@
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type testPersister struct {
+	fail      bool
+	persisted atomic.Int64
+}
+
+func (p *testPersister) PersistMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) error {
+	if p.fail {
+		return fmt.Errorf("endpoint unavailable")
+	}
+	p.persisted.Add(int64(len(timeSeries)))
+	return nil
+}
+
+// testMetadataPersister records the metadata it is given along with the time series
+type testMetadataPersister struct {
+	testPersister
+	metadata *types.MetricMetadata
+}
+
+func (p *testMetadataPersister) PersistMetricsWithMetadata(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], metadata *types.MetricMetadata, logger types.Logger) error {
+	p.metadata = metadata
+	for chunk, err := range chunks {
+		if err != nil {
+			return err
+		}
+		p.persisted.Add(int64(len(chunk)))
+	}
+	return nil
+}
+
+func createTestTimeSeries() []prompb.TimeSeries {
+	return []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "test_gauge"},
+				{Name: "label1", Value: "value1"},
+			},
+			Samples: []prompb.Sample{
+				{Value: 1.0, Timestamp: 1234567890},
+			},
+		},
+	}
+}
+
+func TestFanoutOptions(t *testing.T) {
+
+	_, err := NewFanoutPersister([]Target{}, "")
+	if err == nil {
+		t.Fatalf("Expected error for no targets, got nil")
+	}
+
+	_, err = NewFanoutPersister([]Target{{Name: "a", Persister: &testPersister{}}, {Name: "a", Persister: &testPersister{}}}, "")
+	if err == nil {
+		t.Fatalf("Expected error for duplicate target names, got nil")
+	}
+
+	_, err = NewFanoutPersister([]Target{{Name: "a", Persister: &testPersister{}}}, "SOME")
+	if err == nil {
+		t.Fatalf("Expected error for invalid policy, got nil")
+	}
+
+	f, err := NewFanoutPersister([]Target{{Name: "a", Persister: &testPersister{}}}, "")
+	if err != nil {
+		t.Fatalf("Failed to create fan-out persister: %v", err)
+	}
+	if f.Policy != PolicyAll {
+		t.Fatalf("Expected default policy %s, got %s", PolicyAll, f.Policy)
+	}
+}
+
+func TestFanoutPolicies(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	tests := []struct {
+		policy      string
+		failing     []bool
+		expectError bool
+	}{
+		{PolicyAll, []bool{false, false}, false},
+		{PolicyAll, []bool{false, true}, true},
+		{PolicyAny, []bool{false, true}, false},
+		{PolicyAny, []bool{true, true}, true},
+		{PolicyBestEffort, []bool{true, true}, false},
+	}
+
+	for _, test := range tests {
+		targets := []Target{}
+		persisters := []*testPersister{}
+		for i, fail := range test.failing {
+			p := &testPersister{fail: fail}
+			persisters = append(persisters, p)
+			targets = append(targets, Target{Name: fmt.Sprintf("target-%d", i), Persister: p})
+		}
+
+		f, err := NewFanoutPersister(targets, test.policy)
+		if err != nil {
+			t.Fatalf("Failed to create fan-out persister: %v", err)
+		}
+
+		err = f.PersistMetrics(createTestTimeSeries(), logger)
+		if test.expectError && err == nil {
+			t.Fatalf("Expected error for policy %s with failing targets %v, got nil", test.policy, test.failing)
+		}
+		if !test.expectError && err != nil {
+			t.Fatalf("Expected no error for policy %s with failing targets %v, got %v", test.policy, test.failing, err)
+		}
+		for i, p := range persisters {
+			if !test.failing[i] && p.persisted.Load() != 1 {
+				t.Fatalf("Expected target %d to receive 1 series, got %d", i, p.persisted.Load())
+			}
+		}
+	}
+}
+
+func TestFanoutMetadata(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	a, b, c := &testMetadataPersister{}, &testMetadataPersister{}, &testPersister{}
+	f, err := NewFanoutPersister([]Target{{Name: "a", Persister: a}, {Name: "b", Persister: b}, {Name: "c", Persister: c}}, PolicyAll)
+	if err != nil {
+		t.Fatalf("Failed to create fan-out persister: %v", err)
+	}
+
+	// Targets without metadata support only get the time series
+	metadata := &types.MetricMetadata{Families: []prompb.MetricMetadata{{MetricFamilyName: "test_gauge"}}}
+	err = f.PersistMetricsWithMetadata(context.Background(), func(yield func([]prompb.TimeSeries, error) bool) {
+		yield(createTestTimeSeries(), nil)
+	}, metadata, logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if a.metadata != metadata || b.metadata != metadata {
+		t.Fatalf("Expected metadata to be handed to all targets")
+	}
+	if a.persisted.Load() != 1 || b.persisted.Load() != 1 || c.persisted.Load() != 1 {
+		t.Fatalf("Expected the time series to be sent to all targets")
+	}
+}
+
+type testContextPersister struct {
+	testPersister
+	ctx context.Context
+}
+
+func (p *testContextPersister) PersistMetricsContext(ctx context.Context, timeSeries []prompb.TimeSeries, logger types.Logger) error {
+	p.ctx = ctx
+	return p.PersistMetrics(timeSeries, logger)
+}
+
+func TestFanoutContext(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	withContext := &testContextPersister{}
+	withoutContext := &testPersister{}
+	f, err := NewFanoutPersister([]Target{{Name: "a", Persister: withContext}, {Name: "b", Persister: withoutContext}}, PolicyAll)
+	if err != nil {
+		t.Fatalf("Failed to create fan-out persister: %v", err)
+	}
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+	err = f.PersistMetricsContext(ctx, createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if withContext.ctx == nil || withContext.ctx.Value(ctxKey{}) != "value" {
+		t.Fatalf("Expected context to be passed to the target")
+	}
+	if withoutContext.persisted.Load() != 1 {
+		t.Fatalf("Expected target without context support to be persisted to")
+	}
+
+	// Targets without context support are skipped once the context is cancelled
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = f.PersistMetricsContext(cancelled, createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for cancelled context, got nil")
+	}
+	if withoutContext.persisted.Load() != 1 {
+		t.Fatalf("Expected target without context support to be skipped, got %d series", withoutContext.persisted.Load())
+	}
+}
+
+type testStreamPersister struct {
+	testPersister
+	chunks    atomic.Int64
+	stopAfter int64
+}
+
+func (p *testStreamPersister) PersistMetricsStream(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], logger types.Logger) error {
+	for chunk, err := range chunks {
+		if err != nil {
+			return err
+		}
+		p.persisted.Add(int64(len(chunk)))
+		if p.chunks.Add(1) == p.stopAfter {
+			return fmt.Errorf("endpoint unavailable")
+		}
+	}
+	return nil
+}
+
+func TestFanoutStream(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	streaming := &testStreamPersister{}
+	stopping := &testStreamPersister{stopAfter: 1}
+	collecting := &testPersister{}
+	f, err := NewFanoutPersister([]Target{{Name: "a", Persister: streaming}, {Name: "b", Persister: stopping}, {Name: "c", Persister: collecting}}, PolicyAny)
+	if err != nil {
+		t.Fatalf("Failed to create fan-out persister: %v", err)
+	}
+
+	chunks := func(yield func([]prompb.TimeSeries, error) bool) {
+		for range 3 {
+			if !yield(createTestTimeSeries(), nil) {
+				return
+			}
+		}
+	}
+	err = f.PersistMetricsStream(context.Background(), chunks, logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	// A target that stops early doesn't hold back the others
+	if streaming.chunks.Load() != 3 || streaming.persisted.Load() != 3 {
+		t.Fatalf("Expected 3 chunks to be streamed to target a, got %d", streaming.chunks.Load())
+	}
+	if stopping.chunks.Load() != 1 {
+		t.Fatalf("Expected target b to stop after 1 chunk, got %d", stopping.chunks.Load())
+	}
+	if collecting.persisted.Load() != 3 {
+		t.Fatalf("Expected target without streaming support to get all 3 series, got %d", collecting.persisted.Load())
+	}
+
+	streamErr := fmt.Errorf("conversion failed")
+	failing := func(yield func([]prompb.TimeSeries, error) bool) {
+		if yield(createTestTimeSeries(), nil) {
+			yield(nil, streamErr)
+		}
+	}
+	err = f.PersistMetricsStream(context.Background(), failing, logger)
+	if !errors.Is(err, streamErr) {
+		t.Fatalf("Expected the conversion error, got %v", err)
+	}
+}
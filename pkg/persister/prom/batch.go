@@ -0,0 +1,163 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	DefaultMaxSeriesPerRequest = 2000    // Default maximum number of time series per remote write request
+	DefaultMaxBytesPerRequest  = 1000000 // Default maximum compressed request size, matches the Amazon Managed Prometheus request size limit
+)
+
+// batch is a set of time series sent in a single remote write request
+type batch struct {
+	timeSeries []prompb.TimeSeries // Time series in the batch
+	encoded    []byte              // Snappy encoded remote write request
+}
+
+// BatchFailure describes a batch that could not be sent
+type BatchFailure struct {
+	Index  int   // Index of the batch
+	Series int   // Number of time series in the batch
+	Err    error // Error returned when sending the batch
+}
+
+// BatchError is returned when one or more batches could not be sent to the remote write endpoint
+type BatchError struct {
+	Total    int            // Total number of batches
+	Failures []BatchFailure // Failed batches, ordered by index
+}
+
+func (e *BatchError) Error() string {
+	msgs := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		msgs = append(msgs, fmt.Sprintf("batch %d (%d series): %v", f.Index, f.Series, f.Err))
+	}
+	return fmt.Sprintf("failed to send %d of %d batches: %s", len(e.Failures), e.Total, strings.Join(msgs, "; "))
+}
+
+// Unwrap returns the errors of all failed batches
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		errs = append(errs, f.Err)
+	}
+	return errs
+}
+
+// encode marshals time series into a remote write request of the configured protocol version, with the metadata of their families if sent with the series, and snappy encodes it
+func (p *PromClient) encode(timeSeries []prompb.TimeSeries, metadata *types.MetricMetadata) ([]byte, error) {
+	if p.protocol() == ProtocolV2 {
+		return p.encodeWriteRequestV2(timeSeries, metadata)
+	}
+	return p.encodeWriteRequest(timeSeries, metadata)
+}
+
+// encodeWriteRequest marshals time series into a remote write 1.0 request, with the metadata of their families if metadata is sent with the series, and snappy encodes it
+func (p *PromClient) encodeWriteRequest(timeSeries []prompb.TimeSeries, metadata *types.MetricMetadata) ([]byte, error) {
+	r := &prompb.WriteRequest{
+		Timeseries: timeSeries,
+		Metadata:   p.batchMetadata(timeSeries, metadata),
+	}
+	tsProto, err := r.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, tsProto), nil
+}
+
+// splitBatches splits time series into batches bounded by the number of series and the compressed request size. The metadata (optional) is encoded along with the series, depending on the metadata mode.
+func (p *PromClient) splitBatches(timeSeries []prompb.TimeSeries, metadata *types.MetricMetadata, logger types.Logger) ([]batch, error) {
+
+	maxSeries := p.MaxSeriesPerRequest
+	if maxSeries <= 0 {
+		maxSeries = DefaultMaxSeriesPerRequest
+	}
+	maxBytes := p.MaxBytesPerRequest
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxBytesPerRequest
+	}
+
+	batches := []batch{}
+	for start := 0; start < len(timeSeries); start += maxSeries {
+		end := min(start+maxSeries, len(timeSeries))
+		split, err := p.splitBySize(timeSeries[start:end], metadata, maxBytes, logger)
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, split...)
+	}
+	logger.Log("debug", "Split timeseries into batches", slog.Int("batch_count", len(batches)), slog.Int("max_series", maxSeries), slog.Int("max_bytes", maxBytes))
+	return batches, nil
+}
+
+// splitBySize encodes the time series and halves the batch until every encoded request fits within maxBytes
+func (p *PromClient) splitBySize(timeSeries []prompb.TimeSeries, metadata *types.MetricMetadata, maxBytes int, logger types.Logger) ([]batch, error) {
+	encoded, err := p.encode(timeSeries, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) <= maxBytes {
+		return []batch{{timeSeries: timeSeries, encoded: encoded}}, nil
+	}
+	if len(timeSeries) == 1 {
+		// A single series can't be split any further, send it and let the endpoint decide
+		logger.Log("warn", "Single time series exceeds max request size", slog.Int("body_size", len(encoded)), slog.Int("max_bytes", maxBytes))
+		return []batch{{timeSeries: timeSeries, encoded: encoded}}, nil
+	}
+
+	mid := len(timeSeries) / 2
+	left, err := p.splitBySize(timeSeries[:mid], metadata, maxBytes, logger)
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.splitBySize(timeSeries[mid:], metadata, maxBytes, logger)
+	if err != nil {
+		return nil, err
+	}
+	return append(left, right...), nil
+}
+
+// sendBatches sends the batches to the remote write endpoint, in parallel if RequestConcurrency is above 1, and reports the batches that failed
+func (p *PromClient) sendBatches(ctx context.Context, batches []batch, logger types.Logger) error {
+
+	concurrency := p.RequestConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	errs := make([]error, len(batches))
+	semaphore := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for i, b := range batches {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			logger.Log("debug", "Sending batch", slog.Int("batch", i), slog.Int("timeseries_count", len(b.timeSeries)))
+			errs[i] = p.sendRequestWithRetry(ctx, b, logger)
+		}()
+	}
+	wg.Wait()
+
+	batchErr := &BatchError{Total: len(batches)}
+	for i, err := range errs {
+		if err != nil {
+			logger.Log("error", "Failed to send batch", slog.Int("batch", i), slog.Int("timeseries_count", len(batches[i].timeSeries)), slog.String("error", err.Error()))
+			batchErr.Failures = append(batchErr.Failures, BatchFailure{Index: i, Series: len(batches[i].timeSeries), Err: err})
+		}
+	}
+	if len(batchErr.Failures) > 0 {
+		return batchErr
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package prom
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func createManyTestTimeSeries(count int) []prompb.TimeSeries {
+	timeSeries := []prompb.TimeSeries{}
+	for i := 0; i < count; i++ {
+		timeSeries = append(timeSeries, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "test_gauge"},
+				{Name: "instance", Value: fmt.Sprintf("i-%08d", i)},
+				{Name: "padding", Value: strings.Repeat(fmt.Sprintf("%d", i), 20)},
+			},
+			Samples: []prompb.Sample{
+				{Value: float64(i), Timestamp: 1234567890},
+			},
+		})
+	}
+	return timeSeries
+}
+
+func decodeWriteRequest(r *http.Request) (*prompb.WriteRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	req := &prompb.WriteRequest{}
+	err = req.Unmarshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func TestBatchOptions(t *testing.T) {
+
+	p, err := NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{
+		MaxSeriesPerRequest: "100",
+		MaxBytesPerRequest:  "5000",
+		RequestConcurrency:  "4",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if p.MaxSeriesPerRequest != 100 || p.MaxBytesPerRequest != 5000 || p.RequestConcurrency != 4 {
+		t.Fatalf("Batch options not set, got %d, %d, %d", p.MaxSeriesPerRequest, p.MaxBytesPerRequest, p.RequestConcurrency)
+	}
+
+	_, err = NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{
+		MaxSeriesPerRequest: "many",
+	})
+	if err == nil {
+		t.Fatalf("Expected error for invalid max series per request, got nil")
+	}
+}
+
+func TestSplitBatches(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		MaxSeriesPerRequest: 10,
+	}
+	batches, err := p.splitBatches(createManyTestTimeSeries(95), nil, logger)
+	if err != nil {
+		t.Fatalf("Failed to split batches: %v", err)
+	}
+	if len(batches) != 10 {
+		t.Fatalf("Expected 10 batches, got %d", len(batches))
+	}
+	if len(batches[9].timeSeries) != 5 {
+		t.Fatalf("Expected 5 series in last batch, got %d", len(batches[9].timeSeries))
+	}
+
+	p = &PromClient{
+		MaxSeriesPerRequest: 1000,
+		MaxBytesPerRequest:  1024,
+	}
+	batches, err = p.splitBatches(createManyTestTimeSeries(500), nil, logger)
+	if err != nil {
+		t.Fatalf("Failed to split batches: %v", err)
+	}
+	if len(batches) < 2 {
+		t.Fatalf("Expected batches to be split by size, got %d batch", len(batches))
+	}
+	total := 0
+	for i, b := range batches {
+		if len(b.encoded) > 1024 {
+			t.Fatalf("Batch %d exceeds max size, got %d bytes", i, len(b.encoded))
+		}
+		total += len(b.timeSeries)
+	}
+	if total != 500 {
+		t.Fatalf("Expected 500 series in total, got %d", total)
+	}
+}
+
+func TestMetricsPersistingBatches(t *testing.T) {
+
+	var requests, received atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests.Add(1)
+		received.Add(int64(len(req.Timeseries)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:      svr.URL,
+		MaxSeriesPerRequest: 25,
+		RequestConcurrency:  4,
+	}
+
+	err = p.PersistMetrics(createManyTestTimeSeries(100), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if requests.Load() != 4 {
+		t.Fatalf("Expected 4 requests, got %d", requests.Load())
+	}
+	if received.Load() != 100 {
+		t.Fatalf("Expected 100 series to be received, got %d", received.Load())
+	}
+}
+
+func TestMetricsPersistingFailedBatches(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Reject the batch containing the first series
+		for _, l := range req.Timeseries[0].Labels {
+			if l.Name == "instance" && l.Value == "i-00000000" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:      svr.URL,
+		MaxSeriesPerRequest: 10,
+		RequestConcurrency:  2,
+	}
+
+	err = p.PersistMetrics(createManyTestTimeSeries(30), logger)
+	if err == nil {
+		t.Fatalf("Expected error for failed batch, got nil")
+	}
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected BatchError, got %T", err)
+	}
+	if batchErr.Total != 3 {
+		t.Fatalf("Expected 3 batches in total, got %d", batchErr.Total)
+	}
+	if len(batchErr.Failures) != 1 || batchErr.Failures[0].Index != 0 || batchErr.Failures[0].Series != 10 {
+		t.Fatalf("Expected batch 0 with 10 series to fail, got %+v", batchErr.Failures)
+	}
+}
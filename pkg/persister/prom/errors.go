@@ -0,0 +1,103 @@
+package prom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxErrorBodyBytes = 1024 // Maximum number of bytes of an error response body included in errors, same as Prometheus remote write
+
+// Rejection reasons, match them with errors.Is. A rejection means the receiver refused some or all of the series in the request while the endpoint itself is available.
+var (
+	ErrOutOfOrderSample = errors.New("out of order sample") // Sample is older than the latest sample of the series
+	ErrDuplicateSample  = errors.New("duplicate sample")    // Sample with the same timestamp but a different value already exists
+	ErrSampleTooOld     = errors.New("sample too old")      // Sample is outside of the time window accepted by the receiver
+	ErrInvalidLabels    = errors.New("invalid labels")      // Metric name, label name or label value is invalid
+	ErrLimitExceeded    = errors.New("limit exceeded")      // Receiver limit such as series or label count per metric is exceeded
+	ErrUnknownRejection = errors.New("unknown rejection")   // Request was rejected for a reason that isn't recognized
+)
+
+// rejectionReasons maps substrings of receiver error messages to rejection reasons, matched in order against the lower cased response body.
+// Limits come first, as messages about exceeded limits may also mention labels, e.g. "label value length exceeds the limit".
+var rejectionReasons = []struct {
+	substr string
+	reason error
+}{
+	{"per-user series limit", ErrLimitExceeded},
+	{"per-metric series limit", ErrLimitExceeded},
+	{"ingestion rate limit", ErrLimitExceeded},
+	{"exceeded the limit", ErrLimitExceeded},
+	{"exceeds the limit", ErrLimitExceeded},
+	{"out of order", ErrOutOfOrderSample},
+	{"out-of-order", ErrOutOfOrderSample},
+	{"duplicate sample", ErrDuplicateSample},
+	{"new value for", ErrDuplicateSample},
+	{"same timestamp", ErrDuplicateSample},
+	{"too old", ErrSampleTooOld},
+	{"out of bounds", ErrSampleTooOld},
+	{"too far in the past", ErrSampleTooOld},
+	{"too far in the future", ErrSampleTooOld},
+	{"label name", ErrInvalidLabels},
+	{"label value", ErrInvalidLabels},
+	{"invalid label", ErrInvalidLabels},
+	{"invalid metric name", ErrInvalidLabels},
+	{"missing metric name", ErrInvalidLabels},
+	{"duplicate label", ErrInvalidLabels},
+}
+
+// RejectedError is returned when the remote write endpoint permanently rejects a request, e.g. with a 400 response
+type RejectedError struct {
+	StatusCode int    // HTTP status code of the response
+	Status     string // HTTP status of the response
+	Body       string // Excerpt of the response body
+	Reason     error  // Classified rejection reason, one of the Err* rejection reasons
+}
+
+func (e *RejectedError) Error() string {
+	return responseErrorMessage(e.Status, e.Body)
+}
+
+// Unwrap returns the rejection reason
+func (e *RejectedError) Unwrap() error {
+	return e.Reason
+}
+
+// readErrorBody reads a bounded excerpt of the response body for use in error messages
+func readErrorBody(response *http.Response) string {
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxErrorBodyBytes+1))
+	if err != nil && len(body) == 0 {
+		return ""
+	}
+	truncated := len(body) > maxErrorBodyBytes
+	if truncated {
+		body = body[:maxErrorBodyBytes]
+	}
+	excerpt := strings.TrimSpace(string(bytes.ToValidUTF8(body, nil)))
+	if truncated {
+		excerpt += "..."
+	}
+	return excerpt
+}
+
+// classifyRejection returns the rejection reason matching the response body
+func classifyRejection(body string) error {
+	body = strings.ToLower(body)
+	for _, r := range rejectionReasons {
+		if strings.Contains(body, r.substr) {
+			return r.reason
+		}
+	}
+	return ErrUnknownRejection
+}
+
+// responseErrorMessage formats the error message of a failed request
+func responseErrorMessage(status string, body string) string {
+	if body == "" {
+		return fmt.Sprintf("failed to send metrics: %s", status)
+	}
+	return fmt.Sprintf("failed to send metrics: %s: %s", status, body)
+}
@@ -0,0 +1,101 @@
+package prom
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+)
+
+func TestRejectedErrors(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	tests := []struct {
+		body   string
+		reason error
+	}{
+		{"out of order sample", ErrOutOfOrderSample},
+		{"duplicate sample for timestamp", ErrDuplicateSample},
+		{"the sample has been rejected because another sample with the same timestamp, but a different value, has already been ingested", ErrDuplicateSample},
+		{"out of bounds", ErrSampleTooOld},
+		{"invalid label name \"1abc\"", ErrInvalidLabels},
+		{"per-user series limit of 150000 exceeded", ErrLimitExceeded},
+		{"per-metric series limit of 20000 exceeded", ErrLimitExceeded},
+		{"the request has been rejected because the tenant exceeded the ingestion rate limit", ErrLimitExceeded},
+		{"received a series whose label value length exceeds the limit", ErrLimitExceeded},
+		{"something unexpected", ErrUnknownRejection},
+		{"rate limited by proxy", ErrUnknownRejection},
+		{"unlimited retention is not supported", ErrUnknownRejection},
+	}
+
+	for _, test := range tests {
+		svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, test.body, http.StatusBadRequest)
+		}))
+
+		p := &PromClient{
+			RemoteWriteURL: svr.URL,
+		}
+		err = p.PersistMetrics(createTestTimeSeries(), logger)
+		svr.Close()
+		if err == nil {
+			t.Fatalf("Expected error for body %q, got nil", test.body)
+		}
+		if !errors.Is(err, test.reason) {
+			t.Fatalf("Expected reason %v for body %q, got %v", test.reason, test.body, err)
+		}
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) {
+			t.Fatalf("Expected RejectedError for body %q, got %T", test.body, err)
+		}
+		if rejected.StatusCode != http.StatusBadRequest || rejected.Body != test.body {
+			t.Fatalf("Unexpected rejection details: %d %q", rejected.StatusCode, rejected.Body)
+		}
+		if !strings.Contains(err.Error(), test.body) {
+			t.Fatalf("Expected error to contain the response body, got %v", err)
+		}
+	}
+}
+
+func TestErrorBodyExcerpt(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(strings.Repeat("x", 10*maxErrorBodyBytes)))
+	}))
+	defer svr.Close()
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		MaxRetries:     -1,
+	}
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for unavailable endpoint, got nil")
+	}
+	var recoverable *RecoverableError
+	if !errors.As(err, &recoverable) {
+		t.Fatalf("Expected recoverable error, got %v", err)
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		t.Fatalf("Expected outage not to be reported as a rejection")
+	}
+	excerpt := strings.Repeat("x", maxErrorBodyBytes) + "..."
+	if !strings.Contains(recoverable.Error(), excerpt) || strings.Contains(recoverable.Error(), strings.Repeat("x", maxErrorBodyBytes+1)) {
+		t.Fatalf("Expected error to contain a truncated body excerpt, got %d bytes", len(recoverable.Error()))
+	}
+}
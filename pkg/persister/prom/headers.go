@@ -0,0 +1,78 @@
+package prom
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const TenantHeader = "X-Scope-OrgID" // Header used by Mimir, Cortex and Thanos receivers to route requests to a tenant
+
+// secretHeaderParts are parts of custom header names that hold secrets, such as X-API-Key
+var secretHeaderParts = []string{"auth", "key", "token", "secret", "password"}
+
+// reservedHeaders are set by the client itself and can't be overridden by custom headers
+var reservedHeaders = []string{
+	"Authorization",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Type",
+	"Host",
+	"User-Agent",
+	"X-Prometheus-Remote-Write-Version",
+}
+
+// ParseHeaders parses headers given as comma separated key=value pairs, e.g. "X-Header-One=value1,X-Header-Two=value2"
+func ParseHeaders(value string) (map[string]string, error) {
+	return parseKeyValuePairs(value)
+}
+
+// parseKeyValuePairs parses comma separated key=value pairs into a map
+func parseKeyValuePairs(value string) (map[string]string, error) {
+	pairs := map[string]string{}
+	if strings.TrimSpace(value) == "" {
+		return pairs, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid pair %q, expected key=value", pair)
+		}
+		pairs[key] = strings.TrimSpace(val)
+	}
+	return pairs, nil
+}
+
+// validateHeaders checks that none of the custom headers overrides a reserved header
+func validateHeaders(headers map[string]string) error {
+	for name := range headers {
+		for _, reserved := range reservedHeaders {
+			if http.CanonicalHeaderKey(name) == http.CanonicalHeaderKey(reserved) {
+				return fmt.Errorf("header %s is reserved and can't be set", name)
+			}
+		}
+	}
+	return nil
+}
+
+// isSecretHeader reports whether the value of a custom header is likely a secret
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, part := range secretHeaderParts {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders applies the custom headers and the tenant header to a remote write request
+func (p *PromClient) setHeaders(req *http.Request) {
+	for name, value := range p.Headers {
+		req.Header.Set(name, value)
+	}
+	if p.TenantID != "" {
+		req.Header.Set(TenantHeader, p.TenantID)
+	}
+}
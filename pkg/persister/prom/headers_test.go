@@ -0,0 +1,98 @@
+package prom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+)
+
+func TestParseHeaders(t *testing.T) {
+
+	headers, err := ParseHeaders("X-Header-One=value1, X-Header-Two = value=2")
+	if err != nil {
+		t.Fatalf("Failed to parse headers: %v", err)
+	}
+	if headers["X-Header-One"] != "value1" {
+		t.Fatalf("Expected X-Header-One value1, got %s", headers["X-Header-One"])
+	}
+	if headers["X-Header-Two"] != "value=2" {
+		t.Fatalf("Expected X-Header-Two value=2, got %s", headers["X-Header-Two"])
+	}
+
+	headers, err = ParseHeaders("")
+	if err != nil || len(headers) != 0 {
+		t.Fatalf("Expected no headers for empty value, got %v, %v", headers, err)
+	}
+
+	_, err = ParseHeaders("X-Header-One")
+	if err == nil {
+		t.Fatalf("Expected error for header without value, got nil")
+	}
+}
+
+func TestReservedHeaders(t *testing.T) {
+
+	_, err := NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{
+		Headers: "authorization=Bearer sneaky",
+	})
+	if err == nil {
+		t.Fatalf("Expected error for reserved header, got nil")
+	}
+}
+
+func TestSecrets(t *testing.T) {
+
+	p, err := NewPromClient("http://localhost:9090/api/v1/write", "BASIC", "", "user", "hunter22", "", "", "", PromOpts{
+		Headers: "X-API-Key=abcd1234,X-Team=metrics",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	secrets := map[string]bool{}
+	for _, secret := range p.Secrets() {
+		secrets[secret] = true
+	}
+	if !secrets["hunter22"] || !secrets["abcd1234"] || secrets["metrics"] {
+		t.Fatalf("Expected the password and API key as secrets, got %v", p.Secrets())
+	}
+}
+
+func TestMetricsPersistingHeaders(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+
+		err := checkHeaders(r)
+		if err != nil {
+			t.Errorf("Header check failed: %v", err)
+		}
+		if r.Header.Get("X-Scope-OrgID") != "tenant-1" {
+			t.Errorf("Expected X-Scope-OrgID tenant-1, got %s", r.Header.Get("X-Scope-OrgID"))
+		}
+		if r.Header.Get("X-Gateway-Key") != "gateway" {
+			t.Errorf("Expected X-Gateway-Key gateway, got %s", r.Header.Get("X-Gateway-Key"))
+		}
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p, err := NewPromClient(svr.URL, "", "", "", "", "", "", "", PromOpts{
+		Headers:  "X-Gateway-Key=gateway",
+		TenantID: "tenant-1",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package prom
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultRequestTimeout = 10 * time.Second // Default timeout for a single remote write request
+
+// HTTPClientOpts contains the settings for the HTTP client used to send remote write requests. Values are strings to allow them to be passed directly from environment variables.
+// Certificates and keys can be given either as a path to a PEM file or as PEM content.
+type HTTPClientOpts struct {
+	Timeout            string // Timeout for a single request, Go duration format, e.g. "10s"
+	CAFile             string // CA bundle used to verify the server certificate
+	CertFile           string // Client certificate presented for mTLS, requires KeyFile
+	KeyFile            string // Client key presented for mTLS, requires CertFile
+	InsecureSkipVerify string // Disables verification of the server certificate
+	ProxyURL           string // URL of the proxy to use, defaults to the proxy environment variables
+	ServerName         string // Server name used to verify the server certificate, defaults to the host of the remote write URL
+}
+
+// readPEM returns the value if it contains PEM content, otherwise it's treated as a path and the file content is returned
+func readPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+// NewHTTPClient creates an HTTP client from the given options
+func NewHTTPClient(opts HTTPClientOpts) (*http.Client, error) {
+
+	timeout := DefaultRequestTimeout
+	if opts.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(opts.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP timeout: %w", err)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: opts.ServerName,
+	}
+
+	if opts.InsecureSkipVerify != "" {
+		insecureSkipVerify, err := strconv.ParseBool(opts.InsecureSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid insecure skip verify: %w", err)
+		}
+		tlsConfig.InsecureSkipVerify = insecureSkipVerify
+	}
+
+	if opts.CAFile != "" {
+		ca, err := readPEM(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid certificates found in CA")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf("both client certificate and key must be set for mTLS")
+		}
+		cert, err := readPEM(opts.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		key, err := readPEM(opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client key: %w", err)
+		}
+		keyPair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{keyPair}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if opts.ProxyURL != "" {
+		proxyURL, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
@@ -0,0 +1,199 @@
+package prom
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+)
+
+// createTestClientCert creates a self-signed client certificate and returns the certificate and key in PEM format
+func createTestClientCert(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "yac-p-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestHTTPClientOptions(t *testing.T) {
+
+	client, err := NewHTTPClient(HTTPClientOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	if client.Timeout != DefaultRequestTimeout {
+		t.Fatalf("Expected default timeout %s, got %s", DefaultRequestTimeout, client.Timeout)
+	}
+
+	client, err = NewHTTPClient(HTTPClientOpts{Timeout: "3s", InsecureSkipVerify: "true", ServerName: "prometheus.internal"})
+	if err != nil {
+		t.Fatalf("Failed to create HTTP client: %v", err)
+	}
+	if client.Timeout != 3*time.Second {
+		t.Fatalf("Expected timeout 3s, got %s", client.Timeout)
+	}
+	tlsConfig := client.Transport.(*http.Transport).TLSClientConfig
+	if !tlsConfig.InsecureSkipVerify || tlsConfig.ServerName != "prometheus.internal" {
+		t.Fatalf("TLS options not set, got %+v", tlsConfig)
+	}
+
+	invalid := []HTTPClientOpts{
+		{Timeout: "soon"},
+		{InsecureSkipVerify: "maybe"},
+		{CAFile: "/nonexistent/ca.pem"},
+		{CertFile: "cert.pem"},
+		{ProxyURL: "://proxy"},
+	}
+	for _, opts := range invalid {
+		_, err = NewHTTPClient(opts)
+		if err == nil {
+			t.Fatalf("Expected error for invalid options %+v, got nil", opts)
+		}
+	}
+}
+
+func TestMetricsPersistingTLS(t *testing.T) {
+
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svr.Certificate().Raw}), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	// Without the CA the server certificate can't be verified
+	p, err := NewPromClient(svr.URL, "", "", "", "", "", "", "", PromOpts{MaxRetries: "-1"})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected certificate verification error, got nil")
+	}
+
+	p, err = NewPromClient(svr.URL, "", "", "", "", "", "", "", PromOpts{MaxRetries: "-1", HTTPClient: HTTPClientOpts{CAFile: caFile}})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+}
+
+func TestMetricsPersistingMTLS(t *testing.T) {
+
+	cert, key := createTestClientCert(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(cert)
+
+	svr := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "yac-p-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	svr.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	svr.StartTLS()
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svr.Certificate().Raw}))
+	p, err := NewPromClient(svr.URL, "", "", "", "", "", "", "", PromOpts{
+		MaxRetries: "-1",
+		HTTPClient: HTTPClientOpts{
+			CAFile:   ca,
+			CertFile: string(cert),
+			KeyFile:  string(key),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics with client certificate: %v", err)
+	}
+}
+
+func TestMetricsPersistingProxy(t *testing.T) {
+
+	var proxied atomic.Int64
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "prometheus.invalid" {
+			proxied.Add(1)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer proxy.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p, err := NewPromClient("http://prometheus.invalid/api/v1/write", "", "", "", "", "", "", "", PromOpts{
+		MaxRetries: "-1",
+		HTTPClient: HTTPClientOpts{ProxyURL: proxy.URL},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics through proxy: %v", err)
+	}
+	if proxied.Load() != 1 {
+		t.Fatalf("Expected 1 request through the proxy, got %d", proxied.Load())
+	}
+}
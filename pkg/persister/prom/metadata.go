@@ -0,0 +1,136 @@
+package prom
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	MetadataSeries   = "SERIES"   // Metadata of the families in a request is sent along with the series
+	MetadataSeparate = "SEPARATE" // Metadata is sent in metadata-only requests, at most once per metadata interval
+	MetadataNone     = "NONE"     // Metadata is not sent
+
+	DefaultMetadataInterval = time.Minute // Default minimum time between metadata-only requests, same as Prometheus remote write
+)
+
+// metadataMode returns how metadata is sent, defaults to MetadataSeries. Remote write 2.0 has no metadata-only requests, so it sends metadata with the series for both SERIES and SEPARATE.
+func (p *PromClient) metadataMode() string {
+	if p.MetadataMode == "" {
+		return MetadataSeries
+	}
+	return p.MetadataMode
+}
+
+// batchMetadata returns the metadata of the families the time series belong to
+func (p *PromClient) batchMetadata(timeSeries []prompb.TimeSeries, metadata *types.MetricMetadata) []prompb.MetricMetadata {
+	if metadata == nil || p.metadataMode() != MetadataSeries {
+		return nil
+	}
+
+	families := make(map[string]prompb.MetricMetadata, len(metadata.Families))
+	for _, family := range metadata.Families {
+		families[family.MetricFamilyName] = family
+	}
+	matched := []prompb.MetricMetadata{}
+	added := map[string]bool{}
+	for _, ts := range timeSeries {
+		for _, label := range ts.Labels {
+			if label.Name != "__name__" {
+				continue
+			}
+			family, ok := lookupFamily(families, label.Value)
+			if ok && !added[family.MetricFamilyName] {
+				added[family.MetricFamilyName] = true
+				matched = append(matched, family)
+			}
+			break
+		}
+	}
+	return matched
+}
+
+// encodeMetadataRequest marshals metadata into a metadata-only remote write 1.0 request and snappy encodes it
+func encodeMetadataRequest(metadata []prompb.MetricMetadata) ([]byte, error) {
+	r := &prompb.WriteRequest{
+		Metadata: metadata,
+	}
+	data, err := r.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// MetadataState remembers when metadata-only requests were last sent. Share it between the clients created for each run to keep the metadata interval across runs.
+type MetadataState struct {
+	mu   sync.Mutex
+	sent time.Time // Time metadata-only requests were last sent
+}
+
+// LastSent returns the time metadata-only requests were last sent, zero if never
+func (s *MetadataState) LastSent() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+func (s *MetadataState) setSent(sent time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = sent
+}
+
+// metadataState returns the metadata state of the client, which is created on first use unless set
+func (p *PromClient) metadataState() *MetadataState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.MetadataState == nil {
+		p.MetadataState = &MetadataState{}
+	}
+	return p.MetadataState
+}
+
+// sendMetadata sends the metadata in metadata-only requests if the metadata interval has passed since it was last sent.
+// Failures are logged but not returned, as metadata is not essential for the time series to be stored.
+func (p *PromClient) sendMetadata(ctx context.Context, metadata *types.MetricMetadata, logger types.Logger) {
+
+	if metadata == nil || len(metadata.Families) == 0 {
+		return
+	}
+	interval := p.MetadataInterval
+	if interval <= 0 {
+		interval = DefaultMetadataInterval
+	}
+	state := p.metadataState()
+	if lastSent := state.LastSent(); !lastSent.IsZero() && time.Since(lastSent) < interval {
+		logger.Log("debug", "Skipping metadata, sent recently", slog.Time("last_sent", lastSent), slog.Duration("interval", interval))
+		return
+	}
+
+	maxFamilies := p.MaxSeriesPerRequest
+	if maxFamilies <= 0 {
+		maxFamilies = DefaultMaxSeriesPerRequest
+	}
+	families := metadata.Families
+	for start := 0; start < len(families); start += maxFamilies {
+		end := min(start+maxFamilies, len(families))
+		encoded, err := encodeMetadataRequest(families[start:end])
+		if err != nil {
+			logger.Log("warn", "Failed to encode metadata", slog.String("error", err.Error()))
+			return
+		}
+		err = p.sendRequestWithRetry(ctx, batch{encoded: encoded}, logger)
+		if err != nil {
+			logger.Log("warn", "Failed to send metadata", slog.Int("family_count", end-start), slog.String("error", err.Error()))
+			return
+		}
+	}
+	state.setSent(time.Now())
+	logger.Log("debug", "Sent metadata", slog.Int("family_count", len(families)))
+}
@@ -0,0 +1,179 @@
+package prom
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func createTestMetadata() *types.MetricMetadata {
+	return &types.MetricMetadata{
+		Families: []prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "test_gauge", Help: "This is a test gauge", Unit: "seconds"},
+			{Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "test_histogram", Help: "This is a test histogram"},
+			{Type: prompb.MetricMetadata_COUNTER, MetricFamilyName: "test_counter", Help: "This is a test counter"},
+		},
+	}
+}
+
+func TestMetadataOptions(t *testing.T) {
+
+	_, err := NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{Metadata: "ALWAYS"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid metadata mode, got nil")
+	}
+	_, err = NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{MetadataInterval: "often"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid metadata interval, got nil")
+	}
+	p, err := NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{Metadata: MetadataSeparate, MetadataInterval: "5m"})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	if p.MetadataMode != MetadataSeparate || p.MetadataInterval != 5*time.Minute {
+		t.Fatalf("Expected SEPARATE metadata every 5m, got %s every %s", p.MetadataMode, p.MetadataInterval)
+	}
+}
+
+func TestMetricsPersistingMetadata(t *testing.T) {
+
+	timeSeries := append(createManyTestTimeSeries(2), prompb.TimeSeries{
+		Labels:  []prompb.Label{{Name: "__name__", Value: "test_histogram_bucket"}, {Name: "le", Value: "+Inf"}},
+		Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+	})
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequest(r)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(req.Timeseries) != 3 {
+			t.Errorf("Expected 3 time series, got %d", len(req.Timeseries))
+		}
+		// Only the families of the series in the request are sent, once each
+		if len(req.Metadata) != 2 {
+			t.Errorf("Expected metadata for 2 families, got %d", len(req.Metadata))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Metadata[0].MetricFamilyName != "test_gauge" || req.Metadata[0].Unit != "seconds" || req.Metadata[0].Help != "This is a test gauge" {
+			t.Errorf("Unexpected gauge metadata: %+v", req.Metadata[0])
+		}
+		if req.Metadata[1].MetricFamilyName != "test_histogram" || req.Metadata[1].Type != prompb.MetricMetadata_HISTOGRAM {
+			t.Errorf("Unexpected histogram metadata: %+v", req.Metadata[1])
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+	}
+	err = p.PersistMetricsWithMetadata(context.Background(), chunksOf([][]prompb.TimeSeries{timeSeries}, nil), createTestMetadata(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+}
+
+func TestMetricsPersistingSeparateMetadata(t *testing.T) {
+
+	var mu sync.Mutex
+	metadataRequests, seriesRequests := 0, 0
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequest(r)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case len(req.Timeseries) == 0:
+			metadataRequests++
+			if len(req.Metadata) != 2 {
+				t.Errorf("Expected at most 2 families per metadata request, got %d", len(req.Metadata))
+			}
+		case len(req.Metadata) > 0:
+			t.Errorf("Expected no metadata with the series, got %d families", len(req.Metadata))
+		default:
+			seriesRequests++
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:      svr.URL,
+		MaxSeriesPerRequest: 2,
+		MetadataMode:        MetadataSeparate,
+		MetadataInterval:    time.Hour,
+	}
+	metadata := createTestMetadata()
+	metadata.Families = append(metadata.Families, prompb.MetricMetadata{Type: prompb.MetricMetadata_SUMMARY, MetricFamilyName: "test_summary"})
+
+	// Metadata is sent on the first run, and skipped on the next run within the interval
+	for range 2 {
+		err = p.PersistMetricsWithMetadata(context.Background(), chunksOf([][]prompb.TimeSeries{createManyTestTimeSeries(2)}, nil), metadata, logger)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if metadataRequests != 2 {
+		t.Fatalf("Expected 2 metadata requests, got %d", metadataRequests)
+	}
+	if seriesRequests != 2 {
+		t.Fatalf("Expected 2 series requests, got %d", seriesRequests)
+	}
+}
+
+func TestMetricsPersistingNoMetadata(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequest(r)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(req.Metadata) != 0 {
+			t.Errorf("Expected no metadata, got %d families", len(req.Metadata))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		MetadataMode:   MetadataNone,
+	}
+	err = p.PersistMetricsWithMetadata(context.Background(), chunksOf([][]prompb.TimeSeries{createManyTestTimeSeries(2)}, nil), createTestMetadata(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package prom
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// OAuth2Opts contains the settings for the OAuth2 client credentials flow (if using OAUTH2 auth)
+type OAuth2Opts struct {
+	TokenURL       string // URL of the token endpoint
+	ClientID       string // Client ID
+	ClientSecret   string // Client secret
+	Scopes         string // Comma separated list of scopes to request
+	EndpointParams string // Additional parameters sent to the token endpoint, as comma separated key=value pairs, e.g. "audience=prometheus"
+}
+
+// newOAuth2Config creates the client credentials config from the given options
+func newOAuth2Config(opts OAuth2Opts) (*clientcredentials.Config, error) {
+	if opts.TokenURL == "" || opts.ClientID == "" || opts.ClientSecret == "" {
+		return nil, fmt.Errorf("token URL, client ID and client secret must be set for OAUTH2 auth")
+	}
+
+	cfg := &clientcredentials.Config{
+		TokenURL:     opts.TokenURL,
+		ClientID:     opts.ClientID,
+		ClientSecret: opts.ClientSecret,
+	}
+	for _, scope := range strings.Split(opts.Scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			cfg.Scopes = append(cfg.Scopes, scope)
+		}
+	}
+	params, err := parseKeyValuePairs(opts.EndpointParams)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OAuth2 endpoint params: %w", err)
+	}
+	if len(params) > 0 {
+		cfg.EndpointParams = url.Values{}
+		for key, value := range params {
+			cfg.EndpointParams.Set(key, value)
+		}
+	}
+	return cfg, nil
+}
+
+// NewTokenSource creates a caching token source for the OAuth2 config of the client. Tokens are refreshed shortly before they expire.
+// Token requests use the same HTTP client, and thereby TLS and proxy settings, as remote write requests.
+func (p *PromClient) NewTokenSource() (oauth2.TokenSource, error) {
+	if p.OAuth2Config == nil {
+		return nil, fmt.Errorf("OAuth2 config must be set for OAUTH2 auth")
+	}
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, client)
+	return p.OAuth2Config.TokenSource(ctx), nil
+}
+
+// oauth2Token returns an OAuth2 access token from the token source of the client, which is created on first use unless set
+func (p *PromClient) oauth2Token() (*oauth2.Token, error) {
+	p.mu.Lock()
+	if p.TokenSource == nil {
+		tokenSource, err := p.NewTokenSource()
+		if err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+		p.TokenSource = tokenSource
+	}
+	tokenSource := p.TokenSource
+	p.mu.Unlock()
+
+	token, err := tokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch OAuth2 token: %w", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,187 @@
+package prom
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+)
+
+// createTestTokenServer returns a token server issuing sequentially numbered tokens valid for expiresIn seconds
+func createTestTokenServer(t *testing.T, expiresIn int, issued *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		clientID, clientSecret, _ := r.BasicAuth()
+		if clientID != "testclient" || clientSecret != "testsecret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Form.Get("grant_type") != "client_credentials" {
+			t.Errorf("Expected grant_type client_credentials, got %s", r.Form.Get("grant_type"))
+		}
+		if r.Form.Get("scope") != "metrics:write metrics:read" {
+			t.Errorf("Expected scope metrics:write metrics:read, got %s", r.Form.Get("scope"))
+		}
+		if r.Form.Get("audience") != "prometheus" {
+			t.Errorf("Expected audience prometheus, got %s", r.Form.Get("audience"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": fmt.Sprintf("token-%d", issued.Add(1)),
+			"token_type":   "Bearer",
+			"expires_in":   expiresIn,
+		})
+		if err != nil {
+			t.Errorf("Failed to encode token response: %v", err)
+		}
+	}))
+}
+
+func TestOAuth2Options(t *testing.T) {
+
+	_, err := NewPromClient("http://localhost:9090/api/v1/write", "OAUTH2", "", "", "", "", "", "", PromOpts{
+		OAuth2: OAuth2Opts{TokenURL: "http://localhost/token", ClientID: "testclient"},
+	})
+	if err == nil {
+		t.Fatalf("Expected error for missing client secret, got nil")
+	}
+
+	_, err = NewPromClient("http://localhost:9090/api/v1/write", "OAUTH2", "", "", "", "", "", "", PromOpts{
+		OAuth2: OAuth2Opts{TokenURL: "http://localhost/token", ClientID: "testclient", ClientSecret: "testsecret", EndpointParams: "audience"},
+	})
+	if err == nil {
+		t.Fatalf("Expected error for invalid endpoint params, got nil")
+	}
+}
+
+func TestMetricsPersistingOAuth2(t *testing.T) {
+
+	var issued atomic.Int64
+	tokenSvr := createTestTokenServer(t, 3600, &issued)
+	defer tokenSvr.Close()
+
+	var lastAuth atomic.Value
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastAuth.Store(r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p, err := NewPromClient(svr.URL, "OAUTH2", "", "", "", "", "", "", PromOpts{
+		OAuth2: OAuth2Opts{
+			TokenURL:       tokenSvr.URL,
+			ClientID:       "testclient",
+			ClientSecret:   "testsecret",
+			Scopes:         "metrics:write, metrics:read",
+			EndpointParams: "audience=prometheus",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	// The token is cached between requests as long as it's valid
+	for i := 0; i < 3; i++ {
+		err = p.PersistMetrics(createTestTimeSeries(), logger)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if issued.Load() != 1 {
+		t.Fatalf("Expected 1 token to be issued, got %d", issued.Load())
+	}
+	if lastAuth.Load() != "Bearer token-1" {
+		t.Fatalf("Expected Authorization Bearer token-1, got %s", lastAuth.Load())
+	}
+}
+
+func TestMetricsPersistingOAuth2Refresh(t *testing.T) {
+
+	var issued atomic.Int64
+	// Tokens expiring within the refresh margin are refreshed before every request
+	tokenSvr := createTestTokenServer(t, 1, &issued)
+	defer tokenSvr.Close()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token-%d", issued.Load()) {
+			t.Errorf("Expected latest token, got %s", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p, err := NewPromClient(svr.URL, "OAUTH2", "", "", "", "", "", "", PromOpts{
+		OAuth2: OAuth2Opts{
+			TokenURL:       tokenSvr.URL,
+			ClientID:       "testclient",
+			ClientSecret:   "testsecret",
+			Scopes:         "metrics:write,metrics:read",
+			EndpointParams: "audience=prometheus",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = p.PersistMetrics(createTestTimeSeries(), logger)
+		if err != nil {
+			t.Fatalf("Failed to persist metrics: %v", err)
+		}
+	}
+	if issued.Load() != 2 {
+		t.Fatalf("Expected 2 tokens to be issued, got %d", issued.Load())
+	}
+}
+
+func TestMetricsPersistingOAuth2Rejected(t *testing.T) {
+
+	var issued atomic.Int64
+	tokenSvr := createTestTokenServer(t, 3600, &issued)
+	defer tokenSvr.Close()
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p, err := NewPromClient(svr.URL, "OAUTH2", "", "", "", "", "", "", PromOpts{
+		OAuth2: OAuth2Opts{
+			TokenURL:     tokenSvr.URL,
+			ClientID:     "testclient",
+			ClientSecret: "wrongsecret",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for rejected client credentials, got nil")
+	}
+}
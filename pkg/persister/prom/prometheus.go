@@ -6,10 +6,16 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -17,20 +23,73 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
 	"github.com/aws/aws-sdk-go-v2/service/sts"
-	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/pkg/spool"
+	"github.com/kjansson/yac-p/v3/pkg/tracing"
 	"github.com/kjansson/yac-p/v3/pkg/types"
 	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 type PromClient struct {
 	RemoteWriteURL   string // URL of the Prometheus remote write endpoint
-	AuthType         string // Type of authentication to use (AWS, BASIC, TOKEN)
+	AuthType         string // Type of authentication to use (AWS, BASIC, TOKEN, OAUTH2)
 	AuthToken        string // Token to use for authentication (if using TOKEN auth)
 	Username         string // Username to use for authentication (if using BASIC auth)
 	Password         string // Password to use for authentication (if using BASIC auth)
 	Region           string // AWS region to use for authentication (if using AWS auth)
 	PrometheusRegion string // AWS region of the Prometheus remote write endpoint (if using Amazon Managed Prometheus)
 	AWSRoleARN       string // ARN of the AWS role to assume for remote write (if using Amazon Managed Prometheus cross-account)
+
+	MaxSeriesPerRequest int // Maximum number of time series in a single remote write request, defaults to DefaultMaxSeriesPerRequest
+	MaxBytesPerRequest  int // Maximum size in bytes of the compressed remote write request body, defaults to DefaultMaxBytesPerRequest
+	RequestConcurrency  int // Number of remote write requests sent in parallel, defaults to 1
+
+	MaxRetries       int           // Maximum number of retries for a failed request, defaults to DefaultMaxRetries. Set to a negative value to disable retries
+	MinBackoff       time.Duration // Initial backoff between retries, defaults to DefaultMinBackoff
+	MaxBackoff       time.Duration // Maximum backoff between retries, defaults to DefaultMaxBackoff
+	MaxRetryDuration time.Duration // Maximum total time spent on retrying a request, defaults to DefaultMaxRetryDuration. Should be kept below the Lambda timeout
+
+	HTTPClient *http.Client // HTTP client used to send remote write requests, defaults to http.DefaultClient
+
+	Headers  map[string]string // Custom headers added to every remote write request
+	TenantID string            // Tenant ID sent in the X-Scope-OrgID header (if using Mimir, Cortex or Thanos)
+
+	Protocol string // Remote write protocol version to use (1.0, 2.0), defaults to 1.0
+
+	MetadataMode     string         // How metric metadata is sent (SERIES, SEPARATE, NONE), defaults to SERIES
+	MetadataInterval time.Duration  // Minimum time between metadata-only requests (if using SEPARATE metadata), defaults to DefaultMetadataInterval
+	MetadataState    *MetadataState // When metadata-only requests were last sent, created on first use unless set. Share it between clients to keep the metadata interval across runs (optional)
+
+	OAuth2Config *clientcredentials.Config // OAuth2 client credentials config (if using OAUTH2 auth)
+	TokenSource  oauth2.TokenSource        // Caching OAuth2 token source, created on first use unless set. Share it between clients to reuse tokens across runs (optional)
+
+	Spool        *spool.Spool  // Spool for requests that could not be sent, replayed before new data on the next run (optional)
+	SpoolTimeout time.Duration // Time allowed for spooling batches cut off by the cancellation of the context, defaults to DefaultSpoolTimeout
+
+	mu          sync.Mutex              // Guards the token source and metadata state created on first use
+	awsOnce     sync.Once               // Resolves the AWS credentials provider once per client
+	awsProvider aws.CredentialsProvider // Caching AWS credentials provider (if using AWS auth)
+	awsErr      error                   // Error resolving the AWS credentials provider
+}
+
+// PromOpts contains optional settings for the remote write client. Values are strings to allow them to be passed directly from environment variables.
+type PromOpts struct {
+	MaxSeriesPerRequest string
+	MaxBytesPerRequest  string
+	RequestConcurrency  string
+	MaxRetries          string
+	MinBackoff          string // Go duration format, e.g. "30ms"
+	MaxBackoff          string // Go duration format, e.g. "5s"
+	MaxRetryDuration    string // Go duration format, e.g. "10s"
+	HTTPClient          HTTPClientOpts
+	Headers             string // Comma separated key=value pairs, e.g. "X-Header-One=value1,X-Header-Two=value2"
+	TenantID            string
+	Protocol            string // Remote write protocol version, "1.0" or "2.0"
+	Metadata            string // How metric metadata is sent, "SERIES", "SEPARATE" or "NONE"
+	MetadataInterval    string // Go duration format, e.g. "1m"
+	OAuth2              OAuth2Opts
 }
 
 func NewPromClient(
@@ -42,6 +101,7 @@ func NewPromClient(
 	region string,
 	prometheusRegion string,
 	awsRoleARN string,
+	opts PromOpts,
 ) (*PromClient, error) {
 
 	if remoteWriteURL == "" {
@@ -58,8 +118,16 @@ func NewPromClient(
 			return nil, fmt.Errorf("auth token must be set for TOKEN auth")
 		}
 	}
+	var oauth2Config *clientcredentials.Config
+	if authType == "OAUTH2" { // OAuth2 auth requires token URL and client credentials
+		var err error
+		oauth2Config, err = newOAuth2Config(opts.OAuth2)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	return &PromClient{
+	p := &PromClient{
 		RemoteWriteURL:   remoteWriteURL,
 		AuthType:         authType,
 		AuthToken:        authToken,
@@ -68,64 +136,209 @@ func NewPromClient(
 		Region:           region,
 		PrometheusRegion: prometheusRegion,
 		AWSRoleARN:       awsRoleARN,
-	}, nil
-}
-
-// PeristMetrics creates a Prometheus remote write request and sends it to the remote write URL
-func (p *PromClient) PersistMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) error {
+		OAuth2Config:     oauth2Config,
+	}
 
-	logger.Log("debug", "Sending timeseries", slog.Int("timeseries_count", len(timeSeries)))
-	logger.Log("debug", "Auth type", slog.String("auth_type", p.AuthType))
+	var err error
+	if opts.MaxSeriesPerRequest != "" {
+		p.MaxSeriesPerRequest, err = strconv.Atoi(opts.MaxSeriesPerRequest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max series per request: %w", err)
+		}
+	}
+	if opts.MaxBytesPerRequest != "" {
+		p.MaxBytesPerRequest, err = strconv.Atoi(opts.MaxBytesPerRequest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max bytes per request: %w", err)
+		}
+	}
+	if opts.RequestConcurrency != "" {
+		p.RequestConcurrency, err = strconv.Atoi(opts.RequestConcurrency)
+		if err != nil {
+			return nil, fmt.Errorf("invalid request concurrency: %w", err)
+		}
+	}
+	if opts.MaxRetries != "" {
+		p.MaxRetries, err = strconv.Atoi(opts.MaxRetries)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max retries: %w", err)
+		}
+	}
+	if opts.MinBackoff != "" {
+		p.MinBackoff, err = time.ParseDuration(opts.MinBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min backoff: %w", err)
+		}
+	}
+	if opts.MaxBackoff != "" {
+		p.MaxBackoff, err = time.ParseDuration(opts.MaxBackoff)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max backoff: %w", err)
+		}
+	}
+	if opts.MaxRetryDuration != "" {
+		p.MaxRetryDuration, err = time.ParseDuration(opts.MaxRetryDuration)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max retry duration: %w", err)
+		}
+	}
 
-	r := &prompb.WriteRequest{
-		Timeseries: timeSeries,
+	p.HTTPClient, err = NewHTTPClient(opts.HTTPClient)
+	if err != nil {
+		return nil, err
 	}
-	tsProto, err := r.Marshal()
+
+	p.Headers, err = ParseHeaders(opts.Headers)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err := validateHeaders(p.Headers); err != nil {
+		return nil, err
 	}
+	p.TenantID = opts.TenantID
 
-	encoded := snappy.Encode(nil, tsProto)
-	body := bytes.NewReader(encoded)
+	switch opts.Protocol {
+	case "", ProtocolV1, ProtocolV2:
+		p.Protocol = opts.Protocol
+	default:
+		return nil, fmt.Errorf("invalid remote write protocol: %s", opts.Protocol)
+	}
 
-	req, err := http.NewRequest("POST", p.RemoteWriteURL, body)
-	if err != nil {
-		return err
+	switch opts.Metadata {
+	case "", MetadataSeries, MetadataSeparate, MetadataNone:
+		p.MetadataMode = opts.Metadata
+	default:
+		return nil, fmt.Errorf("invalid metadata mode: %s", opts.Metadata)
+	}
+	if opts.MetadataInterval != "" {
+		p.MetadataInterval, err = time.ParseDuration(opts.MetadataInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata interval: %w", err)
+		}
 	}
 
-	switch p.AuthType {
-	case "AWS":
-		ctx := context.TODO()
+	return p, nil
+}
 
-		// Load AWS SDK v2 config
-		cfg, err := config.LoadDefaultConfig(ctx,
-			config.WithRegion(p.Region),
-		)
+// PeristMetrics splits the time series into batches, creates Prometheus remote write requests and sends them to the remote write URL
+func (p *PromClient) PersistMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) error {
+	return p.PersistMetricsContext(context.Background(), timeSeries, logger)
+}
+
+// PersistMetricsContext is like PersistMetrics but stops sending and retrying when the context is cancelled. Batches cut off by the cancellation are spooled, if a spool is set.
+func (p *PromClient) PersistMetricsContext(ctx context.Context, timeSeries []prompb.TimeSeries, logger types.Logger) error {
+	return p.PersistMetricsStream(ctx, func(yield func([]prompb.TimeSeries, error) bool) {
+		yield(timeSeries, nil)
+	}, logger)
+}
+
+// PersistMetricsStream is like PersistMetricsContext but splits and sends each chunk of time series as it arrives, so only one chunk is held in memory at a time.
+// Failed batches of all chunks are reported together once the chunks are sent. An error producing the chunks stops sending, and is returned along with the batches that failed before it.
+func (p *PromClient) PersistMetricsStream(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], logger types.Logger) error {
+	return p.PersistMetricsWithMetadata(ctx, chunks, nil, logger)
+}
+
+// PersistMetricsWithMetadata is like PersistMetricsStream but also sends the metric metadata (optional), along with the time series or in metadata-only requests depending on the metadata mode
+func (p *PromClient) PersistMetricsWithMetadata(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], metadata *types.MetricMetadata, logger types.Logger) error {
+
+	logger.Log("debug", "Auth type", slog.String("auth_type", p.AuthType))
+
+	spooled := false
+	if p.Spool != nil {
+		err := p.replaySpool(ctx, logger)
 		if err != nil {
-			return err
+			logger.Log("warn", "Failed to replay spooled requests", slog.String("error", err.Error()))
+		}
+	}
+	// Batches cut off by the cancellation of ctx are still spooled. The spool limits are enforced once, after all failed batches are spooled.
+	spoolCtx, cancelSpool := p.spoolContext(ctx)
+	defer cancelSpool()
+	defer func() {
+		if spooled {
+			p.trimSpool(spoolCtx, logger)
 		}
+	}()
 
-		// If a role ARN is provided, assume that role
-		if p.AWSRoleARN != "" {
-			logger.Log("debug", "Using AWS role", slog.String("role_arn", p.AWSRoleARN))
+	if p.metadataMode() == MetadataSeparate && p.protocol() == ProtocolV1 {
+		p.sendMetadata(ctx, metadata, logger)
+	}
 
-			host, err := os.Hostname()
-			if err != nil {
-				host = "unknown"
+	batchErr := &BatchError{}
+	// stopped reports the batches that failed before sending stopped along with the error that stopped it
+	stopped := func(err error) error {
+		if len(batchErr.Failures) > 0 {
+			return errors.Join(batchErr, err)
+		}
+		return err
+	}
+	for timeSeries, err := range chunks {
+		if err != nil {
+			return stopped(err)
+		}
+		logger.Log("debug", "Sending timeseries", slog.Int("timeseries_count", len(timeSeries)), slog.String("protocol", p.protocol()))
+
+		batches, err := p.splitBatches(timeSeries, metadata, logger)
+		if err != nil {
+			return stopped(err)
+		}
+		err = p.sendBatches(ctx, batches, logger)
+		var chunkErr *BatchError
+		if errors.As(err, &chunkErr) {
+			for _, f := range chunkErr.Failures {
+				if p.Spool != nil && p.spoolBatch(spoolCtx, batches[f.Index], f.Err, logger) {
+					spooled = true
+				}
+				f.Index += batchErr.Total // Batches are numbered across chunks
+				batchErr.Failures = append(batchErr.Failures, f)
 			}
-			sessionName := "aws-sigv4-proxy-" + host
-			logger.Log("debug", "Using AWS role session name", slog.String("role_session_name", sessionName))
+		} else if err != nil {
+			return stopped(err)
+		}
+		batchErr.Total += len(batches)
+	}
+	if len(batchErr.Failures) > 0 {
+		return batchErr
+	}
+	return nil
+}
 
-			stsClient := sts.NewFromConfig(cfg)
-			cfg.Credentials = aws.NewCredentialsCache(
-				stscreds.NewAssumeRoleProvider(stsClient, p.AWSRoleARN, func(aro *stscreds.AssumeRoleOptions) {
-					aro.RoleSessionName = sessionName
-				}),
-			)
+// Secrets returns the passwords, tokens and secret header values of the client, so they can be masked in logs and errors
+func (p *PromClient) Secrets() []string {
+	secrets := []string{p.AuthToken, p.Password}
+	if p.OAuth2Config != nil {
+		secrets = append(secrets, p.OAuth2Config.ClientSecret)
+	}
+	for name, value := range p.Headers {
+		if isSecretHeader(name) {
+			secrets = append(secrets, value)
 		}
+	}
+	return secrets
+}
 
-		// Sign the request with SigV4
-		credentials, err := cfg.Credentials.Retrieve(ctx)
+// sendRequest sends a single snappy encoded remote write request to the remote write URL
+func (p *PromClient) sendRequest(ctx context.Context, b batch, logger types.Logger) (err error) {
+
+	ctx, span := tracing.Start(ctx, "remote_write.send",
+		tracing.AttrSeries.Int(len(b.timeSeries)),
+		tracing.AttrBytes.Int(len(b.encoded)),
+		attribute.String("yacp.protocol", p.protocol()),
+	)
+	defer func() { tracing.End(span, spanError(err)) }()
+
+	encoded := b.encoded
+	body := bytes.NewReader(encoded)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.RemoteWriteURL, body)
+	if err != nil {
+		return err
+	}
+	p.setHeaders(req)
+	span.SetAttributes(attribute.String("server.address", req.URL.Hostname()))
+
+	switch p.AuthType {
+	case "AWS":
+		credentials, err := p.awsCredentials(ctx, logger)
 		if err != nil {
 			return err
 		}
@@ -145,20 +358,100 @@ func (p *PromClient) PersistMetrics(timeSeries []prompb.TimeSeries, logger types
 	case "TOKEN":
 		logger.Log("debug", "Using token auth")
 		req.Header.Set("Authorization", "Bearer "+p.AuthToken)
+	case "OAUTH2":
+		logger.Log("debug", "Using OAuth2 auth")
+		token, err := p.oauth2Token()
+		if err != nil {
+			var retrieveErr *oauth2.RetrieveError
+			if errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode/100 == 4 {
+				return err // Rejected credentials won't succeed on retry
+			}
+			return &RecoverableError{Err: err}
+		}
+		token.SetAuthHeader(req)
 	}
 
-	req.Header.Set("Content-Type", "application/x-protobuf")
 	req.Header.Set("Content-Encoding", "snappy")
-	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.protocol() == ProtocolV2 {
+		req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
 
 	logger.Log("debug", "Sending request", slog.String("url", p.RemoteWriteURL), slog.Int("body_size", len(encoded)))
-	response, err := http.DefaultClient.Do(req)
+	client := p.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(req)
 	if err != nil {
-		return err
-	} else if response.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send metrics: %s", response.Status)
+		return &RecoverableError{Err: err} // Transport errors are retried
 	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, response.Body) // Drain the body to allow the connection to be reused
+		_ = response.Body.Close()
+	}()
 	logger.Log("debug", "Response", slog.String("status", response.Status), slog.Int("status_code", response.StatusCode))
+	span.SetAttributes(attribute.Int("http.response.status_code", response.StatusCode))
 
+	err = checkResponse(response)
+	if err != nil {
+		return err
+	}
+	if p.protocol() == ProtocolV2 {
+		checkWritten(response, b, logger)
+	}
 	return nil
 }
+
+// awsCredentials returns the credentials used to sign requests. The AWS config and the caching credentials provider, assuming the role if one is set, are resolved once per client and shared by all batches and retries.
+func (p *PromClient) awsCredentials(ctx context.Context, logger types.Logger) (aws.Credentials, error) {
+	p.awsOnce.Do(func() {
+		// Load AWS SDK v2 config
+		cfg, err := config.LoadDefaultConfig(ctx,
+			config.WithRegion(p.Region),
+		)
+		if err != nil {
+			p.awsErr = err
+			return
+		}
+
+		// If a role ARN is provided, assume that role
+		if p.AWSRoleARN != "" {
+			logger.Log("debug", "Using AWS role", slog.String("role_arn", p.AWSRoleARN))
+
+			host, err := os.Hostname()
+			if err != nil {
+				host = "unknown"
+			}
+			sessionName := "aws-sigv4-proxy-" + host
+			logger.Log("debug", "Using AWS role session name", slog.String("role_session_name", sessionName))
+
+			stsClient := sts.NewFromConfig(cfg)
+			cfg.Credentials = aws.NewCredentialsCache(
+				stscreds.NewAssumeRoleProvider(stsClient, p.AWSRoleARN, func(aro *stscreds.AssumeRoleOptions) {
+					aro.RoleSessionName = sessionName
+				}),
+			)
+		}
+		p.awsProvider = cfg.Credentials
+	})
+	if p.awsErr != nil {
+		return aws.Credentials{}, p.awsErr
+	}
+	if p.awsProvider == nil {
+		return aws.Credentials{}, fmt.Errorf("no AWS credentials found")
+	}
+	return p.awsProvider.Retrieve(ctx)
+}
+
+// spanError returns the error to record on a request span, leaving out the request URL of transport errors as its query may carry credentials
+func spanError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s request failed: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
@@ -5,7 +5,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/kjansson/yac-p/v3/pkg/logger"
 	"github.com/prometheus/prometheus/prompb"
@@ -49,6 +52,7 @@ func TestAuthOptions(t *testing.T) {
 		"",
 		"",
 		"",
+		PromOpts{},
 	)
 	if err == nil {
 		t.Fatalf("Expected error for empty Prometheus URL, got nil")
@@ -63,6 +67,7 @@ func TestAuthOptions(t *testing.T) {
 		"",
 		"",
 		"",
+		PromOpts{},
 	)
 	if err == nil {
 		t.Fatalf("Expected error for empty basic auth credentials, got nil")
@@ -77,6 +82,7 @@ func TestAuthOptions(t *testing.T) {
 		"",
 		"",
 		"",
+		PromOpts{},
 	)
 	if err == nil {
 		t.Fatalf("Expected error for empty token auth credentials, got nil")
@@ -102,7 +108,7 @@ func TestMetricsPersistingNoAuth(t *testing.T) {
 	logger, err := logger.NewLogger(
 		os.Stdout,
 		"text",
-		false,
+		logger.LoggerOpts{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to initialize logger: %v", err)
@@ -143,7 +149,7 @@ func TestMetricsPersistingBasicAuth(t *testing.T) {
 	logger, err := logger.NewLogger(
 		os.Stdout,
 		"text",
-		false,
+		logger.LoggerOpts{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to initialize logger: %v", err)
@@ -183,7 +189,7 @@ func TestMetricsPersistingTokenAuth(t *testing.T) {
 	logger, err := logger.NewLogger(
 		os.Stdout,
 		"text",
-		false,
+		logger.LoggerOpts{},
 	)
 	if err != nil {
 		t.Fatalf("Failed to initialize logger: %v", err)
@@ -203,3 +209,69 @@ func TestMetricsPersistingTokenAuth(t *testing.T) {
 	defer svr.Close()
 
 }
+
+func TestMetricsPersistingAWSAuth(t *testing.T) {
+
+	var assumed atomic.Int64
+	stsSvr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assumed.Add(1)
+		w.Header().Set("Content-Type", "text/xml")
+		_, err := fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleResult>
+    <Credentials>
+      <AccessKeyId>ASIATESTROLE</AccessKeyId>
+      <SecretAccessKey>rolesecret</SecretAccessKey>
+      <SessionToken>rolesession</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/yac-p/test</Arn>
+      <AssumedRoleId>AROATEST:test</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleResult>
+</AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		if err != nil {
+			t.Errorf("Failed to write STS response: %v", err)
+		}
+	}))
+	defer stsSvr.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIATEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	t.Setenv("AWS_ENDPOINT_URL_STS", stsSvr.URL)
+
+	var requests atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !strings.Contains(r.Header.Get("Authorization"), "Credential=ASIATESTROLE/") {
+			t.Errorf("Expected request signed with the assumed role, got %s", r.Header.Get("Authorization"))
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:      svr.URL,
+		AuthType:            "AWS",
+		Region:              "eu-west-1",
+		PrometheusRegion:    "eu-west-1",
+		AWSRoleARN:          "arn:aws:iam::123456789012:role/yac-p",
+		MaxSeriesPerRequest: 10,
+	}
+
+	// The role is assumed once, and the credentials are shared by all batches
+	err = p.PersistMetrics(createManyTestTimeSeries(30), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if requests.Load() != 3 {
+		t.Fatalf("Expected 3 requests, got %d", requests.Load())
+	}
+	if assumed.Load() != 1 {
+		t.Fatalf("Expected the role to be assumed once, got %d", assumed.Load())
+	}
+}
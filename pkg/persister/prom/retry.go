@@ -0,0 +1,153 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+)
+
+const (
+	DefaultMaxRetries       = 10                    // Default maximum number of retries for a failed request
+	DefaultMinBackoff       = 30 * time.Millisecond // Default initial backoff, same as Prometheus remote write
+	DefaultMaxBackoff       = 5 * time.Second       // Default maximum backoff, same as Prometheus remote write
+	DefaultMaxRetryDuration = 10 * time.Second      // Default maximum total retry time, fits within the default Lambda timeout
+	maxRetryAfter           = 5 * time.Minute       // Upper bound for Retry-After values to guard against unreasonable headers
+	retryJitterFraction     = 0.5                   // Fraction of the backoff that is randomized
+)
+
+// RecoverableError is returned for failed requests that may succeed if retried, i.e. transport errors, 5xx and 429 responses
+type RecoverableError struct {
+	Err        error         // Underlying error
+	RetryAfter time.Duration // Delay requested by the remote write endpoint through the Retry-After header, if any
+}
+
+func (e *RecoverableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RecoverableError) Unwrap() error {
+	return e.Err
+}
+
+// checkResponse classifies the remote write response the same way Prometheus does; 2xx is success, 5xx and 429 can be retried and any other status is a permanent rejection.
+// The returned error includes an excerpt of the response body.
+func checkResponse(response *http.Response) error {
+	if response.StatusCode/100 == 2 {
+		return nil
+	}
+	body := readErrorBody(response)
+	if response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests {
+		return &RecoverableError{Err: errors.New(responseErrorMessage(response.Status, body)), RetryAfter: parseRetryAfter(response.Header.Get("Retry-After"))}
+	}
+	return &RejectedError{
+		StatusCode: response.StatusCode,
+		Status:     response.Status,
+		Body:       body,
+		Reason:     classifyRejection(body),
+	}
+}
+
+// parseRetryAfter parses a Retry-After header value given either in seconds or as an HTTP date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		retryAfter = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		retryAfter = time.Until(date)
+	}
+	if retryAfter < 0 {
+		return 0
+	}
+	return min(retryAfter, maxRetryAfter)
+}
+
+// backoffWithJitter returns the backoff with part of it randomized to avoid retries being sent in lockstep
+func backoffWithJitter(backoff time.Duration) time.Duration {
+	jitter := time.Duration(float64(backoff) * retryJitterFraction)
+	if jitter <= 0 {
+		return backoff
+	}
+	return backoff - jitter + rand.N(jitter*2)
+}
+
+// sendRequestWithRetry sends a remote write request and retries recoverable failures with exponential backoff until the request succeeds, the retries are exhausted, the retry time budget is spent or the context is cancelled
+func (p *PromClient) sendRequestWithRetry(ctx context.Context, b batch, logger types.Logger) error {
+
+	maxRetries := p.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	backoff := p.MinBackoff
+	if backoff <= 0 {
+		backoff = DefaultMinBackoff
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	maxRetryDuration := p.MaxRetryDuration
+	if maxRetryDuration <= 0 {
+		maxRetryDuration = DefaultMaxRetryDuration
+	}
+
+	start := time.Now()
+	for retries := 0; ; retries++ {
+		err := p.sendRequest(ctx, b, logger)
+		if err == nil {
+			if retries > 0 {
+				logger.Log("info", "Remote write request succeeded after retries", slog.Int("retries", retries), slog.Duration("elapsed", time.Since(start)))
+			}
+			return nil
+		}
+
+		var recoverable *RecoverableError
+		if !errors.As(err, &recoverable) {
+			var rejected *RejectedError
+			if errors.As(err, &rejected) {
+				logger.Log("error", "Remote write request rejected", slog.Int("status_code", rejected.StatusCode), slog.String("reason", rejected.Reason.Error()), slog.String("body", rejected.Body))
+				return err
+			}
+			logger.Log("error", "Remote write request failed with non-recoverable error", slog.Int("retries", retries), slog.String("error", err.Error()))
+			return err
+		}
+		if maxRetries < 0 || retries >= maxRetries {
+			logger.Log("error", "Remote write request failed, retries exhausted", slog.Int("retries", retries), slog.String("error", err.Error()))
+			return fmt.Errorf("giving up after %d retries: %w", retries, err)
+		}
+
+		sleep := backoffWithJitter(backoff)
+		if recoverable.RetryAfter > 0 {
+			sleep = recoverable.RetryAfter
+		}
+		if time.Since(start)+sleep > maxRetryDuration {
+			logger.Log("error", "Remote write request failed, retry time budget exhausted", slog.Int("retries", retries), slog.Duration("max_retry_duration", maxRetryDuration), slog.String("error", err.Error()))
+			return fmt.Errorf("giving up after %d retries, retry time budget of %s exhausted: %w", retries, maxRetryDuration, err)
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(sleep).After(deadline) {
+			logger.Log("error", "Remote write request failed, deadline reached before next retry", slog.Int("retries", retries), slog.String("error", err.Error()))
+			return fmt.Errorf("giving up after %d retries, deadline reached: %w", retries, err)
+		}
+
+		logger.Log("warn", "Retrying remote write request", slog.Int("retry", retries+1), slog.Duration("backoff", sleep), slog.String("error", err.Error()))
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Log("error", "Remote write request failed, cancelled while waiting to retry", slog.Int("retries", retries), slog.String("error", err.Error()))
+			return fmt.Errorf("giving up after %d retries, %w: %w", retries, ctx.Err(), err)
+		case <-timer.C:
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
@@ -0,0 +1,260 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/spool"
+)
+
+func TestRetryRecoverable(t *testing.T) {
+
+	var attempts atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch attempts.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		MinBackoff:     time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts.Load())
+	}
+}
+
+func TestRetryNonRecoverable(t *testing.T) {
+
+	var attempts atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		MinBackoff:     time.Millisecond,
+	}
+
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for bad request, got nil")
+	}
+	var recoverable *RecoverableError
+	if errors.As(err, &recoverable) {
+		t.Fatalf("Expected non-recoverable error, got %v", err)
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("Expected 1 attempt, got %d", attempts.Load())
+	}
+}
+
+func TestRetryExhausted(t *testing.T) {
+
+	var attempts atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		MaxRetries:     3,
+		MinBackoff:     time.Millisecond,
+		MaxBackoff:     2 * time.Millisecond,
+	}
+
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error after exhausted retries, got nil")
+	}
+	if attempts.Load() != 4 {
+		t.Fatalf("Expected 4 attempts, got %d", attempts.Load())
+	}
+
+	attempts.Store(0)
+	p.MaxRetries = -1
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error with retries disabled, got nil")
+	}
+	if attempts.Load() != 1 {
+		t.Fatalf("Expected 1 attempt with retries disabled, got %d", attempts.Load())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+
+	var attempts atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:   svr.URL,
+		MinBackoff:       time.Millisecond,
+		MaxRetryDuration: 1500 * time.Millisecond,
+	}
+
+	start := time.Now()
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error after retry time budget, got nil")
+	}
+	if attempts.Load() != 2 {
+		t.Fatalf("Expected 2 attempts within the retry budget, got %d", attempts.Load())
+	}
+	if time.Since(start) < time.Second {
+		t.Fatalf("Expected Retry-After to be honoured, finished after %s", time.Since(start))
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+
+	if d := parseRetryAfter("3"); d != 3*time.Second {
+		t.Fatalf("Expected 3s, got %s", d)
+	}
+	if d := parseRetryAfter(""); d != 0 {
+		t.Fatalf("Expected 0 for empty header, got %s", d)
+	}
+	if d := parseRetryAfter("invalid"); d != 0 {
+		t.Fatalf("Expected 0 for invalid header, got %s", d)
+	}
+	date := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d <= 0 || d > 10*time.Second {
+		t.Fatalf("Expected up to 10s for HTTP date, got %s", d)
+	}
+}
+
+func TestRetryCancelled(t *testing.T) {
+
+	var attempts atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:   svr.URL,
+		MinBackoff:       50 * time.Millisecond,
+		MaxBackoff:       50 * time.Millisecond,
+		MaxRetryDuration: time.Minute,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = p.PersistMetricsContext(ctx, createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for cancelled retries, got nil")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected retries to stop at the deadline, took %s", time.Since(start))
+	}
+	if attempts.Load() >= int64(DefaultMaxRetries) {
+		t.Fatalf("Expected retries to stop before being exhausted, got %d attempts", attempts.Load())
+	}
+	var recoverable *RecoverableError
+	if !errors.As(err, &recoverable) {
+		t.Fatalf("Expected recoverable error, got %v", err)
+	}
+}
+
+func TestRequestCancelled(t *testing.T) {
+
+	release := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer svr.Close()
+	defer close(release)
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	store, err := spool.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create spool store: %v", err)
+	}
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		Spool:          &spool.Spool{Store: store},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = p.PersistMetricsContext(ctx, createTestTimeSeries(), logger)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected request to be cancelled at the deadline, took %s", time.Since(start))
+	}
+
+	// The batch cut off by the deadline is spooled for the next run
+	names, err := store.List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("Expected cancelled batch to be spooled, got %v", names)
+	}
+}
@@ -0,0 +1,77 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/spool"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+)
+
+const DefaultSpoolTimeout = 400 * time.Millisecond // Default time allowed for spooling once the context of the run is done, kept below the time the Lambda leaves after persisting
+
+// spoolTimeout returns the time allowed for spooling once the context of the run is done
+func (p *PromClient) spoolTimeout() time.Duration {
+	if p.SpoolTimeout <= 0 {
+		return DefaultSpoolTimeout
+	}
+	return p.SpoolTimeout
+}
+
+// spoolContext returns a context for spooling batches cut off by the cancellation of ctx. It's cancelled when the spool timeout has passed after ctx is done, or when the returned cancel function is called.
+func (p *PromClient) spoolContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	spoolCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(p.spoolTimeout(), cancel)
+	})
+	return spoolCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// replaySpool sends the spooled requests from previous runs. Each request is attempted once without retries, to leave time for the new data if the endpoint is still unavailable.
+func (p *PromClient) replaySpool(ctx context.Context, logger types.Logger) error {
+	return p.Spool.Replay(ctx, logger, func(entry spool.Entry, data []byte) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		if entry.Protocol != p.protocol() {
+			return true, fmt.Errorf("request was spooled with remote write protocol %s, client uses %s", entry.Protocol, p.protocol())
+		}
+		err := p.sendRequest(ctx, batch{encoded: data}, logger)
+		if err == nil {
+			return true, nil
+		}
+		var recoverable *RecoverableError
+		if errors.As(err, &recoverable) {
+			return false, err // Keep the request for the next run
+		}
+		return true, err
+	})
+}
+
+// spoolBatch writes a batch that failed with a recoverable error to the spool, and reports whether it was spooled. Requests rejected by the endpoint are not spooled as they would be rejected again.
+func (p *PromClient) spoolBatch(ctx context.Context, b batch, sendErr error, logger types.Logger) bool {
+	var recoverable *RecoverableError
+	if !errors.As(sendErr, &recoverable) {
+		return false
+	}
+	err := p.Spool.Write(ctx, b.encoded, p.protocol(), logger)
+	if err != nil {
+		logger.Log("error", "Failed to spool batch", slog.Int("timeseries_count", len(b.timeSeries)), slog.String("error", err.Error()))
+		return false
+	}
+	return true
+}
+
+// trimSpool enforces the age and size limits of the spool after batches of the run were spooled
+func (p *PromClient) trimSpool(ctx context.Context, logger types.Logger) {
+	err := p.Spool.Trim(ctx, logger)
+	if err != nil {
+		logger.Log("error", "Failed to trim spool", slog.String("error", err.Error()))
+	}
+}
@@ -0,0 +1,214 @@
+package prom
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/spool"
+)
+
+// testStore counts the listings of a local store, and blocks writes until their context is done if block is set
+type testStore struct {
+	*spool.LocalStore
+	lists atomic.Int64
+	block bool
+}
+
+func (s *testStore) Put(ctx context.Context, name string, data []byte) error {
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.LocalStore.Put(ctx, name, data)
+}
+
+func (s *testStore) List(ctx context.Context) ([]string, error) {
+	s.lists.Add(1)
+	return s.LocalStore.List(ctx)
+}
+
+func TestSpoolFailedBatches(t *testing.T) {
+
+	var available atomic.Bool
+	var received atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	store, err := spool.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create spool store: %v", err)
+	}
+	s, err := spool.NewSpool(store, spool.SpoolOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		MaxRetries:     -1,
+		Spool:          s,
+	}
+
+	// The endpoint is unavailable, the batch is spooled
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for unavailable endpoint, got nil")
+	}
+	entries, err := s.Entries(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 spooled request, got %d", len(entries))
+	}
+
+	// The endpoint is back, the spooled request is replayed before the new data
+	available.Store(true)
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if received.Load() != 2 {
+		t.Fatalf("Expected 2 requests, got %d", received.Load())
+	}
+	entries, err = s.Entries(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected empty spool after replay, got %d entries", len(entries))
+	}
+}
+
+func TestSpoolSkipsRejectedBatches(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	store, err := spool.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create spool store: %v", err)
+	}
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		Spool:          &spool.Spool{Store: store},
+	}
+
+	err = p.PersistMetrics(createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for bad request, got nil")
+	}
+	names, err := store.List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(names) != 0 {
+		t.Fatalf("Expected rejected batch not to be spooled, got %v", names)
+	}
+}
+
+func TestSpoolLimitsOncePerRun(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	local, err := spool.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create spool store: %v", err)
+	}
+	store := &testStore{LocalStore: local}
+	p := &PromClient{
+		RemoteWriteURL:      svr.URL,
+		MaxSeriesPerRequest: 10,
+		MaxRetries:          -1,
+		Spool:               &spool.Spool{Store: store},
+	}
+
+	// The spool is listed once to replay and once to enforce its limits, not for every spooled batch
+	err = p.PersistMetrics(createManyTestTimeSeries(30), logger)
+	if err == nil {
+		t.Fatalf("Expected error for unavailable endpoint, got nil")
+	}
+	names, err := local.List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("Expected 3 spooled requests, got %v", names)
+	}
+	if store.lists.Load() != 2 {
+		t.Fatalf("Expected the spool to be listed twice, got %d", store.lists.Load())
+	}
+}
+
+func TestSpoolTimeout(t *testing.T) {
+
+	release := make(chan struct{})
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer svr.Close()
+	defer close(release)
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	local, err := spool.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create spool store: %v", err)
+	}
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		Spool:          &spool.Spool{Store: &testStore{LocalStore: local, block: true}},
+		SpoolTimeout:   50 * time.Millisecond,
+	}
+
+	// Spooling the batch cut off by the deadline is given up once the spool timeout has passed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = p.PersistMetricsContext(ctx, createTestTimeSeries(), logger)
+	if err == nil {
+		t.Fatalf("Expected error for cancelled request, got nil")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected spooling to stop at the spool timeout, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,215 @@
+package prom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/converter"
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+	"google.golang.org/protobuf/proto"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+)
+
+// chunksOf returns the time series as a sequence of chunks, optionally ending with an error
+func chunksOf(chunks [][]prompb.TimeSeries, err error) func(yield func([]prompb.TimeSeries, error) bool) {
+	return func(yield func([]prompb.TimeSeries, error) bool) {
+		for _, chunk := range chunks {
+			if !yield(chunk, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func TestMetricsPersistingStream(t *testing.T) {
+
+	var requests, received atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if requests.Add(1) == 3 {
+			w.WriteHeader(http.StatusBadRequest) // Reject the first batch of the second chunk
+			return
+		}
+		received.Add(int64(len(req.Timeseries)))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL:      svr.URL,
+		MaxSeriesPerRequest: 10,
+	}
+	chunks := [][]prompb.TimeSeries{createManyTestTimeSeries(20), createManyTestTimeSeries(20)}
+	err = p.PersistMetricsStream(context.Background(), chunksOf(chunks, nil), logger)
+
+	// Sending continues after a failed batch, and batches are numbered across chunks
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("Expected BatchError, got %v", err)
+	}
+	if batchErr.Total != 4 || len(batchErr.Failures) != 1 || batchErr.Failures[0].Index != 2 {
+		t.Fatalf("Expected batch 2 of 4 to fail, got %v", batchErr)
+	}
+	if received.Load() != 30 {
+		t.Fatalf("Expected 30 series to be received, got %d", received.Load())
+	}
+
+	// Batches that failed before a conversion error are still reported
+	requests.Store(2)
+	conversionErr := fmt.Errorf("conversion failed")
+	err = p.PersistMetricsStream(context.Background(), chunksOf(chunks[:1], conversionErr), logger)
+	if !errors.Is(err, conversionErr) {
+		t.Fatalf("Expected the conversion error, got %v", err)
+	}
+	if !errors.As(err, &batchErr) || batchErr.Total != 2 || len(batchErr.Failures) != 1 || batchErr.Failures[0].Index != 0 {
+		t.Fatalf("Expected batch 0 of 2 to fail along with the conversion error, got %v", err)
+	}
+}
+
+// createManyTestMetricsFamilies creates gauge families with the given number of metrics each, with labels like those produced by YACE
+func createManyTestMetricsFamilies(families int, metricsPerFamily int) []*io_prometheus_client.MetricFamily {
+	metrics := []*io_prometheus_client.MetricFamily{}
+	for i := 0; i < families; i++ {
+		family := &io_prometheus_client.MetricFamily{
+			Name: proto.String(fmt.Sprintf("aws_ec2_test_metric_%d_average", i)),
+			Type: io_prometheus_client.MetricType_GAUGE.Enum(),
+		}
+		for j := 0; j < metricsPerFamily; j++ {
+			family.Metric = append(family.Metric, &io_prometheus_client.Metric{
+				Label: []*io_prometheus_client.LabelPair{
+					{Name: proto.String("account_id"), Value: proto.String("123456789012")},
+					{Name: proto.String("dimension_InstanceId"), Value: proto.String(fmt.Sprintf("i-%017d", j))},
+					{Name: proto.String("name"), Value: proto.String(fmt.Sprintf("arn:aws:ec2:eu-west-1:123456789012:instance/i-%017d", j))},
+					{Name: proto.String("region"), Value: proto.String("eu-west-1")},
+				},
+				Gauge: &io_prometheus_client.Gauge{Value: proto.Float64(float64(j))},
+			})
+		}
+		metrics = append(metrics, family)
+	}
+	return metrics
+}
+
+// measurePeakHeap runs f while sampling the live heap reported by the garbage collector, and returns the peak above the live heap before f
+func measurePeakHeap(f func()) uint64 {
+	sample := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	read := func() uint64 {
+		metrics.Read(sample)
+		return sample[0].Value.Uint64()
+	}
+
+	// Collect often, so the live heap is sampled at short intervals
+	defer debug.SetGCPercent(debug.SetGCPercent(10))
+	runtime.GC()
+	baseline := read()
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(100 * time.Microsecond)
+		defer ticker.Stop()
+		for {
+			if heap := read(); heap > peak.Load() {
+				peak.Store(heap)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	f()
+	close(done)
+	<-stopped
+	if peak.Load() < baseline {
+		return 0
+	}
+	return peak.Load() - baseline
+}
+
+// BenchmarkPersistMetrics compares the peak heap of converting and persisting all time series at once with streaming them in chunks. The peak heap of the
+// streaming path should stay about the same as the registry grows, while it grows with the registry when converting all at once.
+func BenchmarkPersistMetrics(b *testing.B) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	logger, err := logger.NewLogger(devNull, "text", logger.LoggerOpts{})
+	if err != nil {
+		b.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	for _, size := range []int{10000, 50000, 100000} {
+		metrics := createManyTestMetricsFamilies(10, size/10)
+		c := &converter.Converter{ChunkSize: 5000}
+		p := &PromClient{RemoteWriteURL: svr.URL}
+		controller := &types.Controller{Logger: logger, Converter: c, Persister: p}
+
+		b.Run(fmt.Sprintf("series=%d/all", size), func(b *testing.B) {
+			var peak uint64
+			for b.Loop() {
+				peak = max(peak, measurePeakHeap(func() {
+					timeSeries, err := controller.ConvertMetrics(metrics)
+					if err != nil {
+						b.Fatalf("Failed to convert metrics: %v", err)
+					}
+					err = controller.PersistMetrics(timeSeries)
+					if err != nil {
+						b.Fatalf("Failed to persist metrics: %v", err)
+					}
+				}))
+			}
+			b.ReportMetric(float64(peak)/1e6, "peak-MB")
+		})
+
+		b.Run(fmt.Sprintf("series=%d/stream", size), func(b *testing.B) {
+			var peak uint64
+			for b.Loop() {
+				peak = max(peak, measurePeakHeap(func() {
+					ctx := context.Background()
+					err := controller.PersistMetricsStream(ctx, controller.ConvertMetricsStream(ctx, metrics), nil)
+					if err != nil {
+						b.Fatalf("Failed to persist metrics: %v", err)
+					}
+				}))
+			}
+			b.ReportMetric(float64(peak)/1e6, "peak-MB")
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package prom
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordSpans sets a tracer provider recording spans in memory as the global provider, until the test ends
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return exporter
+}
+
+// intAttr returns the value of an integer attribute of a span, -1 if not set
+func intAttr(span tracetest.SpanStub, key string) int64 {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value.AsInt64()
+		}
+	}
+	return -1
+}
+
+func TestRequestSpans(t *testing.T) {
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+	exporter := recordSpans(t)
+
+	p := &PromClient{RemoteWriteURL: svr.URL, MaxSeriesPerRequest: 10}
+	ctx, parent := tracing.Start(context.Background(), "yacp.persist")
+	err = p.PersistMetricsContext(ctx, createManyTestTimeSeries(30), logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("Expected 3 request spans and the parent span, got %d", len(spans))
+	}
+	root := spans[len(spans)-1].SpanContext.SpanID()
+	for _, request := range spans[:3] {
+		if request.Name != "remote_write.send" || request.Parent.SpanID() != root {
+			t.Fatalf("Expected request spans to be children of the parent span, got %s", request.Name)
+		}
+		if intAttr(request, "yacp.series") != 10 || intAttr(request, "yacp.bytes") <= 0 || intAttr(request, "http.response.status_code") != http.StatusOK {
+			t.Fatalf("Unexpected request span attributes: %v", request.Attributes)
+		}
+	}
+}
+
+func TestRequestSpanError(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+	exporter := recordSpans(t)
+
+	// The query of the URL is left out of the recorded transport error
+	p := &PromClient{RemoteWriteURL: "http://127.0.0.1:1/api/v1/write?token=secret", MaxRetries: -1}
+	err = p.PersistMetrics(createManyTestTimeSeries(5), logger)
+	if err == nil {
+		t.Fatalf("Expected error for unreachable endpoint, got nil")
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Code != codes.Error {
+		t.Fatalf("Expected 1 failed request span, got %v", spans)
+	}
+	for _, event := range spans[0].Events {
+		for _, attr := range event.Attributes {
+			if contains := attr.Value.AsString(); len(contains) > 0 && (strings.Contains(contains, "secret") || strings.Contains(contains, "token")) {
+				t.Fatalf("Expected the request URL to be left out of the span, got %q", contains)
+			}
+		}
+	}
+	if strings.Contains(spans[0].Status.Description, "secret") {
+		t.Fatalf("Expected the request URL to be left out of the span status, got %q", spans[0].Status.Description)
+	}
+}
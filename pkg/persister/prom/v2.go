@@ -0,0 +1,145 @@
+package prom
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+const (
+	ProtocolV1 = "1.0" // Remote write 1.0, prometheus.WriteRequest
+	ProtocolV2 = "2.0" // Remote write 2.0, io.prometheus.write.v2.Request
+
+	samplesWrittenHeader    = "X-Prometheus-Remote-Write-Samples-Written"
+	histogramsWrittenHeader = "X-Prometheus-Remote-Write-Histograms-Written"
+)
+
+// protocol returns the configured remote write protocol version
+func (p *PromClient) protocol() string {
+	if p.Protocol == "" {
+		return ProtocolV1
+	}
+	return p.Protocol
+}
+
+// familySuffixes are appended to the family name by histogram and summary series
+var familySuffixes = []string{"_bucket", "_sum", "_count"}
+
+// lookupFamily returns the metadata of the family a series belongs to, histogram and summary series are matched to their family by stripping the _bucket, _sum and _count suffixes
+func lookupFamily(families map[string]prompb.MetricMetadata, metricName string) (prompb.MetricMetadata, bool) {
+	if family, ok := families[metricName]; ok {
+		return family, true
+	}
+	for _, suffix := range familySuffixes {
+		name, found := strings.CutSuffix(metricName, suffix)
+		if !found {
+			continue
+		}
+		family, ok := families[name]
+		if ok && (family.Type == prompb.MetricMetadata_HISTOGRAM || family.Type == prompb.MetricMetadata_GAUGEHISTOGRAM || family.Type == prompb.MetricMetadata_SUMMARY) {
+			return family, true
+		}
+	}
+	return prompb.MetricMetadata{}, false
+}
+
+// encodeWriteRequestV2 marshals time series into a remote write 2.0 request with interned label strings, metadata and created timestamps, and snappy encodes it
+func (p *PromClient) encodeWriteRequestV2(timeSeries []prompb.TimeSeries, metadata *types.MetricMetadata) ([]byte, error) {
+
+	families := map[string]prompb.MetricMetadata{}
+	createdTimestamps := map[string]int64{}
+	if metadata != nil && p.metadataMode() != MetadataNone {
+		for _, family := range metadata.Families {
+			families[family.MetricFamilyName] = family
+		}
+		createdTimestamps = metadata.CreatedTimestamps
+	}
+
+	symbols := writev2.NewSymbolTable()
+	r := &writev2.Request{
+		Timeseries: make([]writev2.TimeSeries, 0, len(timeSeries)),
+	}
+	for _, ts := range timeSeries {
+		series := writev2.TimeSeries{
+			LabelsRefs: make([]uint32, 0, len(ts.Labels)*2),
+			Samples:    make([]writev2.Sample, 0, len(ts.Samples)),
+		}
+
+		metricName := ""
+		for _, label := range ts.Labels {
+			series.LabelsRefs = append(series.LabelsRefs, symbols.Symbolize(label.Name), symbols.Symbolize(label.Value))
+			if label.Name == "__name__" {
+				metricName = label.Value
+			}
+		}
+		for _, sample := range ts.Samples {
+			series.Samples = append(series.Samples, writev2.Sample{Value: sample.Value, Timestamp: sample.Timestamp})
+		}
+		for _, h := range ts.Histograms {
+			if h.IsFloatHistogram() {
+				series.Histograms = append(series.Histograms, writev2.FromFloatHistogram(h.Timestamp, h.ToFloatHistogram()))
+			} else {
+				series.Histograms = append(series.Histograms, writev2.FromIntHistogram(h.Timestamp, h.ToIntHistogram()))
+			}
+		}
+
+		if family, ok := lookupFamily(families, metricName); ok {
+			series.Metadata = writev2.Metadata{
+				Type:    writev2.Metadata_MetricType(family.Type), // The 1.0 and 2.0 metric type enums share the same values
+				HelpRef: symbols.Symbolize(family.Help),
+				UnitRef: symbols.Symbolize(family.Unit),
+			}
+		}
+		if created, ok := createdTimestamps[types.SeriesKey(ts.Labels)]; ok {
+			series.CreatedTimestamp = created
+		}
+		r.Timeseries = append(r.Timeseries, series)
+	}
+	r.Symbols = symbols.Symbols()
+
+	data, err := r.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, data), nil
+}
+
+// checkWritten compares the number of samples the receiver reports as written with the number of samples sent
+func checkWritten(response *http.Response, b batch, logger types.Logger) {
+
+	sent, histogramsSent := 0, 0
+	for _, ts := range b.timeSeries {
+		sent += len(ts.Samples)
+		histogramsSent += len(ts.Histograms)
+	}
+
+	header := response.Header.Get(samplesWrittenHeader)
+	if header == "" {
+		// Receivers that only support remote write 1.0 may accept the request without confirming what was written
+		logger.Log("warn", "Remote write 2.0 response did not confirm written samples, the receiver may not support remote write 2.0", slog.Int("samples_sent", sent))
+		return
+	}
+	written, err := strconv.Atoi(header)
+	if err != nil {
+		logger.Log("warn", "Invalid written samples header in response", slog.String("header", header))
+		return
+	}
+	if written < sent {
+		logger.Log("warn", "Remote write receiver wrote fewer samples than sent", slog.Int("samples_sent", sent), slog.Int("samples_written", written), slog.String("histograms_written", response.Header.Get(histogramsWrittenHeader)))
+		return
+	}
+	if histogramsSent > 0 {
+		histogramsWritten, err := strconv.Atoi(response.Header.Get(histogramsWrittenHeader))
+		if err != nil || histogramsWritten < histogramsSent {
+			logger.Log("warn", "Remote write receiver wrote fewer histograms than sent", slog.Int("histograms_sent", histogramsSent), slog.String("histograms_written", response.Header.Get(histogramsWrittenHeader)))
+			return
+		}
+	}
+	logger.Log("debug", "Remote write receiver confirmed written samples", slog.Int("samples_written", written))
+}
@@ -0,0 +1,273 @@
+package prom
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+func decodeWriteRequestV2(r *http.Request) (*writev2.Request, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	req := &writev2.Request{}
+	err = req.Unmarshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func TestProtocolOption(t *testing.T) {
+
+	_, err := NewPromClient("http://localhost:9090/api/v1/write", "", "", "", "", "", "", "", PromOpts{Protocol: "3.0"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid protocol, got nil")
+	}
+}
+
+func TestMetricsPersistingV2(t *testing.T) {
+
+	timeSeries := createManyTestTimeSeries(10)
+	metadata := &types.MetricMetadata{
+		Families: []prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "test_gauge", Help: "This is a test gauge", Unit: "seconds"},
+		},
+		CreatedTimestamps: map[string]int64{
+			types.SeriesKey(timeSeries[0].Labels): 1000,
+		},
+	}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Prometheus-Remote-Write-Version") != "2.0.0" {
+			t.Errorf("Expected X-Prometheus-Remote-Write-Version 2.0.0, got %s", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		}
+		if r.Header.Get("Content-Type") != "application/x-protobuf;proto=io.prometheus.write.v2.Request" {
+			t.Errorf("Expected remote write 2.0 content type, got %s", r.Header.Get("Content-Type"))
+		}
+		req, err := decodeWriteRequestV2(r)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Timeseries) != 10 {
+			t.Errorf("Expected 10 time series, got %d", len(req.Timeseries))
+		}
+		// Label names and the metric name are shared between series and interned once, along with the help text and unit
+		if len(req.Symbols) != 1+3+1+10+10+2 {
+			t.Errorf("Expected 27 symbols, got %d", len(req.Symbols))
+		}
+		first := req.Timeseries[0]
+		if req.Symbols[first.LabelsRefs[0]] != "__name__" || req.Symbols[first.LabelsRefs[1]] != "test_gauge" {
+			t.Errorf("Expected first label __name__=test_gauge, got %s=%s", req.Symbols[first.LabelsRefs[0]], req.Symbols[first.LabelsRefs[1]])
+		}
+		if first.Metadata.Type != writev2.Metadata_METRIC_TYPE_GAUGE {
+			t.Errorf("Expected gauge metadata type, got %s", first.Metadata.Type)
+		}
+		if req.Symbols[first.Metadata.HelpRef] != "This is a test gauge" || req.Symbols[first.Metadata.UnitRef] != "seconds" {
+			t.Errorf("Expected help and unit metadata, got %s and %s", req.Symbols[first.Metadata.HelpRef], req.Symbols[first.Metadata.UnitRef])
+		}
+		if first.CreatedTimestamp != 1000 {
+			t.Errorf("Expected created timestamp 1000, got %d", first.CreatedTimestamp)
+		}
+		if req.Timeseries[1].CreatedTimestamp != 0 {
+			t.Errorf("Expected no created timestamp, got %d", req.Timeseries[1].CreatedTimestamp)
+		}
+
+		w.Header().Set("X-Prometheus-Remote-Write-Samples-Written", strconv.Itoa(len(req.Timeseries)))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		Protocol:       ProtocolV2,
+	}
+
+	err = p.PersistMetricsWithMetadata(context.Background(), chunksOf([][]prompb.TimeSeries{timeSeries}, nil), metadata, logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+}
+
+func TestMetricsPersistingV2SeparateMetadata(t *testing.T) {
+
+	var requests atomic.Int64
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		req, err := decodeWriteRequestV2(r)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for i, ts := range req.Timeseries {
+			if ts.Metadata.Type != writev2.Metadata_METRIC_TYPE_GAUGE || req.Symbols[ts.Metadata.HelpRef] != "This is a test gauge" {
+				t.Errorf("Expected gauge metadata with series %d, got %v", i, ts.Metadata)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		Protocol:       ProtocolV2,
+		MetadataMode:   MetadataSeparate,
+	}
+	metadata := &types.MetricMetadata{
+		Families: []prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "test_gauge", Help: "This is a test gauge"},
+		},
+	}
+
+	// Remote write 2.0 has no metadata-only requests, the metadata is sent with the series
+	err = p.PersistMetricsWithMetadata(context.Background(), chunksOf([][]prompb.TimeSeries{createManyTestTimeSeries(10)}, nil), metadata, logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Fatalf("Expected 1 request, got %d", requests.Load())
+	}
+}
+
+func TestV2SmallerPayload(t *testing.T) {
+
+	// Series resembling YACE output, with long label names and values repeated across series
+	timeSeries := []prompb.TimeSeries{}
+	for _, metric := range []string{"aws_ec2_cpuutilization_average", "aws_ec2_network_in_average", "aws_ec2_network_out_average"} {
+		for i := 0; i < 200; i++ {
+			timeSeries = append(timeSeries, prompb.TimeSeries{
+				Labels: []prompb.Label{
+					{Name: "__name__", Value: metric},
+					{Name: "account_id", Value: "123456789012"},
+					{Name: "dimension_InstanceId", Value: "i-0" + strconv.FormatInt(int64(1000000000+i*7919), 16)},
+					{Name: "name", Value: "arn:aws:ec2:eu-north-1:123456789012:instance/i-0" + strconv.FormatInt(int64(1000000000+i*7919), 16)},
+					{Name: "region", Value: "eu-north-1"},
+					{Name: "tag_Environment", Value: "production"},
+				},
+				Samples: []prompb.Sample{
+					{Value: float64(i), Timestamp: 1234567890},
+				},
+			})
+		}
+	}
+	v1, err := (&PromClient{}).encode(timeSeries, nil)
+	if err != nil {
+		t.Fatalf("Failed to encode remote write 1.0 request: %v", err)
+	}
+	v2, err := (&PromClient{Protocol: ProtocolV2}).encode(timeSeries, nil)
+	if err != nil {
+		t.Fatalf("Failed to encode remote write 2.0 request: %v", err)
+	}
+	if len(v2) >= len(v1) {
+		t.Fatalf("Expected remote write 2.0 payload to be smaller, got %d bytes for 2.0 and %d bytes for 1.0", len(v2), len(v1))
+	}
+}
+
+func TestMetricsPersistingV2Histograms(t *testing.T) {
+
+	timeSeries := []prompb.TimeSeries{
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "test_histogram_bucket"}, {Name: "le", Value: "+Inf"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1234567890}},
+		},
+		{
+			Labels:  []prompb.Label{{Name: "__name__", Value: "test_histogram_count"}},
+			Samples: []prompb.Sample{{Value: 3, Timestamp: 1234567890}},
+		},
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "test_native"}},
+			Histograms: []prompb.Histogram{{
+				Count:          &prompb.Histogram_CountInt{CountInt: 3},
+				ZeroCount:      &prompb.Histogram_ZeroCountInt{ZeroCountInt: 0},
+				Sum:            1.5,
+				PositiveSpans:  []prompb.BucketSpan{{Offset: 0, Length: 2}},
+				PositiveDeltas: []int64{1, 1},
+				Timestamp:      1234567890,
+			}},
+		},
+		{
+			// Gauges don't have suffixed series, so a gauge named like a histogram series gets no metadata
+			Labels:  []prompb.Label{{Name: "__name__", Value: "test_gauge_count"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+		},
+	}
+	metadata := &types.MetricMetadata{
+		Families: []prompb.MetricMetadata{
+			{Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "test_histogram", Help: "Classic histogram"},
+			{Type: prompb.MetricMetadata_HISTOGRAM, MetricFamilyName: "test_native", Help: "Native histogram"},
+			{Type: prompb.MetricMetadata_GAUGE, MetricFamilyName: "test_gauge", Help: "Gauge"},
+		},
+	}
+
+	svr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := decodeWriteRequestV2(r)
+		if err != nil {
+			t.Errorf("Failed to decode request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(req.Timeseries) != 4 {
+			t.Errorf("Expected 4 time series, got %d", len(req.Timeseries))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for i, help := range []string{"Classic histogram", "Classic histogram", "Native histogram", ""} {
+			ts := req.Timeseries[i]
+			if req.Symbols[ts.Metadata.HelpRef] != help {
+				t.Errorf("Expected help %q for series %d, got %q", help, i, req.Symbols[ts.Metadata.HelpRef])
+			}
+		}
+		native := req.Timeseries[2]
+		if len(native.Histograms) != 1 || native.Histograms[0].GetCountInt() != 3 || len(native.Histograms[0].PositiveDeltas) != 2 {
+			t.Errorf("Unexpected native histogram: %v", native.Histograms)
+		}
+		w.Header().Set(samplesWrittenHeader, "3")
+		w.Header().Set(histogramsWrittenHeader, "1")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer svr.Close()
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	p := &PromClient{
+		RemoteWriteURL: svr.URL,
+		Protocol:       ProtocolV2,
+	}
+	err = p.PersistMetricsWithMetadata(context.Background(), chunksOf([][]prompb.TimeSeries{timeSeries}, nil), metadata, logger)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+// Package cardinality provides a processor that caps the number of time series in total and per metric name. It implements the types.MetricProcessor interface.
+package cardinality
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	DroppedSeriesMetric = "yacp_cardinality_dropped_series" // Self-metric with the number of series dropped per metric name and limit
+
+	LimitMetric = "metric" // Series dropped by a per metric name limit
+	LimitGlobal = "global" // Series dropped by the global limit
+)
+
+type Limiter struct {
+	MaxSeries          int            // Maximum number of series in total, zero for no limit
+	MaxSeriesPerMetric int            // Maximum number of series per metric name, zero for no limit
+	MetricLimits       map[string]int // Limits for specific metric names, overriding MaxSeriesPerMetric
+	Labels             []prompb.Label // Extra labels added to the self-metrics, e.g. the external labels (optional)
+}
+
+// dropKey identifies the metric name and limit series were dropped by
+type dropKey struct {
+	metric string
+	limit  string
+}
+
+// NewLimiter creates a cardinality limiter. Limits are given as strings to allow them to be passed directly from environment variables, metric limits as comma separated name=limit pairs, e.g. "aws_ec2_cpuutilization_average=1000".
+func NewLimiter(maxSeries string, maxSeriesPerMetric string, metricLimits string) (*Limiter, error) {
+
+	l := &Limiter{
+		MetricLimits: map[string]int{},
+	}
+	var err error
+	if maxSeries != "" {
+		l.MaxSeries, err = strconv.Atoi(maxSeries)
+		if err != nil || l.MaxSeries < 0 {
+			return nil, fmt.Errorf("invalid max series: %s", maxSeries)
+		}
+	}
+	if maxSeriesPerMetric != "" {
+		l.MaxSeriesPerMetric, err = strconv.Atoi(maxSeriesPerMetric)
+		if err != nil || l.MaxSeriesPerMetric < 0 {
+			return nil, fmt.Errorf("invalid max series per metric: %s", maxSeriesPerMetric)
+		}
+	}
+	for _, pair := range strings.Split(metricLimits, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid metric limit %q, expected name=limit", pair)
+		}
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit for metric %s: %s", name, value)
+		}
+		l.MetricLimits[name] = limit
+	}
+	return l, nil
+}
+
+// metricLimit returns the series limit of a metric name, zero for no limit
+func (l *Limiter) metricLimit(name string) int {
+	if limit, ok := l.MetricLimits[name]; ok {
+		return limit
+	}
+	return l.MaxSeriesPerMetric
+}
+
+// seriesHash hashes the labels of a series, leaving out the metric name and the le and quantile labels so that the series of a histogram or summary hash the same and are kept or dropped together
+func seriesHash(labels []prompb.Label) uint64 {
+	h := fnv.New64a()
+	for _, label := range labels {
+		if label.Name == "__name__" || label.Name == "le" || label.Name == "quantile" {
+			continue
+		}
+		_, _ = h.Write([]byte(label.Name))
+		_, _ = h.Write([]byte{0xff})
+		_, _ = h.Write([]byte(label.Value))
+		_, _ = h.Write([]byte{0xff})
+	}
+	return h.Sum64()
+}
+
+// getMetricName returns the metric name of a series
+func getMetricName(ts prompb.TimeSeries) string {
+	for _, label := range ts.Labels {
+		if label.Name == "__name__" {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// ProcessMetrics drops series over the per metric name limits, and then over the global limit. Which series are kept is decided by the hash of their labels, so the same series are kept on every run.
+// A DroppedSeriesMetric series is added for every metric name and limit that dropped series.
+func (l *Limiter) ProcessMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) ([]prompb.TimeSeries, error) {
+
+	if l.MaxSeries <= 0 && l.MaxSeriesPerMetric <= 0 && len(l.MetricLimits) == 0 {
+		return timeSeries, nil
+	}
+
+	names := make([]string, len(timeSeries))
+	hashes := make([]uint64, len(timeSeries))
+	byMetric := map[string][]int{}
+	for i, ts := range timeSeries {
+		names[i] = getMetricName(ts)
+		hashes[i] = seriesHash(ts.Labels)
+		byMetric[names[i]] = append(byMetric[names[i]], i)
+	}
+	byHash := func(indexes []int) {
+		sort.SliceStable(indexes, func(a, b int) bool {
+			return hashes[indexes[a]] < hashes[indexes[b]]
+		})
+	}
+
+	drop := make([]bool, len(timeSeries))
+	dropped := map[dropKey]int{}
+	for name, indexes := range byMetric {
+		limit := l.metricLimit(name)
+		if limit <= 0 || len(indexes) <= limit {
+			continue
+		}
+		byHash(indexes)
+		for _, i := range indexes[limit:] {
+			drop[i] = true
+		}
+		dropped[dropKey{metric: name, limit: LimitMetric}] = len(indexes) - limit
+	}
+
+	if l.MaxSeries > 0 {
+		kept := []int{}
+		for i := range timeSeries {
+			if !drop[i] {
+				kept = append(kept, i)
+			}
+		}
+		if len(kept) > l.MaxSeries {
+			byHash(kept)
+			for _, i := range kept[l.MaxSeries:] {
+				drop[i] = true
+				dropped[dropKey{metric: names[i], limit: LimitGlobal}]++
+			}
+		}
+	}
+
+	if len(dropped) == 0 {
+		logger.Log("debug", "Time series within cardinality limits", slog.Int("timeseries_count", len(timeSeries)))
+		return timeSeries, nil
+	}
+
+	limited := make([]prompb.TimeSeries, 0, len(timeSeries))
+	for i, ts := range timeSeries {
+		if !drop[i] {
+			limited = append(limited, ts)
+		}
+	}
+
+	keys := make([]dropKey, 0, len(dropped))
+	for key := range dropped {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if keys[a].metric != keys[b].metric {
+			return keys[a].metric < keys[b].metric
+		}
+		return keys[a].limit < keys[b].limit
+	})
+	timestamp := time.Now().UnixMilli()
+	for _, key := range keys {
+		limit := l.MaxSeries
+		if key.limit == LimitMetric {
+			limit = l.metricLimit(key.metric)
+		}
+		logger.Log("warn", "Dropped series over cardinality limit", slog.String("metric", key.metric), slog.String("limit", key.limit), slog.Int("max_series", limit), slog.Int("dropped_count", dropped[key]))
+		limited = append(limited, l.droppedSeries(key, dropped[key], timestamp))
+	}
+	logger.Log("debug", "Applied cardinality limits", slog.Int("timeseries_count", len(timeSeries)), slog.Int("kept_count", len(limited)-len(keys)))
+	return limited, nil
+}
+
+// droppedSeries creates the self-metric series for the number of series dropped for a metric name and limit
+func (l *Limiter) droppedSeries(key dropKey, count int, timestamp int64) prompb.TimeSeries {
+	labels := []prompb.Label{
+		{Name: "__name__", Value: DroppedSeriesMetric},
+		{Name: "limit", Value: key.limit},
+		{Name: "metric", Value: key.metric},
+	}
+	for _, label := range l.Labels {
+		if label.Name != "limit" && label.Name != "metric" {
+			labels = append(labels, label)
+		}
+	}
+	// Keep the labels sorted by name as the remote write spec requires
+	sort.Slice(labels, func(a, b int) bool {
+		return labels[a].Name < labels[b].Name
+	})
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: float64(count), Timestamp: timestamp}},
+	}
+}
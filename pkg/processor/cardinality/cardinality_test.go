@@ -0,0 +1,216 @@
+package cardinality
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func createTestTimeSeries(metricName string, count int) []prompb.TimeSeries {
+	timeSeries := []prompb.TimeSeries{}
+	for i := 0; i < count; i++ {
+		timeSeries = append(timeSeries, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: metricName},
+				{Name: "instance", Value: fmt.Sprintf("i-%08d", i)},
+			},
+			Samples: []prompb.Sample{{Value: float64(i), Timestamp: 1234567890}},
+		})
+	}
+	return timeSeries
+}
+
+// getLabel returns the value of a label, or an empty string
+func getLabel(ts prompb.TimeSeries, name string) string {
+	for _, label := range ts.Labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+// countSeries returns the number of series per metric name
+func countSeries(timeSeries []prompb.TimeSeries) map[string]int {
+	counts := map[string]int{}
+	for _, ts := range timeSeries {
+		counts[getLabel(ts, "__name__")]++
+	}
+	return counts
+}
+
+func TestLimiterOptions(t *testing.T) {
+
+	tests := []struct {
+		maxSeries          string
+		maxSeriesPerMetric string
+		metricLimits       string
+	}{
+		{"many", "", ""},
+		{"-1", "", ""},
+		{"", "many", ""},
+		{"", "", "test_gauge"},
+		{"", "", "test_gauge=many"},
+		{"", "", "=10"},
+	}
+	for _, test := range tests {
+		_, err := NewLimiter(test.maxSeries, test.maxSeriesPerMetric, test.metricLimits)
+		if err == nil {
+			t.Fatalf("Expected error for %+v, got nil", test)
+		}
+	}
+
+	l, err := NewLimiter("1000", "100", " test_gauge=10 , test_counter=0 ")
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	if l.MaxSeries != 1000 || l.MaxSeriesPerMetric != 100 {
+		t.Fatalf("Expected limits 1000 and 100, got %d and %d", l.MaxSeries, l.MaxSeriesPerMetric)
+	}
+	if l.metricLimit("test_gauge") != 10 || l.metricLimit("test_counter") != 0 || l.metricLimit("test_other") != 100 {
+		t.Fatalf("Unexpected metric limits: %v", l.MetricLimits)
+	}
+}
+
+func TestPerMetricLimits(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	l, err := NewLimiter("", "20", "test_gauge=5,test_counter=0")
+	if err != nil {
+		t.Fatalf("Failed to create limiter: %v", err)
+	}
+	l.Labels = []prompb.Label{{Name: "account", Value: "prod"}, {Name: "metric", Value: "ignored"}}
+
+	timeSeries := append(createTestTimeSeries("test_gauge", 10), createTestTimeSeries("test_counter", 30)...)
+	timeSeries = append(timeSeries, createTestTimeSeries("test_other", 25)...)
+	limited, err := l.ProcessMetrics(timeSeries, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+
+	counts := countSeries(limited)
+	// A metric limit of zero disables the limit for that metric, overriding the default per metric limit
+	if counts["test_gauge"] != 5 || counts["test_counter"] != 30 || counts["test_other"] != 20 {
+		t.Fatalf("Unexpected series counts after limiting: %v", counts)
+	}
+	if counts[DroppedSeriesMetric] != 2 {
+		t.Fatalf("Expected 2 dropped series self-metrics, got %d", counts[DroppedSeriesMetric])
+	}
+	for _, ts := range limited[len(limited)-2:] {
+		if getLabel(ts, "__name__") != DroppedSeriesMetric || getLabel(ts, "limit") != LimitMetric || getLabel(ts, "account") != "prod" {
+			t.Fatalf("Unexpected self-metric labels: %v", ts.Labels)
+		}
+		expected := map[string]float64{"test_gauge": 5, "test_other": 5}[getLabel(ts, "metric")]
+		if ts.Samples[0].Value != expected {
+			t.Fatalf("Expected %v dropped series for %s, got %v", expected, getLabel(ts, "metric"), ts.Samples[0].Value)
+		}
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	l := &Limiter{MaxSeries: 15}
+	timeSeries := append(createTestTimeSeries("test_gauge", 10), createTestTimeSeries("test_counter", 10)...)
+	limited, err := l.ProcessMetrics(timeSeries, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+
+	counts := countSeries(limited)
+	if counts["test_gauge"]+counts["test_counter"] != 15 {
+		t.Fatalf("Expected 15 series after limiting, got %v", counts)
+	}
+	dropped := 0.0
+	for _, ts := range limited {
+		if getLabel(ts, "__name__") == DroppedSeriesMetric {
+			if getLabel(ts, "limit") != LimitGlobal {
+				t.Fatalf("Expected global limit label, got %s", getLabel(ts, "limit"))
+			}
+			dropped += ts.Samples[0].Value
+		}
+	}
+	if dropped != 5 {
+		t.Fatalf("Expected 5 dropped series reported, got %v", dropped)
+	}
+}
+
+func TestLimitDeterministic(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	l := &Limiter{MaxSeriesPerMetric: 10}
+	first, err := l.ProcessMetrics(createTestTimeSeries("test_gauge", 50), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+
+	// The same series are kept regardless of the order they arrive in
+	reversed := createTestTimeSeries("test_gauge", 50)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	second, err := l.ProcessMetrics(reversed, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+
+	kept := map[string]bool{}
+	for _, ts := range first {
+		kept[getLabel(ts, "instance")] = true
+	}
+	for _, ts := range second {
+		if !kept[getLabel(ts, "instance")] {
+			t.Fatalf("Expected the same series to be kept, %s was not kept in the first run", getLabel(ts, "instance"))
+		}
+	}
+}
+
+func TestHistogramKeptTogether(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	timeSeries := []prompb.TimeSeries{}
+	for i := 0; i < 4; i++ {
+		instance := fmt.Sprintf("i-%08d", i)
+		for _, le := range []string{"1.0", "+Inf"} {
+			timeSeries = append(timeSeries, prompb.TimeSeries{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "test_histogram_bucket"}, {Name: "instance", Value: instance}, {Name: "le", Value: le}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1234567890}},
+			})
+		}
+	}
+
+	l := &Limiter{MaxSeries: 4}
+	limited, err := l.ProcessMetrics(timeSeries, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	buckets := map[string]int{}
+	for _, ts := range limited {
+		if getLabel(ts, "__name__") == "test_histogram_bucket" {
+			buckets[getLabel(ts, "instance")]++
+		}
+	}
+	if len(buckets) != 2 {
+		t.Fatalf("Expected the buckets of 2 histograms to be kept, got %v", buckets)
+	}
+	for instance, count := range buckets {
+		if count != 2 {
+			t.Fatalf("Expected both buckets of %s to be kept, got %d", instance, count)
+		}
+	}
+}
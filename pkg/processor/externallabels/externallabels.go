@@ -0,0 +1,123 @@
+// Package externallabels provides a processor that adds a fixed set of labels to every time series, like Prometheus global external_labels. It implements the types.MetricProcessor interface.
+package externallabels
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	ModeNever    = "NEVER"    // Existing labels are never overridden by external labels
+	ModeOverride = "OVERRIDE" // External labels override existing labels
+	ModePrefix   = "PREFIX"   // Existing labels are renamed with the exported_ prefix on conflict, like Prometheus does for scraped labels
+
+	exportedPrefix = "exported_"
+)
+
+type ExternalLabeler struct {
+	Labels []prompb.Label // External labels added to every time series, sorted by name
+	Mode   string         // How conflicts with existing labels are handled (NEVER, OVERRIDE, PREFIX), defaults to NEVER
+}
+
+// NewExternalLabeler creates an external labeler from labels given as comma separated name=value pairs, e.g. "account=prod,collector=yac-p"
+func NewExternalLabeler(externalLabels string, mode string) (*ExternalLabeler, error) {
+
+	switch mode {
+	case "":
+		mode = ModeNever
+	case ModeNever, ModeOverride, ModePrefix:
+	default:
+		return nil, fmt.Errorf("invalid external labels mode: %s", mode)
+	}
+
+	e := &ExternalLabeler{
+		Labels: []prompb.Label{},
+		Mode:   mode,
+	}
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(externalLabels, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid external label %q, expected name=value", pair)
+		}
+		if value == "" {
+			return nil, fmt.Errorf("empty value for external label: %s", name) // Receivers reject labels with empty values
+		}
+		if !model.LabelName(name).IsValidLegacy() || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid external label name: %s", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate external label: %s", name)
+		}
+		seen[name] = true
+		e.Labels = append(e.Labels, prompb.Label{Name: name, Value: value})
+	}
+	sort.Slice(e.Labels, func(i, j int) bool {
+		return e.Labels[i].Name < e.Labels[j].Name
+	})
+	return e, nil
+}
+
+// ProcessMetrics adds the external labels to every time series, handling conflicts with existing labels according to the mode
+func (e *ExternalLabeler) ProcessMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) ([]prompb.TimeSeries, error) {
+
+	if len(e.Labels) == 0 {
+		return timeSeries, nil
+	}
+
+	conflicts := 0
+	for i := range timeSeries {
+		ts := &timeSeries[i]
+		existing := make(map[string]int, len(ts.Labels))
+		for j, label := range ts.Labels {
+			existing[label.Name] = j
+		}
+
+		labels := make([]prompb.Label, len(ts.Labels), len(ts.Labels)+len(e.Labels))
+		copy(labels, ts.Labels) // Series may share label slices, so they are not modified in place
+		for _, external := range e.Labels {
+			j, ok := existing[external.Name]
+			if !ok {
+				labels = append(labels, external)
+				continue
+			}
+			conflicts++
+			switch e.Mode {
+			case ModeOverride:
+				labels[j].Value = external.Value
+			case ModePrefix:
+				name := exportedPrefix + external.Name
+				for {
+					if _, taken := existing[name]; !taken {
+						break
+					}
+					name = exportedPrefix + name
+				}
+				existing[name] = j
+				labels[j].Name = name
+				labels = append(labels, external)
+			}
+		}
+		// Keep the labels sorted by name as the remote write spec requires
+		sort.Slice(labels, func(a, b int) bool {
+			return labels[a].Name < labels[b].Name
+		})
+		ts.Labels = labels
+	}
+
+	if conflicts > 0 {
+		logger.Log("debug", "External labels conflicted with existing labels", slog.Int("conflict_count", conflicts), slog.String("mode", e.Mode))
+	}
+	logger.Log("debug", "Added external labels", slog.Int("timeseries_count", len(timeSeries)), slog.Int("label_count", len(e.Labels)))
+	return timeSeries, nil
+}
@@ -0,0 +1,117 @@
+package externallabels
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func createTestTimeSeries() []prompb.TimeSeries {
+	return []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "test_gauge"},
+				{Name: "account", Value: "original"},
+				{Name: "exported_account", Value: "older"},
+			},
+			Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1234567890}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "test_counter"},
+				{Name: "label1", Value: "value1"},
+			},
+			Samples: []prompb.Sample{{Value: 2.0, Timestamp: 1234567890}},
+		},
+	}
+}
+
+// getLabel returns the value of a label, or an empty string
+func getLabel(ts prompb.TimeSeries, name string) string {
+	for _, label := range ts.Labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+func TestExternalLabelOptions(t *testing.T) {
+
+	tests := []struct {
+		labels string
+		mode   string
+	}{
+		{"account=prod", "REPLACE"},
+		{"account", ""},
+		{"account=", ""},
+		{"=prod", ""},
+		{"account= ,environment=prod", ""},
+		{"1account=prod", ""},
+		{"__name__=prod", ""},
+		{"account=prod,account=dev", ""},
+	}
+	for _, test := range tests {
+		_, err := NewExternalLabeler(test.labels, test.mode)
+		if err == nil {
+			t.Fatalf("Expected error for labels %q and mode %q, got nil", test.labels, test.mode)
+		}
+	}
+
+	e, err := NewExternalLabeler(" environment=prod , account=123456789012 ", "")
+	if err != nil {
+		t.Fatalf("Failed to create external labeler: %v", err)
+	}
+	if e.Mode != ModeNever {
+		t.Fatalf("Expected default mode %s, got %s", ModeNever, e.Mode)
+	}
+	if len(e.Labels) != 2 || e.Labels[0].Name != "account" || e.Labels[1].Value != "prod" {
+		t.Fatalf("Expected sorted external labels, got %v", e.Labels)
+	}
+}
+
+func TestExternalLabelModes(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	tests := []struct {
+		mode     string
+		expected map[string]string
+	}{
+		{ModeNever, map[string]string{"account": "original", "exported_account": "older", "collector": "yac-p"}},
+		{ModeOverride, map[string]string{"account": "central", "exported_account": "older", "collector": "yac-p"}},
+		{ModePrefix, map[string]string{"account": "central", "exported_exported_account": "original", "exported_account": "older", "collector": "yac-p"}},
+	}
+
+	for _, test := range tests {
+		e, err := NewExternalLabeler("account=central,collector=yac-p", test.mode)
+		if err != nil {
+			t.Fatalf("Failed to create external labeler: %v", err)
+		}
+		timeSeries, err := e.ProcessMetrics(createTestTimeSeries(), logger)
+		if err != nil {
+			t.Fatalf("Failed to add external labels: %v", err)
+		}
+
+		ts := timeSeries[0]
+		if len(ts.Labels) != len(test.expected)+1 {
+			t.Fatalf("Mode %s: expected %d labels, got %v", test.mode, len(test.expected)+1, ts.Labels)
+		}
+		for name, value := range test.expected {
+			if getLabel(ts, name) != value {
+				t.Fatalf("Mode %s: expected %s=%q, got %v", test.mode, name, value, ts.Labels)
+			}
+		}
+
+		// Series without conflicts get all external labels
+		ts = timeSeries[1]
+		if getLabel(ts, "account") != "central" || getLabel(ts, "collector") != "yac-p" || getLabel(ts, "label1") != "value1" {
+			t.Fatalf("Mode %s: expected external labels to be added, got %v", test.mode, ts.Labels)
+		}
+	}
+}
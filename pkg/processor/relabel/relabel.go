@@ -0,0 +1,84 @@
+// Package relabel provides a processor that relabels time series using Prometheus relabel_configs, e.g. to drop series, drop labels or rename metrics. It implements the types.MetricProcessor interface.
+package relabel
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/model/labels"
+	promrelabel "github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"gopkg.in/yaml.v2"
+)
+
+type Relabeler struct {
+	Configs []*promrelabel.Config // Relabel configs applied to every time series, in order
+}
+
+// NewRelabeler parses relabel configs in Prometheus YAML format, either as a list of relabel configs or as a mapping with a relabel_configs key
+func NewRelabeler(config []byte) (*Relabeler, error) {
+
+	configs := []*promrelabel.Config{}
+	err := yaml.UnmarshalStrict(config, &configs)
+	if err != nil {
+		wrapped := struct {
+			RelabelConfigs []*promrelabel.Config `yaml:"relabel_configs"`
+		}{}
+		if wrappedErr := yaml.UnmarshalStrict(config, &wrapped); wrappedErr != nil {
+			return nil, fmt.Errorf("invalid relabel configs: %w", err)
+		}
+		configs = wrapped.RelabelConfigs
+	}
+
+	for i, cfg := range configs {
+		if cfg == nil {
+			return nil, fmt.Errorf("invalid relabel configs: empty relabel config at index %d", i)
+		}
+	}
+
+	return &Relabeler{
+		Configs: configs,
+	}, nil
+}
+
+// ProcessMetrics applies the relabel configs to the labels of each time series. Series dropped by a keep or drop action, and series left without a metric name, are removed.
+func (r *Relabeler) ProcessMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) ([]prompb.TimeSeries, error) {
+
+	if len(r.Configs) == 0 {
+		return timeSeries, nil
+	}
+
+	builder := labels.NewScratchBuilder(0)
+	processed := make([]prompb.TimeSeries, 0, len(timeSeries))
+	dropped, unnamed := 0, 0
+	for _, ts := range timeSeries {
+		builder.Reset()
+		for _, label := range ts.Labels {
+			builder.Add(label.Name, label.Value)
+		}
+		builder.Sort()
+
+		relabeled, keep := promrelabel.Process(builder.Labels(), r.Configs...)
+		if !keep {
+			dropped++
+			continue
+		}
+		if relabeled.Get(labels.MetricName) == "" {
+			unnamed++
+			continue
+		}
+
+		ts.Labels = make([]prompb.Label, 0, relabeled.Len())
+		relabeled.Range(func(label labels.Label) {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: label.Name, Value: label.Value})
+		})
+		processed = append(processed, ts)
+	}
+
+	if unnamed > 0 {
+		logger.Log("warn", "Dropped time series left without a metric name by relabeling", slog.Int("timeseries_count", unnamed))
+	}
+	logger.Log("debug", "Relabeled time series", slog.Int("input_count", len(timeSeries)), slog.Int("output_count", len(processed)), slog.Int("dropped_count", dropped))
+	return processed, nil
+}
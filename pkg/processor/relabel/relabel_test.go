@@ -0,0 +1,181 @@
+package relabel
+
+import (
+	"os"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func createTestTimeSeries() []prompb.TimeSeries {
+	return []prompb.TimeSeries{
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "aws_ec2_cpuutilization_average"},
+				{Name: "dimension_InstanceId", Value: "i-1234"},
+				{Name: "account_id", Value: "123456789012"},
+				{Name: "region", Value: "eu-north-1"},
+			},
+			Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1234567890}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "aws_ec2_networkin_average"},
+				{Name: "dimension_InstanceId", Value: "i-1234"},
+				{Name: "account_id", Value: "123456789012"},
+				{Name: "region", Value: "eu-north-1"},
+			},
+			Samples: []prompb.Sample{{Value: 2.0, Timestamp: 1234567890}},
+		},
+		{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "aws_ec2_info"},
+				{Name: "name", Value: "arn:aws:ec2:eu-north-1:123456789012:instance/i-1234"},
+			},
+			Samples: []prompb.Sample{{Value: 0, Timestamp: 1234567890}},
+		},
+	}
+}
+
+// getLabel returns the value of a label, or an empty string
+func getLabel(ts prompb.TimeSeries, name string) string {
+	for _, label := range ts.Labels {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+func TestRelabelConfigs(t *testing.T) {
+
+	_, err := NewRelabeler([]byte(`- action: replace`))
+	if err == nil {
+		t.Fatalf("Expected error for replace action without target label, got nil")
+	}
+	_, err = NewRelabeler([]byte(`- action: rename`))
+	if err == nil {
+		t.Fatalf("Expected error for unknown action, got nil")
+	}
+
+	// Both a plain list and a relabel_configs mapping are accepted
+	r, err := NewRelabeler([]byte(`
+- action: labeldrop
+  regex: account_id
+`))
+	if err != nil || len(r.Configs) != 1 {
+		t.Fatalf("Failed to parse relabel config list: %v", err)
+	}
+	r, err = NewRelabeler([]byte(`
+relabel_configs:
+  - action: labeldrop
+    regex: account_id
+  - action: drop
+    source_labels: [__name__]
+    regex: aws_ec2_info
+`))
+	if err != nil || len(r.Configs) != 2 {
+		t.Fatalf("Failed to parse relabel_configs mapping: %v", err)
+	}
+}
+
+func TestRelabeling(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	r, err := NewRelabeler([]byte(`
+- action: drop
+  source_labels: [__name__]
+  regex: aws_ec2_info
+- action: replace
+  source_labels: [__name__]
+  regex: aws_ec2_(.+)_average
+  target_label: __name__
+  replacement: ec2_${1}
+- action: labelmap
+  regex: dimension_(.+)
+  replacement: ${1}
+- action: labeldrop
+  regex: dimension_.+|account_id
+- action: replace
+  target_label: environment
+  replacement: production
+- action: hashmod
+  source_labels: [InstanceId]
+  modulus: 4
+  target_label: shard
+`))
+	if err != nil {
+		t.Fatalf("Failed to create relabeler: %v", err)
+	}
+
+	timeSeries, err := r.ProcessMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to relabel time series: %v", err)
+	}
+	if len(timeSeries) != 2 {
+		t.Fatalf("Expected info metric to be dropped, got %d time series", len(timeSeries))
+	}
+
+	for i, name := range []string{"ec2_cpuutilization", "ec2_networkin"} {
+		ts := timeSeries[i]
+		if getLabel(ts, "__name__") != name {
+			t.Fatalf("Expected metric name %s, got %s", name, getLabel(ts, "__name__"))
+		}
+		if getLabel(ts, "InstanceId") != "i-1234" || getLabel(ts, "dimension_InstanceId") != "" || getLabel(ts, "account_id") != "" {
+			t.Fatalf("Expected dimension labels to be mapped and dropped, got %v", ts.Labels)
+		}
+		if getLabel(ts, "environment") != "production" || getLabel(ts, "shard") == "" {
+			t.Fatalf("Expected environment and shard labels to be added, got %v", ts.Labels)
+		}
+		if len(ts.Samples) != 1 || ts.Samples[0].Value != float64(i+1) {
+			t.Fatalf("Expected samples to be kept, got %v", ts.Samples)
+		}
+	}
+
+	// keep drops everything not matching
+	r, err = NewRelabeler([]byte(`
+- action: keep
+  source_labels: [__name__]
+  regex: .*cpuutilization.*
+- action: labelkeep
+  regex: __name__|region
+`))
+	if err != nil {
+		t.Fatalf("Failed to create relabeler: %v", err)
+	}
+	timeSeries, err = r.ProcessMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to relabel time series: %v", err)
+	}
+	if len(timeSeries) != 1 || len(timeSeries[0].Labels) != 2 || getLabel(timeSeries[0], "region") != "eu-north-1" {
+		t.Fatalf("Expected a single series with name and region labels, got %v", timeSeries)
+	}
+}
+
+func TestRelabelingDropsUnnamedSeries(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	r, err := NewRelabeler([]byte(`
+- action: labeldrop
+  regex: __name__
+`))
+	if err != nil {
+		t.Fatalf("Failed to create relabeler: %v", err)
+	}
+	timeSeries, err := r.ProcessMetrics(createTestTimeSeries(), logger)
+	if err != nil {
+		t.Fatalf("Failed to relabel time series: %v", err)
+	}
+	if len(timeSeries) != 0 {
+		t.Fatalf("Expected series without metric name to be dropped, got %d", len(timeSeries))
+	}
+}
@@ -0,0 +1,99 @@
+// Package staleness provides a processor that adds Prometheus staleness markers for series that disappeared since the previous run. It implements the types.MetricProcessor interface.
+package staleness
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type Marker struct {
+	previous map[string]series // Series sent in the previous run, keyed by SeriesKey
+	pending  map[string]series // Series of this run, replacing the previous series when committed
+	skip     bool              // Add no markers in the next run
+	mu       sync.Mutex        // Guards previous, pending and skip
+}
+
+// series is a series sent in a run
+type series struct {
+	labels    []prompb.Label // Labels of the series
+	timestamp int64          // Timestamp of the newest sample or histogram of the series, in milliseconds
+}
+
+func NewMarker() *Marker {
+	return &Marker{}
+}
+
+// Skip makes the next run add no markers and keep the series of the previous run, e.g. when collection was cut short and the missing series may still exist
+func (m *Marker) Skip() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.skip = true
+}
+
+// Commit makes the series of the last run the ones the next run is compared with. Call it once the time series of the run are persisted, so the markers of a failed run are added again by the next run.
+func (m *Marker) Commit() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending != nil {
+		m.previous, m.pending = m.pending, nil
+	}
+}
+
+// ProcessMetrics adds a staleness marker for every series of the previous run that is missing from this run, so queries stop returning it right away instead of after the lookback period.
+// The marker is a sample with the special StaleNaN value, timestamped 1ms after the newest sample or native histogram sent for the series, so the series is accepted again if it comes back with a later sample.
+// Nothing is marked on the first run, as there is no previous run to compare with.
+func (m *Marker) ProcessMetrics(timeSeries []prompb.TimeSeries, logger types.Logger) ([]prompb.TimeSeries, error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now().UnixMilli()
+	current := make(map[string]series, len(timeSeries))
+	for _, ts := range timeSeries {
+		s := series{labels: ts.Labels}
+		for _, sample := range ts.Samples {
+			s.timestamp = max(s.timestamp, sample.Timestamp)
+		}
+		for _, histogram := range ts.Histograms {
+			s.timestamp = max(s.timestamp, histogram.Timestamp)
+		}
+		if s.timestamp == 0 {
+			s.timestamp = now // A series without timestamps is marked relative to the run
+		}
+		current[types.SeriesKey(ts.Labels)] = s
+	}
+	if m.skip {
+		for key, s := range m.previous {
+			if _, ok := current[key]; !ok {
+				current[key] = s
+			}
+		}
+		m.pending, m.skip = current, false
+		logger.Log("debug", "Skipped staleness markers for this run")
+		return timeSeries, nil
+	}
+
+	stale := 0
+	for key, s := range m.previous {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		timeSeries = append(timeSeries, prompb.TimeSeries{
+			Labels:  s.labels,
+			Samples: []prompb.Sample{{Value: math.Float64frombits(value.StaleNaN), Timestamp: s.timestamp + 1}},
+		})
+		stale++
+	}
+	m.pending = current
+
+	if stale > 0 {
+		logger.Log("info", "Added staleness markers for series that disappeared", slog.Int("stale_count", stale))
+	}
+	return timeSeries, nil
+}
@@ -0,0 +1,177 @@
+package staleness
+
+import (
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func createTestTimeSeries(instances ...string) []prompb.TimeSeries {
+	timeSeries := []prompb.TimeSeries{}
+	for _, instance := range instances {
+		timeSeries = append(timeSeries, prompb.TimeSeries{
+			Labels: []prompb.Label{
+				{Name: "__name__", Value: "test_gauge"},
+				{Name: "instance", Value: instance},
+			},
+			Samples: []prompb.Sample{{Value: 1.0, Timestamp: 1234567890}},
+		})
+	}
+	return timeSeries
+}
+
+func TestStalenessMarkers(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	m := NewMarker()
+
+	// Nothing is marked on the first run
+	processed, err := m.ProcessMetrics(createTestTimeSeries("i-1", "i-2", "i-3"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(processed) != 3 {
+		t.Fatalf("Expected 3 series on the first run, got %d", len(processed))
+	}
+	m.Commit()
+
+	processed, err = m.ProcessMetrics(createTestTimeSeries("i-1", "i-3", "i-4"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(processed) != 4 {
+		t.Fatalf("Expected 3 series and 1 staleness marker, got %d series", len(processed))
+	}
+	marker := processed[3]
+	if marker.Labels[1].Value != "i-2" {
+		t.Fatalf("Expected staleness marker for i-2, got %v", marker.Labels)
+	}
+	if !value.IsStaleNaN(marker.Samples[0].Value) || !math.IsNaN(marker.Samples[0].Value) {
+		t.Fatalf("Expected StaleNaN sample, got %v", marker.Samples[0].Value)
+	}
+	if marker.Samples[0].Timestamp != 1234567891 {
+		t.Fatalf("Expected marker 1ms after the last sample of the series, got %d", marker.Samples[0].Timestamp)
+	}
+	m.Commit()
+
+	// Series are only marked once
+	processed, err = m.ProcessMetrics(createTestTimeSeries("i-1", "i-3", "i-4"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(processed) != 3 {
+		t.Fatalf("Expected no staleness markers, got %d series", len(processed))
+	}
+}
+
+func TestStalenessMarkersSkipped(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	m := NewMarker()
+	_, err = m.ProcessMetrics(createTestTimeSeries("i-1", "i-2"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	m.Commit()
+
+	// An incomplete run marks nothing, and the missing series are remembered for the next run
+	m.Skip()
+	processed, err := m.ProcessMetrics(createTestTimeSeries("i-1", "i-3"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(processed) != 2 {
+		t.Fatalf("Expected no staleness markers in a skipped run, got %d series", len(processed))
+	}
+	m.Commit()
+
+	processed, err = m.ProcessMetrics(createTestTimeSeries("i-1"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(processed) != 3 {
+		t.Fatalf("Expected staleness markers for i-2 and i-3, got %d series", len(processed))
+	}
+}
+
+func TestStalenessMarkersNotCommitted(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	m := NewMarker()
+	_, err = m.ProcessMetrics(createTestTimeSeries("i-1", "i-2"), logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	m.Commit()
+
+	// The markers of a run that failed to persist are added again by the next run
+	for range 2 {
+		processed, err := m.ProcessMetrics(createTestTimeSeries("i-1"), logger)
+		if err != nil {
+			t.Fatalf("Failed to process metrics: %v", err)
+		}
+		if len(processed) != 2 {
+			t.Fatalf("Expected a staleness marker for i-2, got %d series", len(processed))
+		}
+	}
+}
+
+func TestStalenessMarkersHistograms(t *testing.T) {
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	m := NewMarker()
+
+	// Native histogram series carry no samples, the marker follows the newest histogram
+	start := time.Now().UnixMilli()
+	_, err = m.ProcessMetrics([]prompb.TimeSeries{
+		{
+			Labels:     []prompb.Label{{Name: "__name__", Value: "test_histogram"}},
+			Histograms: []prompb.Histogram{{Sum: 1, Timestamp: 1234567890}},
+		},
+		{
+			Labels: []prompb.Label{{Name: "__name__", Value: "test_empty"}},
+		},
+	}, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	m.Commit()
+
+	processed, err := m.ProcessMetrics(nil, logger)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if len(processed) != 2 {
+		t.Fatalf("Expected 2 staleness markers, got %d series", len(processed))
+	}
+	for _, marker := range processed {
+		switch marker.Labels[0].Value {
+		case "test_histogram":
+			if marker.Samples[0].Timestamp != 1234567891 {
+				t.Fatalf("Expected marker 1ms after the last histogram of the series, got %d", marker.Samples[0].Timestamp)
+			}
+		case "test_empty":
+			// Series without timestamps fall back to the time of the run
+			if marker.Samples[0].Timestamp <= start {
+				t.Fatalf("Expected marker after the start of the run, got %d", marker.Samples[0].Timestamp)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore stores spooled requests as files in a local directory. In Lambda the directory must be under /tmp, and the spool only survives as long as the execution environment is reused.
+type LocalStore struct {
+	Dir string // Directory holding the spooled requests
+}
+
+func NewLocalStore(dir string) (*LocalStore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("spool directory must be set")
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{Dir: dir}, nil
+}
+
+// Put writes the data to a temporary file and renames it, so partially written entries are never listed
+func (l *LocalStore) Put(ctx context.Context, name string, data []byte) error {
+	tmp := filepath.Join(l.Dir, "."+name+".tmp")
+	err := os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(l.Dir, name))
+}
+
+func (l *LocalStore) Get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(l.Dir, name))
+}
+
+func (l *LocalStore) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(l.Dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (l *LocalStore) List(ctx context.Context) ([]string, error) {
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, file := range files {
+		if file.IsDir() || file.Name()[0] == '.' {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
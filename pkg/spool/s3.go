@@ -0,0 +1,102 @@
+package spool
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3API is the subset of the S3 client used by S3Store
+type S3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+// S3Store stores spooled requests as objects in an S3 bucket, which keeps them across Lambda execution environments
+type S3Store struct {
+	Client S3API  // S3 client
+	Bucket string // Bucket holding the spooled requests
+	Prefix string // Key prefix of the spooled requests
+}
+
+func NewS3Store(client S3API, bucket string, prefix string) (*S3Store, error) {
+	if client == nil || bucket == "" {
+		return nil, fmt.Errorf("S3 client and bucket must be set for S3 spool")
+	}
+	return &S3Store{
+		Client: client,
+		Bucket: bucket,
+		Prefix: strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (s *S3Store) key(name string) string {
+	return path.Join(s.Prefix, name)
+}
+
+func (s *S3Store) Put(ctx context.Context, name string, data []byte) error {
+	_, err := s.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   bytes.NewReader(data),
+	})
+	return err
+}
+
+func (s *S3Store) Get(ctx context.Context, name string) (content []byte, err error) {
+	obj, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := obj.Body.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	return io.ReadAll(obj.Body)
+}
+
+func (s *S3Store) Delete(ctx context.Context, name string) error {
+	_, err := s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	return err
+}
+
+func (s *S3Store) List(ctx context.Context) ([]string, error) {
+	prefix := ""
+	if s.Prefix != "" {
+		prefix = s.Prefix + "/"
+	}
+	names := []string{}
+	paginator := s3.NewListObjectsV2Paginator(s.Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), prefix)
+			if name == "" || strings.Contains(name, "/") {
+				continue // Skip objects belonging to other spools with a longer prefix
+			}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,104 @@
+package spool
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// testS3Client is an in-memory implementation of S3API
+type testS3Client struct {
+	objects map[string][]byte
+}
+
+func (c *testS3Client) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.objects[aws.ToString(params.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (c *testS3Client) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := c.objects[aws.ToString(params.Key)]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", aws.ToString(params.Key))
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (c *testS3Client) DeleteObject(ctx context.Context, params *s3.DeleteObjectInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(c.objects, aws.ToString(params.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (c *testS3Client) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	keys := []string{}
+	for key := range c.objects {
+		if strings.HasPrefix(key, aws.ToString(params.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	output := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, s3types.Object{Key: aws.String(key)})
+	}
+	return output, nil
+}
+
+func TestS3Store(t *testing.T) {
+
+	client := &testS3Client{objects: map[string][]byte{
+		"spool/primary-old/other.snappy": []byte("belongs to another spool"),
+	}}
+
+	_, err := NewS3Store(client, "", "spool/primary")
+	if err == nil {
+		t.Fatalf("Expected error for missing bucket, got nil")
+	}
+
+	store, err := NewS3Store(client, "bucket", "/spool/primary/")
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	err = store.Put(context.Background(), "entry.snappy", []byte("request"))
+	if err != nil {
+		t.Fatalf("Failed to put entry: %v", err)
+	}
+	if _, ok := client.objects["spool/primary/entry.snappy"]; !ok {
+		t.Fatalf("Expected entry under prefix, got %v", client.objects)
+	}
+
+	names, err := store.List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list entries: %v", err)
+	}
+	if len(names) != 1 || names[0] != "entry.snappy" {
+		t.Fatalf("Expected only entry.snappy, got %v", names)
+	}
+
+	data, err := store.Get(context.Background(), "entry.snappy")
+	if err != nil || string(data) != "request" {
+		t.Fatalf("Expected entry content request, got %s, %v", string(data), err)
+	}
+
+	err = store.Delete(context.Background(), "entry.snappy")
+	if err != nil {
+		t.Fatalf("Failed to delete entry: %v", err)
+	}
+	names, err = store.List(context.Background())
+	if err != nil || len(names) != 0 {
+		t.Fatalf("Expected no entries after delete, got %v, %v", names, err)
+	}
+}
@@ -0,0 +1,238 @@
+// Package spool provides durable storage of remote write requests that could not be sent, so they can be replayed on the next run.
+package spool
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/types"
+)
+
+const (
+	DefaultMaxAge   = time.Hour        // Default maximum age of spooled requests, older samples are likely to be rejected by the receiver anyway
+	DefaultMaxBytes = 50 * 1024 * 1024 // Default maximum total size of spooled requests
+)
+
+// Entry describes a spooled request
+type Entry struct {
+	Name     string    // Name of the entry in the store
+	Size     int64     // Size of the spooled request in bytes
+	Created  time.Time // Time the request was spooled
+	Protocol string    // Remote write protocol version the request was encoded with
+}
+
+// Store is an interface for storage backends holding spooled requests
+type Store interface {
+	Put(ctx context.Context, name string, data []byte) error
+	Get(ctx context.Context, name string) ([]byte, error)
+	Delete(ctx context.Context, name string) error
+	List(ctx context.Context) ([]string, error)
+}
+
+type Spool struct {
+	Store    Store         // Storage backend
+	MaxAge   time.Duration // Spooled requests older than this are discarded, defaults to DefaultMaxAge
+	MaxBytes int64         // Oldest spooled requests are discarded when the total size exceeds this, defaults to DefaultMaxBytes
+}
+
+// SpoolOpts contains optional settings for the spool. Values are strings to allow them to be passed directly from environment variables.
+type SpoolOpts struct {
+	MaxAge   string // Go duration format, e.g. "1h"
+	MaxBytes string
+}
+
+func NewSpool(store Store, opts SpoolOpts) (*Spool, error) {
+
+	if store == nil {
+		return nil, fmt.Errorf("spool store must be set")
+	}
+
+	s := &Spool{
+		Store: store,
+	}
+
+	var err error
+	if opts.MaxAge != "" {
+		s.MaxAge, err = time.ParseDuration(opts.MaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool max age: %w", err)
+		}
+	}
+	if opts.MaxBytes != "" {
+		s.MaxBytes, err = strconv.ParseInt(opts.MaxBytes, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool max bytes: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// entryName creates a name that sorts by creation time and carries the size and protocol version, e.g. "01760000000000000000-2048-1a2b3c4d.v1_0.snappy"
+func entryName(created time.Time, size int, protocol string) (string, error) {
+	random := make([]byte, 4)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%020d-%d-%s.v%s.snappy", created.UnixNano(), size, hex.EncodeToString(random), strings.ReplaceAll(protocol, ".", "_")), nil
+}
+
+// parseEntryName extracts the creation time, size and protocol version from an entry name
+func parseEntryName(name string) (Entry, error) {
+	base, found := strings.CutSuffix(name[strings.LastIndex(name, "/")+1:], ".snappy")
+	if !found {
+		return Entry{}, fmt.Errorf("invalid spool entry name: %s", name)
+	}
+	base, protocol, found := strings.Cut(base, ".v")
+	if !found {
+		return Entry{}, fmt.Errorf("invalid spool entry name: %s", name)
+	}
+	parts := strings.Split(base, "-")
+	if len(parts) != 3 {
+		return Entry{}, fmt.Errorf("invalid spool entry name: %s", name)
+	}
+	created, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid spool entry name: %s", name)
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Entry{}, fmt.Errorf("invalid spool entry name: %s", name)
+	}
+	return Entry{
+		Name:     name,
+		Size:     size,
+		Created:  time.Unix(0, created),
+		Protocol: strings.ReplaceAll(protocol, "_", "."),
+	}, nil
+}
+
+func (s *Spool) maxAge() time.Duration {
+	if s.MaxAge <= 0 {
+		return DefaultMaxAge
+	}
+	return s.MaxAge
+}
+
+func (s *Spool) maxBytes() int64 {
+	if s.MaxBytes <= 0 {
+		return DefaultMaxBytes
+	}
+	return s.MaxBytes
+}
+
+// Write spools a snappy encoded remote write request. The size limit is enforced by Trim, once all requests of a run are spooled.
+func (s *Spool) Write(ctx context.Context, data []byte, protocol string, logger types.Logger) error {
+
+	if int64(len(data)) > s.maxBytes() {
+		return fmt.Errorf("request of %d bytes exceeds the spool size limit of %d bytes", len(data), s.maxBytes())
+	}
+
+	name, err := entryName(time.Now(), len(data), protocol)
+	if err != nil {
+		return err
+	}
+	err = s.Store.Put(ctx, name, data)
+	if err != nil {
+		return fmt.Errorf("failed to spool request: %w", err)
+	}
+	logger.Log("info", "Spooled remote write request", slog.String("entry", name), slog.Int("size", len(data)))
+	return nil
+}
+
+// Trim discards the entries older than the age limit, and the oldest entries if the spool grows beyond its size limit
+func (s *Spool) Trim(ctx context.Context, logger types.Logger) error {
+
+	entries, err := s.Entries(ctx, logger)
+	if err != nil {
+		return err
+	}
+	// Newest entries are kept
+	var total int64
+	for i := len(entries) - 1; i >= 0; i-- {
+		total += entries[i].Size
+		if total > s.maxBytes() {
+			logger.Log("warn", "Discarding spooled request, spool size limit exceeded", slog.String("entry", entries[i].Name), slog.Int64("max_bytes", s.maxBytes()))
+			err := s.Store.Delete(ctx, entries[i].Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Entries returns the spooled requests ordered from oldest to newest. Entries older than the age limit are discarded.
+func (s *Spool) Entries(ctx context.Context, logger types.Logger) ([]Entry, error) {
+
+	names, err := s.Store.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list spool: %w", err)
+	}
+
+	entries := []Entry{}
+	for _, name := range names {
+		entry, err := parseEntryName(name)
+		if err != nil {
+			logger.Log("warn", "Ignoring unknown file in spool", slog.String("entry", name))
+			continue
+		}
+		if time.Since(entry.Created) > s.maxAge() {
+			logger.Log("warn", "Discarding spooled request, age limit exceeded", slog.String("entry", name), slog.Duration("max_age", s.maxAge()))
+			err := s.Store.Delete(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries, nil
+}
+
+// Replay reads the spooled requests from oldest to newest and passes them to the send function. Entries that are sent, or that send reports as permanently failed, are removed.
+// Replay stops at the first entry that send wants to keep, as the endpoint is likely still unavailable.
+func (s *Spool) Replay(ctx context.Context, logger types.Logger, send func(entry Entry, data []byte) (remove bool, err error)) error {
+
+	entries, err := s.Entries(ctx, logger)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	logger.Log("info", "Replaying spooled remote write requests", slog.Int("entry_count", len(entries)))
+
+	for i, entry := range entries {
+		data, err := s.Store.Get(ctx, entry.Name)
+		if err != nil {
+			return fmt.Errorf("failed to read spooled request: %w", err)
+		}
+		remove, err := send(entry, data)
+		if remove {
+			if deleteErr := s.Store.Delete(ctx, entry.Name); deleteErr != nil {
+				return deleteErr
+			}
+		}
+		if err != nil {
+			if !remove {
+				logger.Log("warn", "Stopping replay of spooled requests", slog.String("entry", entry.Name), slog.Int("remaining", len(entries)-i), slog.String("error", err.Error()))
+				return err
+			}
+			logger.Log("error", "Discarding spooled request that can't be sent", slog.String("entry", entry.Name), slog.String("error", err.Error()))
+			continue
+		}
+		logger.Log("info", "Replayed spooled request", slog.String("entry", entry.Name), slog.Duration("age", time.Since(entry.Created)))
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package spool
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kjansson/yac-p/v3/pkg/logger"
+)
+
+func TestSpoolOptions(t *testing.T) {
+
+	_, err := NewSpool(nil, SpoolOpts{})
+	if err == nil {
+		t.Fatalf("Expected error for missing store, got nil")
+	}
+
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	_, err = NewSpool(store, SpoolOpts{MaxAge: "yesterday"})
+	if err == nil {
+		t.Fatalf("Expected error for invalid max age, got nil")
+	}
+
+	s, err := NewSpool(store, SpoolOpts{MaxAge: "30m", MaxBytes: "1024"})
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+	if s.MaxAge != 30*time.Minute || s.MaxBytes != 1024 {
+		t.Fatalf("Spool options not set, got %s and %d", s.MaxAge, s.MaxBytes)
+	}
+}
+
+func TestEntryName(t *testing.T) {
+
+	created := time.Unix(1700000000, 123)
+	name, err := entryName(created, 2048, "2.0")
+	if err != nil {
+		t.Fatalf("Failed to create entry name: %v", err)
+	}
+	entry, err := parseEntryName(name)
+	if err != nil {
+		t.Fatalf("Failed to parse entry name %s: %v", name, err)
+	}
+	if !entry.Created.Equal(created) || entry.Size != 2048 || entry.Protocol != "2.0" {
+		t.Fatalf("Unexpected entry parsed from %s: %+v", name, entry)
+	}
+
+	_, err = parseEntryName("notes.txt")
+	if err == nil {
+		t.Fatalf("Expected error for unknown file name, got nil")
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	s, err := NewSpool(store, SpoolOpts{})
+	if err != nil {
+		t.Fatalf("Failed to create spool: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		err = s.Write(context.Background(), []byte(fmt.Sprintf("request-%d", i)), "1.0", logger)
+		if err != nil {
+			t.Fatalf("Failed to write to spool: %v", err)
+		}
+	}
+
+	// Replay stops at the first request that should be kept
+	replayed := []string{}
+	err = s.Replay(context.Background(), logger, func(entry Entry, data []byte) (bool, error) {
+		replayed = append(replayed, string(data))
+		if string(data) == "request-1" {
+			return false, fmt.Errorf("endpoint unavailable")
+		}
+		return true, nil
+	})
+	if err == nil {
+		t.Fatalf("Expected error from stopped replay, got nil")
+	}
+	if len(replayed) != 2 || replayed[0] != "request-0" || replayed[1] != "request-1" {
+		t.Fatalf("Expected request-0 and request-1 to be replayed in order, got %v", replayed)
+	}
+
+	// Requests reported as permanently failed are removed
+	replayed = []string{}
+	err = s.Replay(context.Background(), logger, func(entry Entry, data []byte) (bool, error) {
+		replayed = append(replayed, string(data))
+		if string(data) == "request-1" {
+			return true, fmt.Errorf("rejected")
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to replay spool: %v", err)
+	}
+	if len(replayed) != 2 || replayed[0] != "request-1" || replayed[1] != "request-2" {
+		t.Fatalf("Expected request-1 and request-2 to be replayed in order, got %v", replayed)
+	}
+
+	entries, err := s.Entries(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected empty spool after replay, got %d entries", len(entries))
+	}
+}
+
+func TestSpoolLimits(t *testing.T) {
+
+	logger, err := logger.NewLogger(os.Stdout, "text", logger.LoggerOpts{})
+	if err != nil {
+		t.Fatalf("Failed to initialize logger: %v", err)
+	}
+
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	s := &Spool{Store: store, MaxBytes: 25}
+
+	for i := 0; i < 3; i++ {
+		err = s.Write(context.Background(), []byte(fmt.Sprintf("request-%d", i)), "1.0", logger)
+		if err != nil {
+			t.Fatalf("Failed to write to spool: %v", err)
+		}
+	}
+	entries, err := s.Entries(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected the size limit to be enforced by trimming, got %d entries", len(entries))
+	}
+	err = s.Trim(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to trim spool: %v", err)
+	}
+	entries, err = s.Entries(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the oldest entry to be discarded by the size limit, got %d entries", len(entries))
+	}
+
+	err = s.Write(context.Background(), make([]byte, 26), "1.0", logger)
+	if err == nil {
+		t.Fatalf("Expected error for request exceeding the size limit, got nil")
+	}
+
+	// Entries older than the age limit are discarded
+	name, err := entryName(time.Now().Add(-2*time.Hour), 9, "1.0")
+	if err != nil {
+		t.Fatalf("Failed to create entry name: %v", err)
+	}
+	err = store.Put(context.Background(), name, []byte("request-x"))
+	if err != nil {
+		t.Fatalf("Failed to write to store: %v", err)
+	}
+	entries, err = s.Entries(context.Background(), logger)
+	if err != nil {
+		t.Fatalf("Failed to list spool: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the expired entry to be discarded, got %d entries", len(entries))
+	}
+	names, err := store.List(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to list store: %v", err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("Expected the expired entry to be deleted from the store, got %v", names)
+	}
+}
@@ -0,0 +1,44 @@
+// Package tracing provides OpenTelemetry tracing for the collect, convert and persist pipeline. Spans are created with the global tracer provider, so they cost nothing unless a provider is set.
+// Only the OpenTelemetry API is used, setting up a provider and exporter is left to the application.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const TracerName = "github.com/kjansson/yac-p/v3" // Name of the tracer creating the spans of yac-p
+
+// Attribute keys used on the spans
+const (
+	AttrSeries         = attribute.Key("yacp.series")          // Number of time series
+	AttrMetricFamilies = attribute.Key("yacp.metric_families") // Number of metric families
+	AttrMetrics        = attribute.Key("yacp.metrics")         // Number of metrics in the metric families
+	AttrChunks         = attribute.Key("yacp.chunks")          // Number of chunks of time series
+	AttrInputSeries    = attribute.Key("yacp.input_series")    // Number of time series before processing
+	AttrInputMetrics   = attribute.Key("yacp.input_metrics")   // Number of metrics before filtering or converting
+	AttrBytes          = attribute.Key("yacp.bytes")           // Size in bytes of the compressed request body
+)
+
+// Tracer returns the tracer of yac-p from the global tracer provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// Start starts a span with the tracer of yac-p
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records the error on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,161 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kjansson/yac-p/v3/pkg/tracing"
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// testCollector exports families with the given number of metrics each
+type testCollector struct {
+	families int
+	metrics  int
+}
+
+func (c *testCollector) CollectMetrics(logger Logger) error {
+	return nil
+}
+
+func (c *testCollector) ExportMetrics(logger Logger) ([]*io_prometheus_client.MetricFamily, error) {
+	families := []*io_prometheus_client.MetricFamily{}
+	for range c.families {
+		family := &io_prometheus_client.MetricFamily{}
+		for range c.metrics {
+			family.Metric = append(family.Metric, &io_prometheus_client.Metric{})
+		}
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// testConverter converts every metric into a time series
+type testConverter struct{}
+
+func (c *testConverter) ConvertMetrics(metrics []*io_prometheus_client.MetricFamily, logger Logger) ([]prompb.TimeSeries, error) {
+	return make([]prompb.TimeSeries, countMetrics(metrics)), nil
+}
+
+// testPersister fails with the given error, if any
+type testPersister struct {
+	err error
+}
+
+func (p *testPersister) PersistMetrics(timeSeries []prompb.TimeSeries, logger Logger) error {
+	return p.err
+}
+
+// intAttr returns the value of an integer attribute of a span, -1 if not set
+func intAttr(span tracetest.SpanStub, key string) int64 {
+	for _, attr := range span.Attributes {
+		if string(attr.Key) == key {
+			return attr.Value.AsInt64()
+		}
+	}
+	return -1
+}
+
+func TestPipelineSpans(t *testing.T) {
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	persister := &testPersister{}
+	c := &Controller{
+		Logger:     &testLogger{},
+		Collector:  &testCollector{families: 3, metrics: 10},
+		Filters:    []MetricFilter{&testFilter{}},
+		Converter:  &testConverter{},
+		Processors: []MetricProcessor{&testProcessor{}},
+		Persister:  persister,
+	}
+
+	ctx, run := tracing.Start(context.Background(), "yacp.run")
+	err := c.CollectMetricsContext(ctx)
+	if err != nil {
+		t.Fatalf("Failed to collect metrics: %v", err)
+	}
+	metrics, err := c.ExportMetricsContext(ctx)
+	if err != nil {
+		t.Fatalf("Failed to export metrics: %v", err)
+	}
+	metrics, err = c.FilterMetricsContext(ctx, metrics)
+	if err != nil {
+		t.Fatalf("Failed to filter metrics: %v", err)
+	}
+	timeSeries, err := c.ConvertMetricsContext(ctx, metrics)
+	if err != nil {
+		t.Fatalf("Failed to convert metrics: %v", err)
+	}
+	timeSeries, err = c.ProcessMetricsContext(ctx, timeSeries)
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	err = c.PersistMetricsContext(ctx, timeSeries, nil)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	run.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 7 {
+		t.Fatalf("Expected 7 spans, got %d", len(spans))
+	}
+	root := spans[len(spans)-1]
+	expected := []struct {
+		name  string
+		attrs map[string]int64
+	}{
+		{"yacp.collect", nil},
+		{"yacp.export", map[string]int64{"yacp.metric_families": 3, "yacp.metrics": 30}},
+		{"yacp.filter", map[string]int64{"yacp.input_metrics": 30, "yacp.metrics": 30}},
+		{"yacp.convert", map[string]int64{"yacp.input_metrics": 30, "yacp.series": 30}},
+		{"yacp.process", map[string]int64{"yacp.input_series": 30, "yacp.series": 30}},
+		{"yacp.persist", map[string]int64{"yacp.series": 30}},
+	}
+	for i, e := range expected {
+		span := spans[i]
+		if span.Name != e.name || span.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Fatalf("Expected span %s as a child of the run span, got %s", e.name, span.Name)
+		}
+		for key, value := range e.attrs {
+			if intAttr(span, key) != value {
+				t.Fatalf("Expected %s %d on span %s, got %v", key, value, span.Name, span.Attributes)
+			}
+		}
+	}
+
+	// Streaming records the chunks on the persist span
+	exporter.Reset()
+	err = c.PersistMetricsStream(context.Background(), func(yield func([]prompb.TimeSeries, error) bool) {
+		_ = yield(make([]prompb.TimeSeries, 20), nil) && yield(make([]prompb.TimeSeries, 10), nil)
+	}, nil)
+	if err != nil {
+		t.Fatalf("Failed to persist metrics: %v", err)
+	}
+	spans = exporter.GetSpans()
+	if len(spans) != 1 || intAttr(spans[0], "yacp.series") != 30 || intAttr(spans[0], "yacp.chunks") != 2 {
+		t.Fatalf("Expected 30 series in 2 chunks on the persist span, got %v", spans)
+	}
+
+	// Failures are recorded on the span of the stage
+	exporter.Reset()
+	persister.err = errors.New("endpoint unavailable")
+	err = c.PersistMetricsContext(context.Background(), timeSeries, nil)
+	if err == nil {
+		t.Fatalf("Expected error from persister, got nil")
+	}
+	spans = exporter.GetSpans()
+	if len(spans) != 1 || spans[0].Status.Code != codes.Error || spans[0].Status.Description != "endpoint unavailable" {
+		t.Fatalf("Expected failed persist span, got %v", spans)
+	}
+}
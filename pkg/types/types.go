@@ -2,36 +2,146 @@
 package types
 
 import (
+	"context"
+	"iter"
+	"sort"
+	"strings"
+
+	"github.com/kjansson/yac-p/v3/pkg/tracing"
 	io_prometheus_client "github.com/prometheus/client_model/go"
 	"github.com/prometheus/prometheus/prompb"
 )
 
+// Components of the controller that can be given their own logger
+const (
+	ComponentCollector = "collector"
+	ComponentFilter    = "filter"
+	ComponentConverter = "converter"
+	ComponentProcessor = "processor"
+	ComponentPersister = "persister"
+)
+
 // Logger is an interface for logging
 type Logger interface {
 	Log(level string, msg string, args ...any)
 }
 
+// ComponentLogger is an optional interface for loggers that log differently for each component, e.g. with their own level
+type ComponentLogger interface {
+	Logger
+	Component(name string) Logger
+}
+
+// ErrorRedactor is an optional interface for loggers that mask secrets, to mask them in returned errors as well
+type ErrorRedactor interface {
+	RedactError(error) error
+}
+
+// SecretHolder is an optional interface for components holding secrets, such as passwords and tokens, that must not show up in logs and errors
+type SecretHolder interface {
+	Secrets() []string
+}
+
 // MetricCollector is an interface for collecting metrics and export them in Prometheus format
 type MetricCollector interface {
 	CollectMetrics(Logger) error
 	ExportMetrics(Logger) ([]*io_prometheus_client.MetricFamily, error)
 }
 
+// MetricFilter is an interface for filtering Prometheus metrics after collection, before they are converted
+type MetricFilter interface {
+	FilterMetrics([]*io_prometheus_client.MetricFamily, Logger) ([]*io_prometheus_client.MetricFamily, error)
+}
+
 // MetricConverter is an interface for converting Prometheus metrics to timeseries format
 type MetricConverter interface {
 	ConvertMetrics([]*io_prometheus_client.MetricFamily, Logger) ([]prompb.TimeSeries, error)
 }
 
+// MetricProcessor is an interface for processing time series between conversion and persisting, e.g. relabeling or filtering
+type MetricProcessor interface {
+	ProcessMetrics([]prompb.TimeSeries, Logger) ([]prompb.TimeSeries, error)
+}
+
 // MetricPersister is an interface for persisting Prometheus time series data
 type MetricPersister interface {
 	PersistMetrics([]prompb.TimeSeries, Logger) error
 }
 
+// ContextMetricCollector is an optional interface for collectors that stop collecting when the context is cancelled
+type ContextMetricCollector interface {
+	CollectMetricsContext(context.Context, Logger) error
+}
+
+// ContextMetricConverter is an optional interface for converters that stop converting when the context is cancelled
+type ContextMetricConverter interface {
+	ConvertMetricsContext(context.Context, []*io_prometheus_client.MetricFamily, Logger) ([]prompb.TimeSeries, error)
+}
+
+// ContextMetricPersister is an optional interface for persisters that stop sending when the context is cancelled
+type ContextMetricPersister interface {
+	PersistMetricsContext(context.Context, []prompb.TimeSeries, Logger) error
+}
+
+// StreamMetricConverter is an optional interface for converters that can emit time series in chunks as they are converted, instead of all at once
+type StreamMetricConverter interface {
+	ConvertMetricsStream(context.Context, []*io_prometheus_client.MetricFamily, Logger) iter.Seq2[[]prompb.TimeSeries, error]
+}
+
+// StreamMetricPersister is an optional interface for persisters that can send chunks of time series as they arrive
+type StreamMetricPersister interface {
+	PersistMetricsStream(context.Context, iter.Seq2[[]prompb.TimeSeries, error], Logger) error
+}
+
+// MetricMetadata holds information about converted metrics that is not part of the time series themselves
+type MetricMetadata struct {
+	Families          []prompb.MetricMetadata // Type, help and unit of each metric family
+	CreatedTimestamps map[string]int64        // Created timestamps in milliseconds, keyed by the SeriesKey of the time series labels
+}
+
+// MetadataConverter is an optional interface for converters that can extract metadata from Prometheus metrics
+type MetadataConverter interface {
+	ConvertMetadata([]*io_prometheus_client.MetricFamily, Logger) (*MetricMetadata, error)
+}
+
+// MetadataPersister is an optional interface for persisters that can forward metric metadata along with chunks of time series
+type MetadataPersister interface {
+	PersistMetricsWithMetadata(context.Context, iter.Seq2[[]prompb.TimeSeries, error], *MetricMetadata, Logger) error
+}
+
+// SeriesKey returns a key identifying a time series by its label set, regardless of label order
+func SeriesKey(labels []prompb.Label) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, label.Name+"\xff"+label.Value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
 type Controller struct {
-	Logger    Logger          // Logger component
-	Collector MetricCollector // Collector component
-	Converter MetricConverter // Converter component
-	Persister MetricPersister // Persister component
+	Logger     Logger            // Logger component
+	Collector  MetricCollector   // Collector component
+	Filters    []MetricFilter    // Filter components, applied in order before conversion (optional)
+	Converter  MetricConverter   // Converter component
+	Processors []MetricProcessor // Processor components, applied in order (optional)
+	Persister  MetricPersister   // Persister component
+}
+
+// componentLogger returns the logger of a component, if the logger has one for each component
+func (c *Controller) componentLogger(name string) Logger {
+	if logger, ok := c.Logger.(ComponentLogger); ok {
+		return logger.Component(name)
+	}
+	return c.Logger
+}
+
+// redactError masks secrets in an error, if the logger supports it
+func (c *Controller) redactError(err error) error {
+	if redactor, ok := c.Logger.(ErrorRedactor); ok {
+		return redactor.RedactError(err)
+	}
+	return err
 }
 
 // Log extends the logger interface
@@ -41,28 +151,220 @@ func (c *Controller) Log(level string, msg string, args ...any) {
 
 // GetRegistry extends the underlying method triggers metrics collection in the Collector component
 func (c *Controller) CollectMetrics() error {
-	return c.Collector.CollectMetrics(c.Logger)
+	return c.Collector.CollectMetrics(c.componentLogger(ComponentCollector))
+}
+
+// CollectMetricsContext is like CollectMetrics but stops collecting when the context is cancelled, if the Collector component supports it
+func (c *Controller) CollectMetricsContext(ctx context.Context) (err error) {
+	ctx, span := tracing.Start(ctx, "yacp.collect")
+	defer func() { tracing.End(span, err) }()
+
+	if collector, ok := c.Collector.(ContextMetricCollector); ok {
+		return collector.CollectMetricsContext(ctx, c.componentLogger(ComponentCollector))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Collector.CollectMetrics(c.componentLogger(ComponentCollector))
 }
 
 // GetRegistry extendes the underlying method and extracts the metrics from the prometheus registry in the Collector component
 func (c *Controller) ExportMetrics() ([]*io_prometheus_client.MetricFamily, error) {
-	metrics, err := c.Collector.ExportMetrics(c.Logger)
+	return c.ExportMetricsContext(context.Background())
+}
+
+// ExportMetricsContext is like ExportMetrics, with the span of the export as a child of the span in the context
+func (c *Controller) ExportMetricsContext(ctx context.Context) (metrics []*io_prometheus_client.MetricFamily, err error) {
+	_, span := tracing.Start(ctx, "yacp.export")
+	defer func() {
+		span.SetAttributes(tracing.AttrMetricFamilies.Int(len(metrics)), tracing.AttrMetrics.Int(countMetrics(metrics)))
+		tracing.End(span, err)
+	}()
+
+	metrics, err = c.Collector.ExportMetrics(c.componentLogger(ComponentCollector))
 	if err != nil {
 		return nil, err
 	}
 	return metrics, nil
 }
 
+// FilterMetrics runs the metrics through the Filter components in order
+func (c *Controller) FilterMetrics(metrics []*io_prometheus_client.MetricFamily) ([]*io_prometheus_client.MetricFamily, error) {
+	return c.FilterMetricsContext(context.Background(), metrics)
+}
+
+// FilterMetricsContext is like FilterMetrics, with the span of the filtering as a child of the span in the context
+func (c *Controller) FilterMetricsContext(ctx context.Context, metrics []*io_prometheus_client.MetricFamily) (filtered []*io_prometheus_client.MetricFamily, err error) {
+	if len(c.Filters) == 0 {
+		return metrics, nil
+	}
+	_, span := tracing.Start(ctx, "yacp.filter", tracing.AttrInputMetrics.Int(countMetrics(metrics)))
+	defer func() {
+		span.SetAttributes(tracing.AttrMetrics.Int(countMetrics(filtered)))
+		tracing.End(span, err)
+	}()
+
+	for _, filter := range c.Filters {
+		metrics, err = filter.FilterMetrics(metrics, c.componentLogger(ComponentFilter))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
+
 // ConvertMetrics extends the underlying method and converts metrics to timeseries format using the Converter component
 func (c *Controller) ConvertMetrics(metrics []*io_prometheus_client.MetricFamily) ([]prompb.TimeSeries, error) {
-	timeSeries, err := c.Converter.ConvertMetrics(metrics, c.Logger)
+	timeSeries, err := c.Converter.ConvertMetrics(metrics, c.componentLogger(ComponentConverter))
 	if err != nil {
 		return nil, err
 	}
 	return timeSeries, nil
 }
 
+// ConvertMetricsContext is like ConvertMetrics but stops converting when the context is cancelled, if the Converter component supports it
+func (c *Controller) ConvertMetricsContext(ctx context.Context, metrics []*io_prometheus_client.MetricFamily) (timeSeries []prompb.TimeSeries, err error) {
+	ctx, span := tracing.Start(ctx, "yacp.convert", tracing.AttrInputMetrics.Int(countMetrics(metrics)))
+	defer func() {
+		span.SetAttributes(tracing.AttrSeries.Int(len(timeSeries)))
+		tracing.End(span, err)
+	}()
+
+	if converter, ok := c.Converter.(ContextMetricConverter); ok {
+		return converter.ConvertMetricsContext(ctx, metrics, c.componentLogger(ComponentConverter))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.ConvertMetrics(metrics)
+}
+
+// ProcessMetrics runs the timeseries through the Processor components in order
+func (c *Controller) ProcessMetrics(timeSeries []prompb.TimeSeries) ([]prompb.TimeSeries, error) {
+	return c.ProcessMetricsContext(context.Background(), timeSeries)
+}
+
+// ProcessMetricsContext is like ProcessMetrics, with the span of the processing as a child of the span in the context
+func (c *Controller) ProcessMetricsContext(ctx context.Context, timeSeries []prompb.TimeSeries) (processed []prompb.TimeSeries, err error) {
+	if len(c.Processors) == 0 {
+		return timeSeries, nil
+	}
+	_, span := tracing.Start(ctx, "yacp.process", tracing.AttrInputSeries.Int(len(timeSeries)))
+	defer func() {
+		span.SetAttributes(tracing.AttrSeries.Int(len(processed)))
+		tracing.End(span, err)
+	}()
+
+	for _, processor := range c.Processors {
+		timeSeries, err = processor.ProcessMetrics(timeSeries, c.componentLogger(ComponentProcessor))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return timeSeries, nil
+}
+
+// ConvertMetricsStream converts the metrics into chunks of time series using the Converter component, and runs each chunk through the Processor components.
+// Converters without streaming support produce a single chunk.
+func (c *Controller) ConvertMetricsStream(ctx context.Context, metrics []*io_prometheus_client.MetricFamily) iter.Seq2[[]prompb.TimeSeries, error] {
+	chunks := func(yield func([]prompb.TimeSeries, error) bool) {
+		yield(c.ConvertMetricsContext(ctx, metrics))
+	}
+	if converter, ok := c.Converter.(StreamMetricConverter); ok {
+		chunks = converter.ConvertMetricsStream(ctx, metrics, c.componentLogger(ComponentConverter))
+	}
+	return func(yield func([]prompb.TimeSeries, error) bool) {
+		for chunk, err := range chunks {
+			if err == nil {
+				chunk, err = c.ProcessMetricsContext(ctx, chunk)
+			}
+			if !yield(chunk, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
 // PersistMetrics extends the underlying method and persists timeseries to the remote write endpoint using the Persister component
 func (c *Controller) PersistMetrics(timeSeries []prompb.TimeSeries) error {
-	return c.Persister.PersistMetrics(timeSeries, c.Logger)
+	return c.redactError(c.Persister.PersistMetrics(timeSeries, c.componentLogger(ComponentPersister)))
+}
+
+// PersistMetricsContext is like PersistMetrics but stops sending when the context is cancelled, if the Persister component supports it.
+// The metric metadata (optional) is sent along with the time series, if the Persister component supports it.
+func (c *Controller) PersistMetricsContext(ctx context.Context, timeSeries []prompb.TimeSeries, metadata *MetricMetadata) (err error) {
+	ctx, span := tracing.Start(ctx, "yacp.persist", tracing.AttrSeries.Int(len(timeSeries)))
+	defer func() { tracing.End(span, err) }()
+
+	return c.persistMetrics(ctx, timeSeries, metadata)
+}
+
+// persistMetrics sends the time series and metadata using the Persister component, with secrets masked in the returned error
+func (c *Controller) persistMetrics(ctx context.Context, timeSeries []prompb.TimeSeries, metadata *MetricMetadata) error {
+	if persister, ok := c.Persister.(MetadataPersister); ok {
+		return c.redactError(persister.PersistMetricsWithMetadata(ctx, func(yield func([]prompb.TimeSeries, error) bool) {
+			yield(timeSeries, nil)
+		}, metadata, c.componentLogger(ComponentPersister)))
+	}
+	if persister, ok := c.Persister.(ContextMetricPersister); ok {
+		return c.redactError(persister.PersistMetricsContext(ctx, timeSeries, c.componentLogger(ComponentPersister)))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.redactError(c.Persister.PersistMetrics(timeSeries, c.componentLogger(ComponentPersister)))
+}
+
+// PersistMetricsStream sends the chunks of time series as they arrive using the Persister component. Persisters without streaming support get all chunks at once.
+// The metric metadata (optional) is sent along with the time series, if the Persister component supports it.
+func (c *Controller) PersistMetricsStream(ctx context.Context, chunks iter.Seq2[[]prompb.TimeSeries, error], metadata *MetricMetadata) (err error) {
+	ctx, span := tracing.Start(ctx, "yacp.persist")
+	series, count := 0, 0
+	defer func() {
+		span.SetAttributes(tracing.AttrSeries.Int(series), tracing.AttrChunks.Int(count))
+		tracing.End(span, err)
+	}()
+	counted := func(yield func([]prompb.TimeSeries, error) bool) {
+		for chunk, err := range chunks {
+			if err == nil {
+				series, count = series+len(chunk), count+1
+			}
+			if !yield(chunk, err) {
+				return
+			}
+		}
+	}
+
+	if persister, ok := c.Persister.(MetadataPersister); ok {
+		return c.redactError(persister.PersistMetricsWithMetadata(ctx, counted, metadata, c.componentLogger(ComponentPersister)))
+	}
+	if persister, ok := c.Persister.(StreamMetricPersister); ok {
+		return c.redactError(persister.PersistMetricsStream(ctx, counted, c.componentLogger(ComponentPersister)))
+	}
+	timeSeries := []prompb.TimeSeries{}
+	for chunk, err := range counted {
+		if err != nil {
+			return err
+		}
+		timeSeries = append(timeSeries, chunk...)
+	}
+	return c.persistMetrics(ctx, timeSeries, metadata)
+}
+
+// countMetrics returns the number of metrics in the metric families
+func countMetrics(metrics []*io_prometheus_client.MetricFamily) int {
+	count := 0
+	for _, family := range metrics {
+		count += len(family.GetMetric())
+	}
+	return count
+}
+
+// ConvertMetadata extends the underlying method and extracts metric metadata using the Converter component, if it supports it
+func (c *Controller) ConvertMetadata(metrics []*io_prometheus_client.MetricFamily) (*MetricMetadata, error) {
+	converter, ok := c.Converter.(MetadataConverter)
+	if !ok {
+		return nil, nil
+	}
+	return converter.ConvertMetadata(metrics, c.componentLogger(ComponentConverter))
 }
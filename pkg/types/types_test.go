@@ -0,0 +1,66 @@
+package types
+
+import (
+	"testing"
+
+	io_prometheus_client "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// testLogger is a logger with a child logger for each component, recording the component it belongs to
+type testLogger struct {
+	component string
+}
+
+func (l *testLogger) Log(level string, msg string, args ...any) {}
+
+func (l *testLogger) Component(name string) Logger {
+	return &testLogger{component: name}
+}
+
+// testProcessor records the logger it is given
+type testProcessor struct {
+	logger Logger
+}
+
+func (p *testProcessor) ProcessMetrics(timeSeries []prompb.TimeSeries, logger Logger) ([]prompb.TimeSeries, error) {
+	p.logger = logger
+	return timeSeries, nil
+}
+
+// testFilter records the logger it is given
+type testFilter struct {
+	logger Logger
+}
+
+func (f *testFilter) FilterMetrics(metrics []*io_prometheus_client.MetricFamily, logger Logger) ([]*io_prometheus_client.MetricFamily, error) {
+	f.logger = logger
+	return metrics, nil
+}
+
+func TestComponentLoggers(t *testing.T) {
+
+	filter := &testFilter{}
+	processor := &testProcessor{}
+	c := &Controller{
+		Logger:     &testLogger{},
+		Filters:    []MetricFilter{filter},
+		Processors: []MetricProcessor{processor},
+	}
+
+	_, err := c.FilterMetrics([]*io_prometheus_client.MetricFamily{})
+	if err != nil {
+		t.Fatalf("Failed to filter metrics: %v", err)
+	}
+	if l, ok := filter.logger.(*testLogger); !ok || l.component != ComponentFilter {
+		t.Fatalf("Expected the filter component logger, got %+v", filter.logger)
+	}
+
+	_, err = c.ProcessMetrics([]prompb.TimeSeries{})
+	if err != nil {
+		t.Fatalf("Failed to process metrics: %v", err)
+	}
+	if l, ok := processor.logger.(*testLogger); !ok || l.component != ComponentProcessor {
+		t.Fatalf("Expected the processor component logger, got %+v", processor.logger)
+	}
+}